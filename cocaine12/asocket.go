@@ -2,6 +2,8 @@ package cocaine12
 
 import (
 	"bufio"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -164,6 +166,8 @@ type asyncRWSocket struct {
 	upstreamBuf   *asyncBuff
 	downstreamBuf *asyncBuff
 	closed        chan struct{} // broadcast channel
+	// writeErr is the error, which has closed the socket
+	writeErr error
 }
 
 func newAsyncRW(conn io.ReadWriteCloser) (*asyncRWSocket, error) {
@@ -181,16 +185,30 @@ func newAsyncRW(conn io.ReadWriteCloser) (*asyncRWSocket, error) {
 }
 
 func newUnixConnection(address string, timeout time.Duration) (socketIO, error) {
-	return newAsyncConnection("unix", address, timeout)
+	return newAsyncConnection("unix", address, timeout, 0, nil)
 }
 
 func newTCPConnection(address string, timeout time.Duration) (socketIO, error) {
-	return newAsyncConnection("tcp", address, timeout)
+	return newAsyncConnection("tcp", address, timeout, 0, nil)
 }
 
-func newAsyncConnection(family string, address string, timeout time.Duration) (socketIO, error) {
+// WithTLS makes the Service and the locator resolving it connect
+// over TLS with the given config. Certificates of the config are sent
+// to the server, which enables mutual TLS. Connections are plaintext
+// by default. Pass the Service to NewLoggerWithService to log over TLS.
+func WithTLS(config *tls.Config) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.tlsConfig = config
+	}
+}
+
+// newAsyncConnection dials the address. keepAlive is the period
+// of TCP keepalive probes, zero means the default of net.Dialer.
+// The connection is wrapped into TLS, if tlsConfig is not nil.
+func newAsyncConnection(family string, address string, timeout, keepAlive time.Duration, tlsConfig *tls.Config) (socketIO, error) {
 	dialer := net.Dialer{
 		Timeout:   timeout,
+		KeepAlive: keepAlive,
 		DualStack: true,
 	}
 
@@ -198,9 +216,41 @@ func newAsyncConnection(family string, address string, timeout time.Duration) (s
 	if err != nil {
 		return nil, err
 	}
+
+	if tlsConfig != nil && family == "tcp" {
+		if conn, err = tlsHandshake(conn, address, tlsConfig, timeout); err != nil {
+			return nil, err
+		}
+	}
+
 	return newAsyncRW(conn)
 }
 
+// tlsHandshake wraps the connection into TLS. The connection
+// is closed if the handshake fails.
+func tlsHandshake(conn net.Conn, address string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", address, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
 func (sock *asyncRWSocket) Close() {
 	sock.upstreamBuf.Stop()
 	sock.downstreamBuf.Stop()
@@ -219,6 +269,37 @@ func (sock *asyncRWSocket) close() {
 	}
 }
 
+// fail closes the socket because of the write error.
+// The error is kept unless the socket has been closed already.
+func (sock *asyncRWSocket) fail(err error) {
+	sock.Lock()
+	select {
+	case <-sock.closed:
+	default:
+		sock.writeErr = err
+	}
+	sock.Unlock()
+
+	sock.close()
+}
+
+// writeError returns the error, which has failed the writes
+func (sock *asyncRWSocket) writeError() error {
+	sock.Lock()
+	defer sock.Unlock()
+	return sock.writeErr
+}
+
+// socketWriteError returns the write error of the socket if it keeps one
+func socketWriteError(sock socketIO) error {
+	if s, ok := sock.(interface {
+		writeError() error
+	}); ok {
+		return s.writeError()
+	}
+	return nil
+}
+
 func (sock *asyncRWSocket) IsClosed() (broadcast <-chan struct{}) {
 	return sock.closed
 }
@@ -244,10 +325,37 @@ func (sock *asyncRWSocket) writeloop() {
 	go func() {
 		var buf = bufio.NewWriter(sock.conn)
 		encoder := codec.NewEncoder(buf, hAsocket)
+		// flush markers are released once the buffer is flushed
+		var markers []chan struct{}
+		encode := func(msg *Message) error {
+			if msg.written != nil {
+				markers = append(markers, msg.written)
+				return nil
+			}
+			return encoder.Encode(msg)
+		}
+
 		for incoming := range sock.upstreamBuf.out {
-			err := encoder.Encode(incoming)
+			err := encode(incoming)
+		COALESCE_LOOP:
+			// messages queued meanwhile are written with one syscall
+			for err == nil {
+				select {
+				case next, ok := <-sock.upstreamBuf.out:
+					if !ok {
+						break COALESCE_LOOP
+					}
+					err = encode(next)
+				default:
+					break COALESCE_LOOP
+				}
+			}
+
+			if err == nil {
+				err = buf.Flush()
+			}
 			if err != nil {
-				sock.close()
+				sock.fail(err)
 				// blackhole all pending writes. See #31
 				go func() {
 					for _ = range sock.upstreamBuf.out {
@@ -256,7 +364,10 @@ func (sock *asyncRWSocket) writeloop() {
 				}()
 				return
 			}
-			buf.Flush()
+			for _, written := range markers {
+				close(written)
+			}
+			markers = markers[:0]
 		}
 	}()
 }
@@ -1,10 +1,19 @@
 package cocaine12
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func TestASocketDrain(t *testing.T) {
@@ -41,3 +50,96 @@ func TestASocketConnect(t *testing.T) {
 	_, err = newUnixConnection("unix.sock", time.Second)
 	assert.Error(t, err)
 }
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cocaine"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestASocketTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Skip("unable to listen", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			defer conn.Close()
+		}
+	}()
+	address := ln.Addr().String()
+
+	// the client certificate is required
+	config := &tls.Config{RootCAs: pool}
+	if sock, err := newAsyncConnection("tcp", address, time.Second, 0, config); err == nil {
+		// TLS 1.3 reports the rejected certificate after the handshake
+		select {
+		case <-sock.IsClosed():
+		case <-time.After(time.Second):
+			t.Error("the connection without a client certificate is not closed")
+		}
+	}
+
+	// the server certificate is unknown
+	config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	_, err = newAsyncConnection("tcp", address, time.Second, 0, config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "TLS handshake")
+	}
+
+	// NewService reports the handshake failure of the locator
+	_, err = NewService(context.Background(), "storage", []string{address}, WithTLS(config))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "TLS handshake")
+	}
+
+	config = &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}
+	sock, err := newAsyncConnection("tcp", address, time.Second, 0, config)
+	if assert.NoError(t, err) {
+		sock.Close()
+	}
+
+	// plaintext is the default
+	sock, err = newTCPConnection(address, time.Second)
+	if assert.NoError(t, err) {
+		sock.Close()
+	}
+}
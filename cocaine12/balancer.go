@@ -0,0 +1,308 @@
+package cocaine12
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// a lost backend is replaced by re-resolving the service in background
+	balancerResolveTimeout = 5 * time.Second
+	// removed backends are given time to finish their calls
+	balancerDrainTimeout = 30 * time.Second
+)
+
+// ErrBalancedServiceClosed is returned by BalancedService.Call after Close
+var ErrBalancedServiceClosed = errors.New("balanced service is closed")
+
+// LoadBalancePolicy chooses a backend of BalancedService for a new session
+type LoadBalancePolicy int
+
+const (
+	// RoundRobin spreads sessions across the backends in turn
+	RoundRobin LoadBalancePolicy = iota
+	// LeastOutstanding chooses the backend with the fewest calls in flight
+	LeastOutstanding
+)
+
+type backend struct {
+	endpoint string
+	service  *Service
+}
+
+// BalancedService resolves a service through several locators
+// and connects to every resolved endpoint. New sessions are spread
+// across the connected endpoints according to the policy.
+// When an endpoint is disconnected, the service is resolved again.
+type BalancedService struct {
+	policy LoadBalancePolicy
+	next   uint64
+
+	mu       sync.RWMutex
+	backends []*backend
+	closed   bool
+
+	resolveMu sync.Mutex
+	resolving int32
+
+	// resolve and dial are replaced in tests
+	resolve func(ctx context.Context) (*ServiceInfo, error)
+	dial    func(ctx context.Context, info *ServiceInfo, endpoint EndpointItem) (*Service, error)
+}
+
+// NewBalancedService resolves the service through each of the locator
+// endpoints and connects to all endpoints of the service.
+// It returns an error if no endpoint has been connected.
+func NewBalancedService(ctx context.Context, name string, endpoints []string, policy LoadBalancePolicy) (*BalancedService, error) {
+	resolve := func(ctx context.Context) (*ServiceInfo, error) {
+		return resolveAll(ctx, name, endpoints)
+	}
+
+	dial := func(ctx context.Context, info *ServiceInfo, endpoint EndpointItem) (*Service, error) {
+		sock, err := serviceCreateIO([]EndpointItem{endpoint}, serviceOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to service %s: %s", name, err)
+		}
+		return newService(name, endpoints, info, sock, serviceOptions{}), nil
+	}
+
+	return newBalancedService(ctx, policy, resolve, dial)
+}
+
+func newBalancedService(ctx context.Context, policy LoadBalancePolicy,
+	resolve func(context.Context) (*ServiceInfo, error),
+	dial func(context.Context, *ServiceInfo, EndpointItem) (*Service, error)) (*BalancedService, error) {
+	b := &BalancedService{
+		policy:  policy,
+		resolve: resolve,
+		dial:    dial,
+	}
+
+	if err := b.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// resolveAll merges the endpoints of the service resolved by each locator
+func resolveAll(ctx context.Context, name string, locators []string) (*ServiceInfo, error) {
+	if len(locators) == 0 {
+		return serviceResolve(ctx, name, nil, nil)
+	}
+
+	var (
+		merged  *ServiceInfo
+		seen    = make(map[string]bool)
+		lastErr error
+	)
+	for _, locator := range locators {
+		info, err := serviceResolve(ctx, name, []string{locator}, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if merged == nil {
+			merged = &ServiceInfo{Version: info.Version, API: info.API}
+		}
+		for _, endpoint := range info.Endpoints {
+			if !seen[endpoint.String()] {
+				seen[endpoint.String()] = true
+				merged.Endpoints = append(merged.Endpoints, endpoint)
+			}
+		}
+	}
+
+	if merged == nil {
+		return nil, fmt.Errorf("Unable to resolve service %s: %v", name, lastErr)
+	}
+
+	return merged, nil
+}
+
+// refresh resolves the service and connects to new endpoints.
+// Connected backends are kept, disconnected and removed ones are closed.
+func (b *BalancedService) refresh(ctx context.Context) error {
+	b.resolveMu.Lock()
+	defer b.resolveMu.Unlock()
+
+	info, err := b.resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]*backend)
+	b.mu.RLock()
+	for _, be := range b.backends {
+		if !be.service.disconnected() {
+			current[be.endpoint] = be
+		}
+	}
+	b.mu.RUnlock()
+
+	var (
+		backends []*backend
+		kept     = make(map[*backend]bool)
+		lastErr  error
+	)
+	for _, endpoint := range info.Endpoints {
+		key := endpoint.String()
+		if be, ok := current[key]; ok {
+			backends = append(backends, be)
+			kept[be] = true
+			continue
+		}
+
+		s, err := b.dial(ctx, info, endpoint)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		backends = append(backends, &backend{endpoint: key, service: s})
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		for _, be := range backends {
+			if !kept[be] {
+				be.service.Close()
+			}
+		}
+		return ErrBalancedServiceClosed
+	}
+	old := b.backends
+	b.backends = backends
+	b.mu.Unlock()
+
+	for _, be := range old {
+		if !kept[be] {
+			go drainBackend(be.service)
+		}
+	}
+
+	if len(backends) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no endpoints are resolved")
+		}
+		return lastErr
+	}
+
+	return nil
+}
+
+func drainBackend(s *Service) {
+	ctx, cancel := context.WithTimeout(context.Background(), balancerDrainTimeout)
+	defer cancel()
+	s.CloseGracefully(ctx)
+}
+
+// Call calls the method on a connected backend chosen by the policy
+func (b *BalancedService) Call(ctx context.Context, name string, args ...interface{}) (Channel, error) {
+	s, err := b.pick(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Service.Call is not used, as it would reconnect
+	// the lost backend to another endpoint
+	return s.call(ctx, name, args...)
+}
+
+func (b *BalancedService) pick(ctx context.Context) (*Service, error) {
+	healthy, stale, err := b.healthy()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(healthy) == 0:
+		if err = b.refresh(ctx); err != nil {
+			return nil, err
+		}
+		if healthy, _, err = b.healthy(); err != nil {
+			return nil, err
+		}
+		if len(healthy) == 0 {
+			return nil, fmt.Errorf("no endpoints are connected")
+		}
+	case stale && atomic.CompareAndSwapInt32(&b.resolving, 0, 1):
+		go func() {
+			defer atomic.StoreInt32(&b.resolving, 0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), balancerResolveTimeout)
+			defer cancel()
+			b.refresh(ctx)
+		}()
+	}
+
+	// ties of LeastOutstanding are broken in round-robin order
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(len(healthy)))
+	chosen := healthy[start]
+	if b.policy == LeastOutstanding {
+		for i := 1; i < len(healthy); i++ {
+			s := healthy[(start+i)%len(healthy)]
+			if s.PendingCalls() < chosen.PendingCalls() {
+				chosen = s
+			}
+		}
+	}
+
+	return chosen, nil
+}
+
+// healthy returns the connected backends and reports
+// if there are disconnected ones
+func (b *BalancedService) healthy() (healthy []*Service, stale bool, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, false, ErrBalancedServiceClosed
+	}
+
+	healthy = make([]*Service, 0, len(b.backends))
+	for _, be := range b.backends {
+		if be.service.disconnected() {
+			stale = true
+			continue
+		}
+		healthy = append(healthy, be.service)
+	}
+
+	return healthy, stale, nil
+}
+
+// Endpoints returns the endpoints of the backends
+func (b *BalancedService) Endpoints() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	endpoints := make([]string, 0, len(b.backends))
+	for _, be := range b.backends {
+		endpoints = append(endpoints, be.endpoint)
+	}
+	return endpoints
+}
+
+// Close closes all backends
+func (b *BalancedService) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for _, be := range b.backends {
+		be.service.Close()
+	}
+	b.backends = nil
+}
@@ -0,0 +1,159 @@
+package cocaine12
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type testBackends struct {
+	mu        sync.Mutex
+	endpoints []EndpointItem
+	peers     map[string]*asyncRWSocket
+	services  map[string]*Service
+}
+
+func newTestBackends(ports ...uint64) *testBackends {
+	tb := &testBackends{
+		peers:    make(map[string]*asyncRWSocket),
+		services: make(map[string]*Service),
+	}
+	tb.setEndpoints(ports...)
+	return tb
+}
+
+func (tb *testBackends) setEndpoints(ports ...uint64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.endpoints = nil
+	for _, port := range ports {
+		tb.endpoints = append(tb.endpoints, EndpointItem{IP: "127.0.0.1", Port: port})
+	}
+}
+
+func (tb *testBackends) resolve(context.Context) (*ServiceInfo, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	info := newLocatorServiceInfo()
+	info.Endpoints = append([]EndpointItem(nil), tb.endpoints...)
+	return info, nil
+}
+
+func (tb *testBackends) dial(ctx context.Context, info *ServiceInfo, endpoint EndpointItem) (*Service, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	s, peer := newTestService("locator", info)
+	tb.peers[endpoint.String()] = peer
+	tb.services[endpoint.String()] = s
+	return s, nil
+}
+
+// received returns the endpoint, which has received the call.
+// Closed peers are skipped.
+func (tb *testBackends) received(t *testing.T) (string, *Message) {
+	tb.mu.Lock()
+	peers := make(map[string]*asyncRWSocket, len(tb.peers))
+	for endpoint, peer := range tb.peers {
+		peers[endpoint] = peer
+	}
+	tb.mu.Unlock()
+
+	for i := 0; i < 1000; i++ {
+		for endpoint, peer := range peers {
+			select {
+			case msg, ok := <-peer.Read():
+				if ok {
+					return endpoint, msg
+				}
+			default:
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("no backend has received the call")
+	return "", nil
+}
+
+func TestBalancedServiceRoundRobin(t *testing.T) {
+	tb := newTestBackends(1, 2)
+	b, err := newBalancedService(context.Background(), RoundRobin, tb.resolve, tb.dial)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer b.Close()
+
+	calls := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		_, err = b.Call(context.Background(), "resolve", "echo")
+		assert.NoError(t, err)
+		endpoint, _ := tb.received(t)
+		calls[endpoint]++
+	}
+	assert.Equal(t, map[string]int{"127.0.0.1:1": 2, "127.0.0.1:2": 2}, calls)
+
+	// the lost backend is replaced by the re-resolved one
+	tb.setEndpoints(2, 3)
+	tb.mu.Lock()
+	lost, peer := tb.services["127.0.0.1:1"], tb.peers["127.0.0.1:1"]
+	tb.mu.Unlock()
+	peer.Close()
+	<-lost.IsClosed()
+
+	_, err = b.Call(context.Background(), "resolve", "echo")
+	assert.NoError(t, err)
+	endpoint, _ := tb.received(t)
+	assert.Equal(t, "127.0.0.1:2", endpoint)
+
+	for i := 0; i < 1000 && fmt.Sprint(b.Endpoints()) != "[127.0.0.1:2 127.0.0.1:3]"; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []string{"127.0.0.1:2", "127.0.0.1:3"}, b.Endpoints())
+
+	b.Close()
+	_, err = b.Call(context.Background(), "resolve", "echo")
+	assert.Equal(t, ErrBalancedServiceClosed, err)
+}
+
+func TestBalancedServiceLeastOutstanding(t *testing.T) {
+	tb := newTestBackends(1, 2)
+	b, err := newBalancedService(context.Background(), LeastOutstanding, tb.resolve, tb.dial)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer b.Close()
+
+	// both backends have a call in flight, then one of them finishes
+	channels := make(map[string]Channel)
+	var finished string
+	for i := 0; i < 2; i++ {
+		ch, err := b.Call(context.Background(), "resolve", "echo")
+		assert.NoError(t, err)
+		endpoint, msg := tb.received(t)
+		channels[endpoint] = ch
+		finished = endpoint
+
+		tb.mu.Lock()
+		peer := tb.peers[endpoint]
+		tb.mu.Unlock()
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+		}
+	}
+	assert.Equal(t, 2, len(channels))
+	_, err = channels[finished].Get(context.Background())
+	assert.NoError(t, err)
+
+	_, err = b.Call(context.Background(), "resolve", "echo")
+	assert.NoError(t, err)
+	endpoint, _ := tb.received(t)
+	assert.Equal(t, finished, endpoint)
+}
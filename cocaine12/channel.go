@@ -1,12 +1,17 @@
 package cocaine12
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 
 	"golang.org/x/net/context"
 )
 
+// errStreamStopped is sent to the remote side,
+// once the receiver stops reading the stream
+var errStreamStopped = errors.New("stream is stopped by the receiver")
+
 type Channel interface {
 	Rx
 	Tx
@@ -14,6 +19,12 @@ type Channel interface {
 
 type Rx interface {
 	Get(context.Context) (ServiceResult, error)
+	// Range calls fn for every chunk of the stream until the stream
+	// is closed or fn returns false. In the latter case the remote side
+	// is sent an error, if the protocol of the stream allows it.
+	// The terminal "close" frame ends the loop and is not passed to fn.
+	// An error reply is returned as the error.
+	Range(ctx context.Context, fn func(ServiceResult) bool) error
 	push(ServiceResult)
 }
 
@@ -33,6 +44,22 @@ type rx struct {
 	sync.Mutex
 	queue []ServiceResult
 	done  bool
+	// received is set once the first chunk has been pushed,
+	// succeeded once a chunk without an error has been read
+	received  bool
+	succeeded bool
+
+	// removes the session from the sessions of the service,
+	// counts the result of the call and closes its span with
+	// the status. Only the first call takes effect.
+	detach func(err error, status string) bool
+
+	// cancelled is closed once the context of the call is done,
+	// callCtx is the context of the call
+	cancelled chan struct{}
+	callCtx   context.Context
+	// notifies the remote side about the cancellation
+	cancelTx func(err error)
 }
 
 func (rx *rx) Get(ctx context.Context) (ServiceResult, error) {
@@ -40,6 +67,13 @@ func (rx *rx) Get(ctx context.Context) (ServiceResult, error) {
 		return nil, ErrStreamIsClosed
 	}
 
+	// the cancellation of the call wins over the pending chunks
+	select {
+	case <-rx.cancelled:
+		return rx.abort(rx.callCtx.Err())
+	default:
+	}
+
 	var res ServiceResult
 
 	// fast path
@@ -59,8 +93,12 @@ func (rx *rx) Get(ctx context.Context) (ServiceResult, error) {
 
 		select {
 		case res = <-rx.pushBuffer:
+		case <-rx.cancelled:
+			return rx.abort(rx.callCtx.Err())
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			// the caller is not going to wait for the answer anymore,
+			// so the session is closed to not leak it
+			return rx.abort(ctx.Err())
 		}
 	}
 
@@ -96,11 +134,93 @@ func (rx *rx) Get(ctx context.Context) (ServiceResult, error) {
 		})
 	}
 
+	if res.Err() == nil {
+		rx.Lock()
+		rx.succeeded = true
+		rx.Unlock()
+	}
+
+	if rx.done {
+		rx.close(res.Err(), temp.Name)
+	}
+
 	return res, nil
 }
 
+func (rx *rx) Range(ctx context.Context, fn func(ServiceResult) bool) error {
+	for !rx.done {
+		// the tree is taken before Get moves to the next state
+		treeMap := *(rx.rxTree)
+
+		res, err := rx.Get(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err = res.Err(); err != nil {
+			return err
+		}
+
+		method, _, _ := res.Result()
+		if treeMap[method].Name == "close" {
+			return nil
+		}
+
+		if !fn(res) {
+			rx.stop()
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// abort closes the cancelled session
+func (rx *rx) abort(err error) (ServiceResult, error) {
+	rx.done = true
+	if rx.cancelTx != nil {
+		rx.cancelTx(err)
+	}
+	rx.close(rx.cancellationError(err), "cancelled")
+	return nil, err
+}
+
+// cancellationError returns the error the cancelled call is finished
+// with. The cancellation by the caller after a successful result
+// is not a failure of the call.
+func (rx *rx) cancellationError(err error) error {
+	rx.Lock()
+	defer rx.Unlock()
+
+	if err == context.Canceled && rx.succeeded {
+		return nil
+	}
+	return err
+}
+
+// stop closes the session, which chunks are not going to be read,
+// and notifies the remote side
+func (rx *rx) stop() {
+	if rx.done {
+		return
+	}
+
+	rx.done = true
+	if rx.cancelTx != nil {
+		rx.cancelTx(errStreamStopped)
+	}
+	rx.close(nil, "stopped")
+}
+
+func (rx *rx) close(err error, status string) {
+	if rx.detach != nil {
+		rx.detach(err, status)
+	}
+}
+
 func (rx *rx) push(res ServiceResult) {
 	rx.Lock()
+	rx.received = true
 	rx.queue = append(rx.queue, res)
 	select {
 	case rx.pushBuffer <- rx.queue[0]:
@@ -115,9 +235,20 @@ type tx struct {
 	txTree  *streamDescription
 	id      uint64
 	done    bool
+
+	// protects the state from the cancellation
+	// and the resubmission of the call
+	mu sync.Mutex
+	// call is the message opening the session,
+	// sent is set once another message has been sent
+	call *Message
+	sent bool
 }
 
 func (tx *tx) Call(ctx context.Context, name string, args ...interface{}) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
 	if tx.done {
 		return fmt.Errorf("tx is done")
 	}
@@ -146,6 +277,58 @@ func (tx *tx) Call(ctx context.Context, name string, args ...interface{}) error
 		Payload:           args,
 	}
 
+	tx.sent = true
 	tx.service.sendMsg(msg)
 	return nil
 }
+
+// finish marks the stream as closed without sending anything
+func (tx *tx) finish() {
+	tx.mu.Lock()
+	tx.done = true
+	tx.mu.Unlock()
+}
+
+// cancel sends the error to the remote side, so the remote side
+// stops the work. If the protocol of the stream has no error,
+// the stream is closed. Nothing is sent if it has neither of them.
+func (tx *tx) cancel(err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return
+	}
+
+	payload := []interface{}{}
+	method, merr := tx.txTree.MethodByName("error")
+	if merr == nil {
+		payload = []interface{}{[2]int{cworkererrorcategory, cdefaulterrrorcode}, err.Error()}
+	} else if method, merr = tx.txTree.MethodByName("close"); merr != nil {
+		return
+	}
+	tx.done = true
+
+	tx.service.sendMsg(&Message{
+		CommonMessageInfo: CommonMessageInfo{tx.id, method},
+		Payload:           payload,
+	})
+}
+
+// resubmittable reports if the call is able to be sent again
+// on a new connection, as nothing has been received or sent
+// after the message opening the session
+func resubmittable(ch Channel) bool {
+	c, ok := ch.(*channel)
+	if !ok {
+		return false
+	}
+
+	c.rx.Lock()
+	received := c.rx.received
+	c.rx.Unlock()
+
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	return !received && !c.tx.sent && !c.tx.done && c.tx.call != nil
+}
@@ -0,0 +1,157 @@
+package cocaine12
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrCircuitOpen is returned by CircuitBreaker.Call while the circuit is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Caller calls methods of a service. It's implemented by Service,
+// ServicePool, BalancedService and CircuitBreaker,
+// so they can wrap each other.
+type Caller interface {
+	Call(ctx context.Context, name string, args ...interface{}) (Channel, error)
+}
+
+// just for the type check
+var (
+	_ Caller = &Service{}
+	_ Caller = &ServicePool{}
+	_ Caller = &BalancedService{}
+	_ Caller = &CircuitBreaker{}
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker fails calls fast with ErrCircuitOpen after threshold
+// consecutive failures. After cooldown one probe call is let through:
+// its success closes the circuit, its failure opens it again.
+// Transport errors and error replies are failures,
+// cancellations of the caller's context are not.
+type CircuitBreaker struct {
+	caller    Caller
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	// openedAt is the time the circuit was opened or the probe started
+	openedAt time.Time
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewCircuitBreaker wraps caller with a circuit breaker
+func NewCircuitBreaker(caller Caller, threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &CircuitBreaker{
+		caller:    caller,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Call calls the method unless the circuit is open.
+// The results read from the returned Channel are counted as
+// successes or failures.
+func (cb *CircuitBreaker) Call(ctx context.Context, name string, args ...interface{}) (Channel, error) {
+	if !cb.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	ch, err := cb.caller.Call(ctx, name, args...)
+	if err != nil {
+		cb.record(ctx, err)
+		return nil, err
+	}
+
+	return &breakerChannel{Channel: ch, cb: cb}, nil
+}
+
+func (cb *CircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitClosed:
+		return true
+	default:
+		// the probe is let through after the cooldown. If the probe
+		// has not been finished, another one is let through later.
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		cb.openedAt = cb.now()
+		return true
+	}
+}
+
+func (cb *CircuitBreaker) record(ctx context.Context, err error) {
+	if err != nil && (err == context.Canceled || err == context.DeadlineExceeded || ctx.Err() != nil) {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.state = circuitOpen
+		cb.openedAt = cb.now()
+	}
+}
+
+// IsOpen reports if calls are failed fast
+func (cb *CircuitBreaker) IsOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state != circuitClosed
+}
+
+// breakerChannel reports the results of a call to the circuit breaker
+type breakerChannel struct {
+	Channel
+	cb *CircuitBreaker
+}
+
+func (b *breakerChannel) Get(ctx context.Context) (ServiceResult, error) {
+	res, err := b.Channel.Get(ctx)
+	switch {
+	case err == ErrStreamIsClosed:
+		// it's the caller's mistake
+	case err != nil:
+		b.cb.record(ctx, err)
+	default:
+		b.cb.record(ctx, res.Err())
+	}
+	return res, err
+}
+
+func (b *breakerChannel) Range(ctx context.Context, fn func(ServiceResult) bool) error {
+	err := b.Channel.Range(ctx, fn)
+	b.cb.record(ctx, err)
+	return err
+}
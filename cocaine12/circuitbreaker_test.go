@@ -0,0 +1,91 @@
+package cocaine12
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type testChannel struct {
+	res ServiceResult
+	err error
+}
+
+func (c *testChannel) Get(context.Context) (ServiceResult, error) { return c.res, c.err }
+func (c *testChannel) push(ServiceResult)                         {}
+func (c *testChannel) Range(context.Context, func(ServiceResult) bool) error {
+	return c.err
+}
+func (c *testChannel) Call(context.Context, string, ...interface{}) error {
+	return nil
+}
+
+// testCaller returns the results in order
+type testCaller struct {
+	calls   int
+	results []error
+}
+
+func (c *testCaller) Call(ctx context.Context, name string, args ...interface{}) (Channel, error) {
+	err := c.results[c.calls]
+	c.calls++
+
+	switch err {
+	case errTestReply:
+		return &testChannel{res: &serviceRes{err: err}}, nil
+	case nil:
+		return &testChannel{res: &serviceRes{}}, nil
+	default:
+		return nil, err
+	}
+}
+
+var errTestReply = &ErrRequest{Message: "failure", Category: 1, Code: 1}
+
+func TestCircuitBreaker(t *testing.T) {
+	transportErr := errors.New("disconnected")
+	caller := &testCaller{results: []error{
+		transportErr, context.Canceled, errTestReply, errTestReply,
+		// the failed probe
+		transportErr,
+		// the successful probe
+		nil, nil,
+	}}
+
+	now := time.Now()
+	cb := NewCircuitBreaker(caller, 3, time.Second)
+	cb.now = func() time.Time { return now }
+
+	call := func() error {
+		ch, err := cb.Call(context.Background(), "method")
+		if err != nil {
+			return err
+		}
+		res, _ := ch.Get(context.Background())
+		return res.Err()
+	}
+
+	assert.Equal(t, transportErr, call())
+	// cancellations are not failures
+	assert.Equal(t, context.Canceled, call())
+	assert.Equal(t, errTestReply, call())
+	assert.False(t, cb.IsOpen())
+	assert.Equal(t, errTestReply, call())
+	assert.True(t, cb.IsOpen())
+
+	assert.Equal(t, ErrCircuitOpen, call())
+	assert.Equal(t, 4, caller.calls)
+
+	now = now.Add(time.Second)
+	assert.Equal(t, transportErr, call())
+	assert.Equal(t, ErrCircuitOpen, call())
+
+	now = now.Add(time.Second)
+	assert.NoError(t, call())
+	assert.False(t, cb.IsOpen())
+	assert.NoError(t, call())
+	assert.Equal(t, 7, caller.calls)
+}
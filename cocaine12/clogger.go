@@ -1,34 +1,179 @@
 package cocaine12
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
-const loggerEmit = 0
+const (
+	loggerEmit = 0
+
+	// messages logged while the logger is reconnecting are queued up to the limit
+	// by default, see SetReconnectBuffer
+	loggerReconnectQueueSize = 128
+	loggerReconnectTimeout   = 5 * time.Second
+	loggerMinReconnectDelay  = 100 * time.Millisecond
+	loggerMaxReconnectDelay  = 10 * time.Second
+	// Close waits for the queued records to be written up to the timeout
+	loggerCloseTimeout = 5 * time.Second
+
+	loggerVerbosityPollInterval = 10 * time.Second
+	// V fetches the unknown verbosity in background with the timeout,
+	// a failed fetch is retried after the poll interval
+	loggerVerbosityFetchTimeout = 5 * time.Second
+	// the verbosity of a logger is refreshed in background by default
+	loggerVerbosityRefreshInterval = 30 * time.Second
+)
+
+// ErrLoggerClosed is returned by Logger.Flush after Close
+var ErrLoggerClosed = errors.New("logger is closed")
+
+// verbosityUnknown is the cached verbosity until it's fetched
+// from the logging service or set by SetVerbosity
+const verbosityUnknown Severity = math.MinInt32
 
 type cocaineLogger struct {
 	*Service
 
 	mu       sync.Mutex
 	severity Severity
-	prefix   string
+	prefix   atomic.Value
+	caller   callerReport
+	limit    rateLimit
+	sample   debugSampler
+	hooks    hooks
+	errs     errorReport
+	// records below the verbosity are sent to the logging service
+	// if local filtering is disabled
+	serverFiltering int32
+	// trace records are logged along with debug ones if it's set
+	traceEnabled int32
+	// fetching is set while V fetches the unknown verbosity,
+	// nextFetch is the earliest time of the next attempt in nanoseconds
+	fetching  int32
+	nextFetch int64
+	// records have no client timestamps if it's set
+	noTimestamps int32
+
+	// pending is nil unless the logger is asynchronous
+	pending      chan *Message
+	pendingMu    sync.RWMutex
+	policy       int32
+	closed       bool
+	drained      chan struct{}
+	closeTimeout time.Duration
+	dropped      uint64
+
+	reconnectMu  sync.Mutex
+	reconnecting bool
+	backlog      []*Message
+	backlogSize  int
+	closing      chan struct{}
+	closeOnce    sync.Once
+	// maxDelay limits the backoff of reconnection attempts
+	maxDelay time.Duration
+	// reconnects is the number of successful reconnections,
+	// the first record after each of them reports it
+	reconnects  uint64
+	reconnected int32
+	// redial reconnects the service, it's replaced in tests
+	redial func(ctx context.Context) error
+
+	// stopRefresh stops the background refresh of the verbosity
+	refreshMu   sync.Mutex
+	stopRefresh context.CancelFunc
+
+	// records are coalesced if maxBatch is greater than 1
+	batchMu       sync.Mutex
+	batch         []*Message
+	maxBatch      int
+	flushInterval time.Duration
+	batchTimer    *time.Timer
 }
 
-type attrPair struct {
-	Name  string
-	Value interface{}
+// BatchingLogger is a Logger, which is able to coalesce records into
+// batches. The logger returned by NewLogger implements it, unless
+// the logging service is unavailable.
+type BatchingLogger interface {
+	Logger
+
+	// SetBatching makes the logger send records in batches of maxBatch
+	// or every flushInterval, whichever comes first.
+	// maxBatch less than 2 disables batching, which is the default.
+	// Logger.Flush sends the pending batch.
+	SetBatching(maxBatch int, flushInterval time.Duration)
 }
 
-func formatFields(f Fields) []attrPair {
-	formatted := make([]attrPair, 0, len(f))
-	for k, v := range f {
-		formatted = append(formatted, attrPair{k, v})
-	}
+// QueuePolicy tells an asynchronous logger what to do
+// with a message when its queue is full
+type QueuePolicy int32
+
+const (
+	// QueueDropNewest drops the message being logged. It's the default.
+	QueueDropNewest QueuePolicy = iota
+	// QueueDropOldest drops the oldest queued message to make room
+	QueueDropOldest
+	// QueueBlock blocks the caller until there is room in the queue
+	QueueBlock
+)
+
+// AsyncLogger is a Logger, which sends messages from a background goroutine
+type AsyncLogger interface {
+	Logger
 
-	return formatted
+	// Dropped returns the number of messages dropped
+	// because of the full buffer or the lost connection
+	//
+	// Deprecated: use DroppedMessages.
+	Dropped() uint64
+	// DroppedMessages returns the number of messages dropped
+	// because of the full buffer or the lost connection
+	DroppedMessages() uint64
+	// Connected reports if the logging service is connected
+	Connected() bool
+	// SetReconnectBuffer sets the number of messages kept in memory
+	// while the logger is reconnecting. The oldest messages are dropped
+	// when the buffer is full.
+	SetReconnectBuffer(size int)
+	// SetQueuePolicy sets the behavior of the logger when its queue is full
+	SetQueuePolicy(policy QueuePolicy)
+	// QueueDepth returns the number of messages waiting to be sent
+	QueueDepth() int
+	// SetVerbosityRefresh sets the interval of polling the logging service
+	// for the verbosity. The default is 30 seconds, zero disables polling.
+	SetVerbosityRefresh(interval time.Duration)
+	// SetLocalFiltering enables dropping records below the verbosity
+	// before they are sent, which is the default. If it's disabled,
+	// all records are sent and the logging service filters them.
+	SetLocalFiltering(enabled bool)
+	// SetVerbosity sets the verbosity of the logging service. The cached
+	// verbosity is changed once the service has acknowledged it.
+	SetVerbosity(ctx context.Context, level Severity) error
+	// SetTraceEnabled enables records of TraceLevel while the verbosity
+	// is DebugLevel, as the logging service has no lower verbosity.
+	// They are disabled by default.
+	SetTraceEnabled(enabled bool)
+	// SetReconnectBackoff limits the delay between attempts to reconnect
+	// the logging service. The delay starts at 100ms, doubles with every
+	// attempt and is randomized. The default limit is 10 seconds.
+	SetReconnectBackoff(maxDelay time.Duration)
+	// SetAppName sets the application name, which is the source
+	// of the records, so a process hosting several applications
+	// is able to tag them. An empty name restores the name
+	// of the application from the defaults.
+	SetAppName(name string)
+	// SetClientTimestamps enables the "timestamp" field, which is the time
+	// of the call in nanoseconds. The logging service timestamps records
+	// on arrival, which might be much later if the logger is buffering
+	// or reconnecting. It's enabled by default.
+	SetClientTimestamps(enable bool)
 }
 
 func newCocaineLogger(ctx context.Context, name string, endpoints ...string) (Logger, error) {
@@ -37,51 +182,563 @@ func newCocaineLogger(ctx context.Context, name string, endpoints ...string) (Lo
 		return nil, err
 	}
 
-	logger := &cocaineLogger{
-		Service:  service,
-		severity: -100,
-		prefix:   fmt.Sprintf("app/%s", GetDefaults().ApplicationName()),
+	return NewLoggerWithService(service), nil
+}
+
+// NewLoggerWithService creates a logger, which sends messages through
+// the given logging service. It allows to configure the connection
+// with ServiceOption, e.g. to log over TLS:
+//
+//	service, err := NewService(ctx, "logging", endpoints, WithTLS(config))
+//	...
+//	logger := NewLoggerWithService(service)
+//
+// The service is closed by Close of the logger.
+func NewLoggerWithService(service *Service) Logger {
+	logger := newCocaineLoggerWithService(service)
+	logger.SetVerbosityRefresh(loggerVerbosityRefreshInterval)
+	return logger
+}
+
+func newCocaineLoggerWithService(service *Service) *cocaineLogger {
+	c := &cocaineLogger{
+		Service:      service,
+		severity:     verbosityUnknown,
+		backlogSize:  loggerReconnectQueueSize,
+		closing:      make(chan struct{}),
+		closeTimeout: loggerCloseTimeout,
+		maxDelay:     loggerMaxReconnectDelay,
+		redial: func(ctx context.Context) error {
+			return service.Reconnect(ctx, false)
+		},
+	}
+	c.SetAppName("")
+	service.setWriteErrorHandler(func(err error) {
+		c.errs.report(fmt.Errorf("unable to send records: %v", err))
+	})
+	return c
+}
+
+// NewAsyncCocaineLogger creates a logger, which never blocks on the logging
+// service. Messages are buffered up to bufferSize and sent by a dedicated
+// goroutine. Messages are dropped if the buffer is full, see SetQueuePolicy.
+// Close sends the buffered messages before closing the service,
+// but it waits for them no longer than 5 seconds.
+func NewAsyncCocaineLogger(name string, bufferSize int, endpoints ...string) (AsyncLogger, error) {
+	service, err := NewService(context.Background(), name, endpoints)
+	if err != nil {
+		return nil, err
 	}
 
+	logger := newAsyncCocaineLogger(service, bufferSize)
+	logger.SetVerbosityRefresh(loggerVerbosityRefreshInterval)
 	return logger, nil
 }
 
+func newAsyncCocaineLogger(service *Service, bufferSize int) *cocaineLogger {
+	logger := newCocaineLoggerWithService(service)
+	logger.pending = make(chan *Message, bufferSize)
+	logger.drained = make(chan struct{})
+
+	go logger.drain()
+
+	return logger
+}
+
+func (c *cocaineLogger) drain() {
+	for msg := range c.pending {
+		c.deliver(msg)
+	}
+	close(c.drained)
+}
+
+// deliver sends the messages to the service. If the connection is lost,
+// the messages are queued and the service is redialed in background.
+func (c *cocaineLogger) deliver(msgs ...*Message) {
+	c.reconnectMu.Lock()
+	if c.reconnecting || c.isDisconnected() {
+		wasReconnecting := c.reconnecting
+		trimmed := c.enqueueLocked(msgs)
+		lost := !wasReconnecting && c.reconnecting
+		c.reconnectMu.Unlock()
+
+		// errors are reported without locks,
+		// as the handler might use the logger
+		if lost {
+			c.errs.report(ErrLoggerDisconnected)
+		}
+		if trimmed > 0 {
+			c.errs.report(ErrLoggerBacklogFull)
+		}
+		return
+	}
+	c.reconnectMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, msg := range msgs {
+		c.Service.sendMsg(msg)
+	}
+}
+
+func (c *cocaineLogger) isDisconnected() bool {
+	c.Service.mutex.RLock()
+	defer c.Service.mutex.RUnlock()
+	return c.Service.disconnected()
+}
+
+// enqueueLocked returns the number of dropped messages
+func (c *cocaineLogger) enqueueLocked(msgs []*Message) int {
+	c.backlog = append(c.backlog, msgs...)
+	trimmed := c.trimBacklogLocked()
+
+	if c.reconnecting {
+		return trimmed
+	}
+
+	select {
+	case <-c.closing:
+		// the logger is closed, so there is no need to reconnect
+		return trimmed
+	default:
+	}
+
+	c.reconnecting = true
+	go c.reconnect()
+	return trimmed
+}
+
+// trimBacklogLocked drops the oldest messages, which don't fit the buffer,
+// and returns their number
+func (c *cocaineLogger) trimBacklogLocked() int {
+	size := c.backlogSize
+	if size < 0 {
+		size = 0
+	}
+
+	extra := len(c.backlog) - size
+	if extra <= 0 {
+		return 0
+	}
+
+	atomic.AddUint64(&c.dropped, uint64(extra))
+	c.backlog = append(c.backlog[:0], c.backlog[extra:]...)
+	return extra
+}
+
+// SetReconnectBuffer sets the number of messages kept in memory
+// while the logger is reconnecting. The default is 128.
+func (c *cocaineLogger) SetReconnectBuffer(size int) {
+	c.reconnectMu.Lock()
+	c.backlogSize = size
+	trimmed := c.trimBacklogLocked()
+	c.reconnectMu.Unlock()
+
+	if trimmed > 0 {
+		c.errs.report(ErrLoggerBacklogFull)
+	}
+}
+
+// SetReconnectBackoff limits the delay between reconnection attempts
+func (c *cocaineLogger) SetReconnectBackoff(maxDelay time.Duration) {
+	if maxDelay < loggerMinReconnectDelay {
+		maxDelay = loggerMinReconnectDelay
+	}
+
+	c.reconnectMu.Lock()
+	c.maxDelay = maxDelay
+	c.reconnectMu.Unlock()
+}
+
+// SetAppName overrides the application name of the defaults
+func (c *cocaineLogger) SetAppName(name string) {
+	if name == "" {
+		name = GetDefaults().ApplicationName()
+	}
+	c.prefix.Store(fmt.Sprintf("app/%s", name))
+}
+
+// SetClientTimestamps enables the timestamps of the calls
+func (c *cocaineLogger) SetClientTimestamps(enable bool) {
+	if enable {
+		atomic.StoreInt32(&c.noTimestamps, 0)
+	} else {
+		atomic.StoreInt32(&c.noTimestamps, 1)
+	}
+}
+
+func (c *cocaineLogger) timestampFields(fields Fields, t time.Time) Fields {
+	if atomic.LoadInt32(&c.noTimestamps) != 0 {
+		return fields
+	}
+	return timestampFields(fields, t)
+}
+
+// source returns the source of the records of the application
+func (c *cocaineLogger) source() string {
+	return c.prefix.Load().(string)
+}
+
+// reconnect redials the service with jittered exponential backoff
+// and sends the queued messages. The service is resolved through
+// the locator again, so the logger follows it to new endpoints.
+func (c *cocaineLogger) reconnect() {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), loggerReconnectTimeout)
+		err := c.redial(ctx)
+		cancel()
+
+		c.reconnectMu.Lock()
+		if err == nil {
+			backlog := c.backlog
+			c.backlog = nil
+			c.mu.Lock()
+			for _, msg := range backlog {
+				c.Service.sendMsg(msg)
+			}
+			c.mu.Unlock()
+			c.reconnecting = false
+			atomic.AddUint64(&c.reconnects, 1)
+			atomic.StoreInt32(&c.reconnected, 1)
+			c.reconnectMu.Unlock()
+			return
+		}
+		policy := RetryPolicy{BaseDelay: loggerMinReconnectDelay, MaxDelay: c.maxDelay}
+		c.reconnectMu.Unlock()
+
+		select {
+		case <-time.After(policy.delay(attempt)):
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// reconnectFields adds the number of reconnections
+// to the first record after a reconnection
+func (c *cocaineLogger) reconnectFields(fields Fields) Fields {
+	if !atomic.CompareAndSwapInt32(&c.reconnected, 1, 0) {
+		return fields
+	}
+
+	result := make(Fields, len(fields)+1)
+	for k, v := range fields {
+		result[k] = v
+	}
+	result["reconnects"] = atomic.LoadUint64(&c.reconnects)
+	return result
+}
+
+// Connected reports if the logging service is connected
+func (c *cocaineLogger) Connected() bool {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+	return !c.reconnecting && !c.isDisconnected()
+}
+
+func (c *cocaineLogger) Dropped() uint64 {
+	return c.DroppedMessages()
+}
+
+func (c *cocaineLogger) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (c *cocaineLogger) SetQueuePolicy(policy QueuePolicy) {
+	atomic.StoreInt32(&c.policy, int32(policy))
+}
+
+func (c *cocaineLogger) QueueDepth() int {
+	return len(c.pending)
+}
+
+func (c *cocaineLogger) SetBatching(maxBatch int, flushInterval time.Duration) {
+	c.batchMu.Lock()
+	c.maxBatch, c.flushInterval = maxBatch, flushInterval
+	c.batchMu.Unlock()
+
+	c.flushBatch()
+}
+
+// Flush sends the pending batch and waits until the records logged
+// before are written to the connection or ctx is done. It waits for
+// the records queued while the logging service is reconnecting as well.
+func (c *cocaineLogger) Flush(ctx context.Context) error {
+	select {
+	case <-c.closing:
+		return ErrLoggerClosed
+	default:
+	}
+
+	c.flushBatch()
+
+	// the marker follows the records through the queue,
+	// the reconnect backlog and the socket
+	marker := newFlushMarker()
+	if c.pending == nil {
+		c.deliver(marker)
+		return marker.waitWritten(ctx)
+	}
+
+	c.pendingMu.RLock()
+	if c.closed {
+		c.pendingMu.RUnlock()
+		return ErrLoggerClosed
+	}
+	select {
+	case c.pending <- marker:
+	case <-ctx.Done():
+		c.pendingMu.RUnlock()
+		return ctx.Err()
+	}
+	c.pendingMu.RUnlock()
+
+	return marker.waitWritten(ctx)
+}
+
+func (c *cocaineLogger) flushBatch() {
+	c.batchMu.Lock()
+	batch := c.takeBatchLocked()
+	c.batchMu.Unlock()
+
+	if len(batch) > 0 {
+		c.send(batch...)
+	}
+}
+
+func (c *cocaineLogger) takeBatchLocked() []*Message {
+	if c.batchTimer != nil {
+		c.batchTimer.Stop()
+		c.batchTimer = nil
+	}
+
+	batch := c.batch
+	c.batch = nil
+	return batch
+}
+
+// emit adds the message to the batch or sends it immediately
+// if batching is disabled
+func (c *cocaineLogger) emit(msg *Message) {
+	c.batchMu.Lock()
+	if c.maxBatch < 2 {
+		c.batchMu.Unlock()
+		c.send(msg)
+		return
+	}
+
+	c.batch = append(c.batch, msg)
+	if len(c.batch) >= c.maxBatch {
+		batch := c.takeBatchLocked()
+		c.batchMu.Unlock()
+		c.send(batch...)
+		return
+	}
+
+	if c.batchTimer == nil && c.flushInterval > 0 {
+		c.batchTimer = time.AfterFunc(c.flushInterval, c.flushBatch)
+	}
+	c.batchMu.Unlock()
+}
+
+// Close sends the batched and the queued records and waits for them
+// to be written before closing the service, but no longer than closeTimeout
 func (c *cocaineLogger) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.closeTimeout)
+	defer cancel()
+
+	c.closeOnce.Do(func() { close(c.closing) })
+	c.flushBatch()
+
+	if c.pending != nil {
+		c.pendingMu.Lock()
+		if !c.closed {
+			c.closed = true
+			close(c.pending)
+		}
+		c.pendingMu.Unlock()
+
+		select {
+		case <-c.drained:
+		case <-ctx.Done():
+			// the rest of the queue is dropped by the closed service
+			rest := len(c.pending)
+			atomic.AddUint64(&c.dropped, uint64(rest))
+			c.errs.report(fmt.Errorf("%d queued records are dropped on close", rest))
+		}
+	}
+
+	if ctx.Err() == nil && !c.isDisconnected() {
+		// the records are written before the socket is closed,
+		// the marker follows them as in Flush. The backlog of
+		// the disconnected logger is dropped.
+		marker := newFlushMarker()
+		c.deliver(marker)
+		marker.waitWritten(ctx)
+	}
+
 	c.Service.Close()
 }
 
 func (c *cocaineLogger) Verbosity(ctx context.Context) (level Severity) {
 	level = DebugLevel
-	if lvl := c.severity.get(); lvl != -100 {
+	if lvl := c.severity.get(); lvl != verbosityUnknown {
 		return lvl
 	}
 
+	if lvl, err := c.fetchVerbosity(ctx); err == nil {
+		// SetVerbosity might have been called meanwhile
+		c.severity.compareAndSet(verbosityUnknown, lvl)
+		return c.severity.get()
+	}
+
+	return
+}
+
+// fetchUnknownVerbosity fetches the verbosity in background
+// unless it's being fetched or the last attempt has failed recently
+func (c *cocaineLogger) fetchUnknownVerbosity() {
+	if time.Now().UnixNano() < atomic.LoadInt64(&c.nextFetch) ||
+		!atomic.CompareAndSwapInt32(&c.fetching, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&c.fetching, 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), loggerVerbosityFetchTimeout)
+		defer cancel()
+
+		lvl, err := c.fetchVerbosity(ctx)
+		if err != nil {
+			atomic.StoreInt64(&c.nextFetch, time.Now().Add(loggerVerbosityPollInterval).UnixNano())
+			return
+		}
+		c.severity.compareAndSet(verbosityUnknown, lvl)
+	}()
+}
+
+// SetVerbosity sets the verbosity of the logging service
+// and caches it after the service has replied
+func (c *cocaineLogger) SetVerbosity(ctx context.Context, level Severity) error {
+	channel, err := c.Service.Call(ctx, "set_verbosity", level)
+	if err != nil {
+		return err
+	}
+
+	result, err := channel.Get(ctx)
+	if err != nil {
+		return err
+	}
+	if err = result.Err(); err != nil {
+		return err
+	}
+
+	c.severity.set(level)
+	return nil
+}
+
+func (c *cocaineLogger) fetchVerbosity(ctx context.Context) (Severity, error) {
 	channel, err := c.Service.Call(ctx, "verbosity")
 	if err != nil {
-		return
+		return 0, err
 	}
 
 	result, err := channel.Get(ctx)
 	if err != nil {
-		return
+		return 0, err
 	}
 
 	var verbosity struct {
 		Level Severity
 	}
 
-	err = result.Extract(&verbosity)
-	if err != nil {
-		return
+	if err = result.Extract(&verbosity); err != nil {
+		return 0, err
+	}
+
+	return verbosity.Level, nil
+}
+
+// WatchVerbosity polls the logging service for the verbosity
+// until ctx is cancelled, so changes of the verbosity
+// are applied without restart
+func (c *cocaineLogger) WatchVerbosity(ctx context.Context) {
+	go c.watchVerbosity(ctx, loggerVerbosityPollInterval)
+}
+
+// SetVerbosityRefresh restarts the background polling of the verbosity
+// with the interval. Zero interval stops it.
+func (c *cocaineLogger) SetVerbosityRefresh(interval time.Duration) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	if c.stopRefresh != nil {
+		c.stopRefresh()
+		c.stopRefresh = nil
 	}
 
-	c.severity.set(verbosity.Level)
+	if interval > 0 {
+		var ctx context.Context
+		ctx, c.stopRefresh = context.WithCancel(context.Background())
+		go c.watchVerbosity(ctx, interval)
+	}
+}
 
-	return verbosity.Level
+func (c *cocaineLogger) watchVerbosity(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// select picks a random ready case, so the ticker
+	// might win over the cancellation
+	for ctx.Err() == nil {
+		if lvl, err := c.fetchVerbosity(ctx); err == nil {
+			c.severity.set(lvl)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-c.closing:
+			return
+		}
+	}
 }
 
 func (c *cocaineLogger) V(level Severity) bool {
-	return level >= c.severity.get()
+	if atomic.LoadInt32(&c.serverFiltering) == 1 {
+		return true
+	}
+
+	severity := c.severity.get()
+	if severity == verbosityUnknown {
+		// the logging service filters the records
+		// until the verbosity is known
+		c.fetchUnknownVerbosity()
+		return true
+	}
+
+	if level == TraceLevel && atomic.LoadInt32(&c.traceEnabled) == 1 {
+		level = DebugLevel
+	}
+	return level >= severity
+}
+
+func (c *cocaineLogger) SetTraceEnabled(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&c.traceEnabled, 1)
+	} else {
+		atomic.StoreInt32(&c.traceEnabled, 0)
+	}
+}
+
+func (c *cocaineLogger) SetLocalFiltering(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&c.serverFiltering, 0)
+	} else {
+		atomic.StoreInt32(&c.serverFiltering, 1)
+	}
 }
 
 func (c *cocaineLogger) WithFields(fields Fields) *Entry {
@@ -91,22 +748,238 @@ func (c *cocaineLogger) WithFields(fields Fields) *Entry {
 	}
 }
 
+func (c *cocaineLogger) newEmitMessage(source string, level Severity, fields Fields, msg string) *Message {
+	// the logging service knows the levels from debug to error only,
+	// so trace records are sent as debug ones and fatal ones as errors
+	if level < DebugLevel || level > ErrorLevel {
+		result := make(Fields, len(fields)+1)
+		for k, v := range fields {
+			result[k] = v
+		}
+		result["original_level"] = strings.ToLower(level.String())
+		fields = result
+		if level < DebugLevel {
+			level = DebugLevel
+		} else {
+			level = ErrorLevel
+		}
+	}
+
+	return &Message{
+		CommonMessageInfo: CommonMessageInfo{c.Service.sessions.Next(), loggerEmit},
+		Payload:           []interface{}{level, source, msg, formatFields(fields)},
+	}
+}
+
+func (c *cocaineLogger) WithError(err error) *Entry {
+	return &Entry{
+		Logger: c,
+		Fields: errorFields(nil, err),
+	}
+}
+
+func (c *cocaineLogger) WithContext(ctx context.Context) *Entry {
+	return &Entry{
+		Logger: c,
+		Fields: contextFields(nil, ctx),
+	}
+}
+
+func (c *cocaineLogger) SetReportCaller(enable bool) {
+	c.caller.set(enable, 0)
+}
+
+func (c *cocaineLogger) SetCallerSkip(skip int) {
+	c.caller.set(true, skip)
+}
+
+func (c *cocaineLogger) AddHook(hook Hook) {
+	c.hooks.add(hook)
+}
+
+func (c *cocaineLogger) SetErrorHandler(handler func(error)) {
+	c.errs.setHandler(handler)
+}
+
+func (c *cocaineLogger) Errors() <-chan error {
+	return c.errs.errors()
+}
+
+func (c *cocaineLogger) SetRateLimit(perKey int, window time.Duration) {
+	c.limit.set(perKey, window)
+}
+
+func (c *cocaineLogger) SetDebugSampling(n int) {
+	c.sample.set(n)
+}
+
 func (c *cocaineLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {
-	var methodArgs []interface{}
+	c.logWithSource(c.source(), level, fields, msg, args...)
+}
+
+func (c *cocaineLogger) logWithSource(source string, level Severity, fields Fields, msg string, args ...interface{}) {
+	// the record is dropped before the message is built
+	if !c.V(level) {
+		return
+	}
+	now := time.Now()
+
+	fields, ok := c.sample.apply(level, fields, msg, args, c.caller.frames(1))
+	if !ok {
+		return
+	}
+
+	fields, ok = c.limit.apply(fields, msg, args)
+	if !ok {
+		return
+	}
+
+	fields = c.caller.apply(fields, 1)
+	fields = c.reconnectFields(fields)
+	fields = c.timestampFields(fields, now)
 	if len(args) > 0 {
-		methodArgs = []interface{}{level, c.prefix, fmt.Sprintf(msg, args...), formatFields(fields)}
-	} else {
-		methodArgs = []interface{}{level, c.prefix, msg, formatFields(fields)}
+		msg = fmt.Sprintf(msg, args...)
+	}
+	if err := c.hooks.fire(level, msg, fields); err != nil {
+		c.logWithSource(source, ErrorLevel, errorFields(nil, err), "%s", "log hook failed")
 	}
+	c.emit(c.newEmitMessage(source, level, fields, msg))
+}
 
-	loggermsg := &Message{
-		CommonMessageInfo: CommonMessageInfo{c.Service.sessions.Next(), loggerEmit},
-		Payload:           methodArgs,
+// WithSource returns a logger, which sends records with the given
+// source instead of the application name. It shares the connection
+// with the original logger, so closing either of them closes both.
+func (c *cocaineLogger) WithSource(source string) Logger {
+	return &Entry{
+		Logger: &sourceLogger{cocaineLogger: c, source: source},
+		Fields: defaultFields,
 	}
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Service.sendMsg(loggermsg)
+func (c *cocaineLogger) WithPersistentFields(fields Fields) Logger {
+	return c.WithFields(fields)
+}
+
+// sourceLogger substitutes the source of the records. It's wrapped
+// into Entry, which level methods call the overridden log.
+type sourceLogger struct {
+	*cocaineLogger
+	source string
+}
+
+func (s *sourceLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {
+	s.logWithSource(s.source, level, fields, msg, args...)
+}
+
+func (s *sourceLogger) logBatch(records []traceRecord) {
+	s.logBatchWithSource(s.source, records)
+}
+
+func (c *cocaineLogger) send(msgs ...*Message) {
+	if c.pending == nil {
+		c.deliver(msgs...)
+		return
+	}
+
+	var err error
+	c.pendingMu.RLock()
+	for _, msg := range msgs {
+		if c.closed {
+			atomic.AddUint64(&c.dropped, 1)
+			err = ErrLoggerClosed
+			continue
+		}
+
+		if !c.enqueuePending(msg) {
+			err = ErrLoggerQueueFull
+			select {
+			case <-c.closing:
+				err = ErrLoggerClosed
+			default:
+			}
+		}
+	}
+	c.pendingMu.RUnlock()
+
+	if err != nil {
+		c.errs.report(err)
+	}
+}
+
+// enqueuePending returns false if a message has been dropped
+func (c *cocaineLogger) enqueuePending(msg *Message) bool {
+	switch QueuePolicy(atomic.LoadInt32(&c.policy)) {
+	case QueueBlock:
+		// Close waits for the read lock to be released,
+		// so the caller is unblocked once the logger is closing
+		select {
+		case c.pending <- msg:
+			return true
+		case <-c.closing:
+			atomic.AddUint64(&c.dropped, 1)
+			return false
+		}
+	case QueueDropOldest:
+		queued := true
+		for {
+			select {
+			case c.pending <- msg:
+				return queued
+			default:
+			}
+
+			select {
+			case old := <-c.pending:
+				// a dropped flush marker is not a record,
+				// its Flush waits for the context
+				if old.written == nil {
+					atomic.AddUint64(&c.dropped, 1)
+					queued = false
+				}
+			default:
+			}
+		}
+	default:
+		select {
+		case c.pending <- msg:
+			return true
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+			return false
+		}
+	}
+}
+
+// logBatch sends the records in one burst
+func (c *cocaineLogger) logBatch(records []traceRecord) {
+	c.logBatchWithSource(c.source(), records)
+}
+
+func (c *cocaineLogger) logBatchWithSource(source string, records []traceRecord) {
+	msgs := make([]*Message, 0, len(records))
+	for _, record := range records {
+		if !c.V(record.level) {
+			continue
+		}
+
+		fields, ok := c.sample.apply(record.level, record.fields, record.msg, nil, -1)
+		if !ok {
+			continue
+		}
+
+		fields, ok = c.limit.apply(fields, record.msg, nil)
+		if !ok {
+			continue
+		}
+		fields = c.reconnectFields(fields)
+		fields = c.timestampFields(fields, record.time)
+		if err := c.hooks.fire(record.level, record.msg, fields); err != nil {
+			c.logWithSource(source, ErrorLevel, errorFields(nil, err), "%s", "log hook failed")
+		}
+		msgs = append(msgs, c.newEmitMessage(source, record.level, fields, record.msg))
+	}
+
+	c.send(msgs...)
 }
 
 func (c *cocaineLogger) Debug(args ...interface{}) {
@@ -121,6 +994,30 @@ func (c *cocaineLogger) Debugf(msg string, args ...interface{}) {
 	}
 }
 
+func (c *cocaineLogger) Log(level Severity, args ...interface{}) {
+	if c.V(level) {
+		c.log(level, defaultFields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (c *cocaineLogger) Logf(level Severity, msg string, args ...interface{}) {
+	if c.V(level) {
+		c.log(level, defaultFields, msg, args...)
+	}
+}
+
+func (c *cocaineLogger) Trace(args ...interface{}) {
+	if c.V(TraceLevel) {
+		c.log(TraceLevel, defaultFields, fmt.Sprint(args...))
+	}
+}
+
+func (c *cocaineLogger) Tracef(msg string, args ...interface{}) {
+	if c.V(TraceLevel) {
+		c.log(TraceLevel, defaultFields, msg, args...)
+	}
+}
+
 func (c *cocaineLogger) Info(args ...interface{}) {
 	if c.V(InfoLevel) {
 		c.log(InfoLevel, defaultFields, fmt.Sprint(args...))
@@ -156,3 +1053,35 @@ func (c *cocaineLogger) Errf(msg string, args ...interface{}) {
 		c.log(ErrorLevel, defaultFields, msg, args...)
 	}
 }
+
+func (c *cocaineLogger) Fatalf(format string, args ...interface{}) {
+	if c.V(FatalLevel) {
+		c.log(FatalLevel, defaultFields, format, args...)
+	}
+	c.Close()
+	exit(1)
+}
+
+func (c *cocaineLogger) Fatal(args ...interface{}) {
+	if c.V(FatalLevel) {
+		c.log(FatalLevel, defaultFields, "%s", fmt.Sprint(args...))
+	}
+	c.Close()
+	exit(1)
+}
+
+func (c *cocaineLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if c.V(ErrorLevel) {
+		c.log(ErrorLevel, defaultFields, "%s", msg)
+	}
+	panic(msg)
+}
+
+func (c *cocaineLogger) Panic(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	if c.V(ErrorLevel) {
+		c.log(ErrorLevel, defaultFields, "%s", msg)
+	}
+	panic(msg)
+}
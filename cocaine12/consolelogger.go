@@ -0,0 +1,326 @@
+package cocaine12
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ConsoleFormat is the format of records written by ConsoleLogger
+type ConsoleFormat int32
+
+const (
+	// ConsoleLogfmt formats records as key=value pairs. It's the default.
+	ConsoleLogfmt ConsoleFormat = iota
+	// ConsoleJSON formats records as JSON lines
+	ConsoleJSON
+)
+
+// ConsoleLogger is a Logger, which writes records to io.Writer.
+// It might be used where there is no Cocaine, e.g. in development and tests.
+type ConsoleLogger interface {
+	Logger
+
+	// SetFormat changes the format of records
+	SetFormat(format ConsoleFormat)
+	// SetVerbosity changes the minimal level of logged records
+	SetVerbosity(level Severity)
+}
+
+// consoleLogger writes records to io.Writer as logfmt or JSON lines
+type consoleLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	format   int32
+	severity Severity
+	caller   callerReport
+	limit    rateLimit
+	sample   debugSampler
+	hooks    hooks
+	errs     errorReport
+}
+
+// NewConsoleLogger creates a logger, which writes records
+// of the level and above to w in logfmt format
+func NewConsoleLogger(w io.Writer, level Severity) ConsoleLogger {
+	return &consoleLogger{
+		w:        w,
+		severity: level,
+	}
+}
+
+// NewFallbackLogger creates a logger, which writes records of all levels
+// to w as JSON lines with "level", "message" and the fields.
+// It might be used where the logging service is unavailable.
+func NewFallbackLogger(w io.Writer) Logger {
+	return newJSONLogger(w)
+}
+
+func newJSONLogger(w io.Writer) *consoleLogger {
+	return &consoleLogger{
+		w:        w,
+		format:   int32(ConsoleJSON),
+		severity: DebugLevel,
+	}
+}
+
+func (j *consoleLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {
+	if !j.V(level) {
+		return
+	}
+
+	fields, ok := j.sample.apply(level, fields, msg, args, j.caller.frames(0))
+	if !ok {
+		return
+	}
+
+	fields, ok = j.limit.apply(fields, msg, args)
+	if !ok {
+		return
+	}
+
+	fields = j.caller.apply(fields, 0)
+
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	if err := j.hooks.fire(level, msg, fields); err != nil {
+		j.log(ErrorLevel, errorFields(nil, err), "%s", "log hook failed")
+	}
+
+	fields = withGlobalFields(fields)
+	var data []byte
+	if ConsoleFormat(atomic.LoadInt32(&j.format)) == ConsoleJSON {
+		data = formatJSON(level, fields, msg)
+	} else {
+		data = formatLogfmt(level, fields, msg)
+	}
+
+	j.mu.Lock()
+	_, err := j.w.Write(data)
+	j.mu.Unlock()
+
+	if err != nil {
+		j.errs.report(err)
+	}
+}
+
+func formatJSON(level Severity, fields Fields, msg string) []byte {
+	record := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["level"] = level.String()
+	record["message"] = msg
+	record["time"] = time.Now().Format(time.RFC3339Nano)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{
+			"level":   level.String(),
+			"message": msg,
+			"error":   err.Error(),
+		})
+	}
+	return append(data, '\n')
+}
+
+// formatLogfmt formats the record as time, level, message
+// followed by the fields sorted by name
+func formatLogfmt(level Severity, fields Fields, msg string) []byte {
+	var b bytes.Buffer
+	b.WriteString("time=")
+	b.WriteString(time.Now().Format(time.RFC3339Nano))
+	b.WriteString(" level=")
+	b.WriteString(level.String())
+	b.WriteString(" message=")
+	b.WriteString(logfmtValue(msg))
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b.WriteByte(' ')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(fmt.Sprint(fields[k])))
+	}
+	b.WriteByte('\n')
+
+	return b.Bytes()
+}
+
+// logfmtValue quotes the value if it's empty or contains
+// spaces, quotes, equal signs or control characters
+func logfmtValue(value string) string {
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func (j *consoleLogger) WithFields(fields Fields) *Entry {
+	return &Entry{
+		Logger: j,
+		Fields: fields,
+	}
+}
+
+func (j *consoleLogger) WithError(err error) *Entry {
+	return &Entry{
+		Logger: j,
+		Fields: errorFields(nil, err),
+	}
+}
+
+func (j *consoleLogger) WithContext(ctx context.Context) *Entry {
+	return &Entry{
+		Logger: j,
+		Fields: contextFields(nil, ctx),
+	}
+}
+
+func (j *consoleLogger) Verbosity(context.Context) Severity {
+	return j.severity.get()
+}
+
+func (j *consoleLogger) V(level Severity) bool {
+	return level >= j.severity.get()
+}
+
+func (j *consoleLogger) WatchVerbosity(context.Context) {}
+
+func (j *consoleLogger) SetReportCaller(enable bool) {
+	j.caller.set(enable, 0)
+}
+
+func (j *consoleLogger) SetCallerSkip(skip int) {
+	j.caller.set(true, skip)
+}
+
+func (j *consoleLogger) WithSource(source string) Logger {
+	return j.WithFields(Fields{"app": source})
+}
+
+func (j *consoleLogger) WithPersistentFields(fields Fields) Logger {
+	return j.WithFields(fields)
+}
+
+func (j *consoleLogger) AddHook(hook Hook) {
+	j.hooks.add(hook)
+}
+
+func (j *consoleLogger) SetErrorHandler(handler func(error)) {
+	j.errs.setHandler(handler)
+}
+
+func (j *consoleLogger) Errors() <-chan error {
+	return j.errs.errors()
+}
+
+func (j *consoleLogger) SetRateLimit(perKey int, window time.Duration) {
+	j.limit.set(perKey, window)
+}
+
+func (j *consoleLogger) SetDebugSampling(n int) {
+	j.sample.set(n)
+}
+
+func (j *consoleLogger) SetFormat(format ConsoleFormat) {
+	atomic.StoreInt32(&j.format, int32(format))
+}
+
+func (j *consoleLogger) SetVerbosity(level Severity) {
+	j.severity.set(level)
+}
+
+func (j *consoleLogger) Flush(context.Context) error { return nil }
+
+func (j *consoleLogger) Close() {}
+
+func (j *consoleLogger) Errf(format string, args ...interface{}) {
+	j.log(ErrorLevel, defaultFields, format, args...)
+}
+
+func (j *consoleLogger) Err(args ...interface{}) {
+	j.log(ErrorLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+
+func (j *consoleLogger) Warnf(format string, args ...interface{}) {
+	j.log(WarnLevel, defaultFields, format, args...)
+}
+
+func (j *consoleLogger) Warn(args ...interface{}) {
+	j.log(WarnLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+
+func (j *consoleLogger) Infof(format string, args ...interface{}) {
+	j.log(InfoLevel, defaultFields, format, args...)
+}
+
+func (j *consoleLogger) Info(args ...interface{}) {
+	j.log(InfoLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+
+func (j *consoleLogger) Debugf(format string, args ...interface{}) {
+	j.log(DebugLevel, defaultFields, format, args...)
+}
+
+func (j *consoleLogger) Debug(args ...interface{}) {
+	j.log(DebugLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+
+func (j *consoleLogger) Logf(level Severity, format string, args ...interface{}) {
+	j.log(level, defaultFields, format, args...)
+}
+
+func (j *consoleLogger) Log(level Severity, args ...interface{}) {
+	j.log(level, defaultFields, "%s", fmt.Sprint(args...))
+}
+
+func (j *consoleLogger) Tracef(format string, args ...interface{}) {
+	j.log(TraceLevel, defaultFields, format, args...)
+}
+
+func (j *consoleLogger) Trace(args ...interface{}) {
+	j.log(TraceLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+
+func (j *consoleLogger) Fatalf(format string, args ...interface{}) {
+	j.log(FatalLevel, defaultFields, format, args...)
+	j.Close()
+	exit(1)
+}
+
+func (j *consoleLogger) Fatal(args ...interface{}) {
+	j.log(FatalLevel, defaultFields, "%s", fmt.Sprint(args...))
+	j.Close()
+	exit(1)
+}
+
+func (j *consoleLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	j.log(ErrorLevel, defaultFields, "%s", msg)
+	panic(msg)
+}
+
+func (j *consoleLogger) Panic(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	j.log(ErrorLevel, defaultFields, "%s", msg)
+	panic(msg)
+}
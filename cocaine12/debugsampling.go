@@ -0,0 +1,129 @@
+package cocaine12
+
+import (
+	"container/list"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultDebugSamplingKeys is the number of keys remembered
+// by the debug sampling of a logger unless SetDebugSamplingKeys is called
+const DefaultDebugSamplingKeys = 1024
+
+var (
+	debugSamplingKeysMu sync.RWMutex
+	debugSamplingKeys   = DefaultDebugSamplingKeys
+)
+
+// SetDebugSamplingKeys sets the number of (file, format) keys
+// remembered by the debug sampling of every logger. The least recently
+// logged keys are forgotten, so their counters start over.
+// Zero or negative size restores the default.
+func SetDebugSamplingKeys(size int) {
+	if size <= 0 {
+		size = DefaultDebugSamplingKeys
+	}
+
+	debugSamplingKeysMu.Lock()
+	debugSamplingKeys = size
+	debugSamplingKeysMu.Unlock()
+}
+
+func getDebugSamplingKeys() int {
+	debugSamplingKeysMu.RLock()
+	defer debugSamplingKeysMu.RUnlock()
+	return debugSamplingKeys
+}
+
+type sampleKey struct {
+	file   string
+	format string
+}
+
+type sampleCounter struct {
+	key   sampleKey
+	count int
+}
+
+// debugSampler logs 1 of every n debug records per key.
+// The zero value logs every record.
+type debugSampler struct {
+	rate int32
+
+	mu sync.Mutex
+	// lru holds *sampleCounter, the most recently used in front
+	lru  *list.List
+	keys map[sampleKey]*list.Element
+}
+
+func (d *debugSampler) set(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	d.lru = list.New()
+	d.keys = make(map[sampleKey]*list.Element)
+	atomic.StoreInt32(&d.rate, int32(n))
+}
+
+// apply returns false if the record must be dropped. Otherwise it returns
+// fields to be logged, which contain "sampled" and "sample_rate" for
+// sampled records. skip is the number of frames to the user's call site,
+// the negative one means the file is unknown.
+func (d *debugSampler) apply(level Severity, fields Fields, format string, args []interface{}, skip int) (Fields, bool) {
+	rate := int(atomic.LoadInt32(&d.rate))
+	if level != DebugLevel || rate <= 1 {
+		return fields, true
+	}
+
+	key := sampleKey{format: rateLimitKey(format, args)}
+	if skip >= 0 {
+		if _, file, _, ok := runtime.Caller(skip); ok {
+			key.file = file
+		}
+	}
+
+	if !d.allow(key, rate) {
+		return nil, false
+	}
+
+	result := make(Fields, len(fields)+2)
+	for k, v := range fields {
+		result[k] = v
+	}
+	result["sampled"] = true
+	result["sample_rate"] = rate
+	return result, true
+}
+
+func (d *debugSampler) allow(key sampleKey, rate int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.keys == nil {
+		// set has not been called yet
+		return true
+	}
+
+	var counter *sampleCounter
+	if elem, ok := d.keys[key]; ok {
+		d.lru.MoveToFront(elem)
+		counter = elem.Value.(*sampleCounter)
+	} else {
+		counter = &sampleCounter{key: key}
+		d.keys[key] = d.lru.PushFront(counter)
+		for size := getDebugSamplingKeys(); d.lru.Len() > size; {
+			oldest := d.lru.Back()
+			d.lru.Remove(oldest)
+			delete(d.keys, oldest.Value.(*sampleCounter).key)
+		}
+	}
+
+	// the first record of a key is logged
+	ok := counter.count == 0
+	counter.count = (counter.count + 1) % rate
+	return ok
+}
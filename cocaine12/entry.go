@@ -2,6 +2,8 @@ package cocaine12
 
 import (
 	"fmt"
+
+	"golang.org/x/net/context"
 )
 
 type Entry struct {
@@ -10,7 +12,129 @@ type Entry struct {
 }
 
 // just for the type check
-var _ EntryLogger = &Entry{}
+var (
+	_ EntryLogger = &Entry{}
+	// Entry can be passed where Logger is expected
+	// to log every record with its fields
+	_ Logger = &Entry{}
+)
+
+// StackTracer is implemented by errors, which carry
+// a stack trace of the place they were created at
+type StackTracer interface {
+	StackTrace() string
+}
+
+// errorFields returns a copy of fields with the error attached.
+// nil error adds no fields.
+func errorFields(fields Fields, err error) Fields {
+	result := make(Fields, len(fields)+3)
+	for k, v := range fields {
+		result[k] = v
+	}
+
+	if err != nil {
+		result["error"] = err.Error()
+		if st, ok := err.(StackTracer); ok {
+			result["stack"] = st.StackTrace()
+		}
+		if causes := errorCauses(err); len(causes) > 0 {
+			result["error_cause"] = causes
+		}
+	}
+
+	return result
+}
+
+// errorCauses returns the messages of the errors wrapped by err
+// from the outermost to the innermost one
+func errorCauses(err error) []string {
+	var causes []string
+	for {
+		wrapper, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			return causes
+		}
+
+		if err = wrapper.Unwrap(); err == nil {
+			return causes
+		}
+		causes = append(causes, err.Error())
+	}
+}
+
+// contextFields returns a copy of fields with the ids of the span
+// attached to the context. The context without TraceInfo adds no fields.
+func contextFields(fields Fields, ctx context.Context) Fields {
+	result := make(Fields, len(fields)+3)
+	for k, v := range fields {
+		result[k] = v
+	}
+
+	if traceInfo, ok := TraceInfoFromContext(ctx); ok {
+		setTraceFields(result, traceInfo)
+	}
+
+	return result
+}
+
+// WithFields returns a copy of the Entry with the fields added.
+// Like Logger.WithFields it doesn't copy the fields if the Entry
+// has none, so they must not be modified afterwards.
+func (e *Entry) WithFields(fields Fields) *Entry {
+	if len(e.Fields) == 0 {
+		return &Entry{Logger: e.Logger, Fields: fields}
+	}
+
+	result := make(Fields, len(e.Fields)+len(fields))
+	for k, v := range e.Fields {
+		result[k] = v
+	}
+	for k, v := range fields {
+		result[k] = v
+	}
+
+	return &Entry{
+		Logger: e.Logger,
+		Fields: result,
+	}
+}
+
+// WithContext returns a copy of the Entry with the ids
+// of the span attached to the context
+func (e *Entry) WithContext(ctx context.Context) *Entry {
+	return &Entry{
+		Logger: e.Logger,
+		Fields: contextFields(e.Fields, ctx),
+	}
+}
+
+// WithError returns a copy of the Entry with the error attached as
+// "error" field. The stack of a StackTracer is attached as "stack",
+// the messages of wrapped errors are attached as "error_cause".
+func (e *Entry) WithError(err error) *Entry {
+	return &Entry{
+		Logger: e.Logger,
+		Fields: errorFields(e.Fields, err),
+	}
+}
+
+// WithSource returns a logger with the fields of the Entry,
+// which records come from the given source
+func (e *Entry) WithSource(source string) Logger {
+	return &Entry{
+		Logger: e.Logger.WithSource(source),
+		Fields: e.Fields,
+	}
+}
+
+// WithPersistentFields returns a logger with the fields
+// of the Entry and the given ones
+func (e *Entry) WithPersistentFields(fields Fields) Logger {
+	return e.WithFields(fields)
+}
 
 func (e *Entry) Errf(format string, args ...interface{}) {
 	if e.V(ErrorLevel) {
@@ -36,6 +160,12 @@ func (e *Entry) Debugf(format string, args ...interface{}) {
 	}
 }
 
+func (e *Entry) Tracef(format string, args ...interface{}) {
+	if e.V(TraceLevel) {
+		e.log(TraceLevel, e.Fields, format, args...)
+	}
+}
+
 func (e *Entry) Err(args ...interface{}) {
 	if e.V(ErrorLevel) {
 		e.log(ErrorLevel, e.Fields, fmt.Sprint(args...))
@@ -59,3 +189,53 @@ func (e *Entry) Debug(args ...interface{}) {
 		e.log(DebugLevel, e.Fields, fmt.Sprint(args...))
 	}
 }
+
+func (e *Entry) Trace(args ...interface{}) {
+	if e.V(TraceLevel) {
+		e.log(TraceLevel, e.Fields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (e *Entry) Logf(level Severity, format string, args ...interface{}) {
+	if e.V(level) {
+		e.log(level, e.Fields, format, args...)
+	}
+}
+
+func (e *Entry) Log(level Severity, args ...interface{}) {
+	if e.V(level) {
+		e.log(level, e.Fields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (e *Entry) Fatalf(format string, args ...interface{}) {
+	if e.V(FatalLevel) {
+		e.log(FatalLevel, e.Fields, format, args...)
+	}
+	e.Close()
+	exit(1)
+}
+
+func (e *Entry) Fatal(args ...interface{}) {
+	if e.V(FatalLevel) {
+		e.log(FatalLevel, e.Fields, "%s", fmt.Sprint(args...))
+	}
+	e.Close()
+	exit(1)
+}
+
+func (e *Entry) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if e.V(ErrorLevel) {
+		e.log(ErrorLevel, e.Fields, "%s", msg)
+	}
+	panic(msg)
+}
+
+func (e *Entry) Panic(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	if e.V(ErrorLevel) {
+		e.log(ErrorLevel, e.Fields, "%s", msg)
+	}
+	panic(msg)
+}
@@ -0,0 +1,165 @@
+package cocaine12
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cocaine/cocaine-framework-go/vendor/src/github.com/ugorji/go/codec"
+)
+
+// TimestampExtension is the msgpack extension type of timestamps,
+// which are decoded into time.Time
+const TimestampExtension int8 = -1
+
+// ExtensionDecoder decodes the data of a msgpack extension type
+type ExtensionDecoder func(data []byte) (interface{}, error)
+
+// UnknownExtensionError is returned by Extract if the payload
+// contains an extension type without a registered decoder
+type UnknownExtensionError struct {
+	TypeID int8
+}
+
+func (e *UnknownExtensionError) Error() string {
+	return fmt.Sprintf("msgpack extension type %d has no registered decoder", e.TypeID)
+}
+
+type extension struct {
+	typ    reflect.Type
+	decode ExtensionDecoder
+}
+
+var (
+	extensionsMu sync.RWMutex
+	extensions   = make(map[byte]extension)
+	// extensionHandler decodes the payloads with extension types,
+	// it's rebuilt on every registration
+	extensionHandler *codec.MsgpackHandle
+)
+
+func init() {
+	if err := RegisterExtension(TimestampExtension, time.Time{}, decodeTimestamp); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterExtension makes ServiceResult.Extract decode the msgpack extension
+// type into the values returned by decode. They must have the type of
+// sample, which must be a named type and not a pointer. The values are
+// decoded into fields of the type as well as into interface{}.
+// A type is decoded from one extension type only. A nil decode removes
+// the registration. The registration applies to all services.
+func RegisterExtension(typeID int8, sample interface{}, decode ExtensionDecoder) error {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+
+	registered := make(map[byte]extension, len(extensions)+1)
+	for tag, ext := range extensions {
+		registered[tag] = ext
+	}
+
+	tag := byte(typeID)
+	delete(registered, tag)
+	if decode != nil {
+		typ := reflect.TypeOf(sample)
+		if typ == nil {
+			return fmt.Errorf("no type is given for msgpack extension type %d", typeID)
+		}
+		for t, ext := range registered {
+			if ext.typ == typ {
+				delete(registered, t)
+			}
+		}
+		registered[tag] = extension{typ: typ, decode: decode}
+	}
+
+	handler := &codec.MsgpackHandle{WriteExt: true}
+	for tag, ext := range registered {
+		if err := handler.AddExt(ext.typ, tag, nil, ext.decodeValue); err != nil {
+			return err
+		}
+	}
+
+	extensions, extensionHandler = registered, handler
+	return nil
+}
+
+func (ext extension) decodeValue(rv reflect.Value, data []byte) error {
+	v, err := ext.decode(data)
+	if err != nil {
+		return err
+	}
+
+	value := reflect.ValueOf(v)
+	if value.Type() != ext.typ {
+		return fmt.Errorf("msgpack extension is decoded into %s instead of %s", value.Type(), ext.typ)
+	}
+	rv.Set(value)
+	return nil
+}
+
+// payloadExtensionHandler returns the handler decoding the extension types
+// of the payload, or nil if there are no extension types
+func payloadExtensionHandler(payload interface{}) (*codec.MsgpackHandle, error) {
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+
+	found, err := findExtensions(payload)
+	if err != nil || !found {
+		return nil, err
+	}
+	return extensionHandler, nil
+}
+
+// findExtensions reports if the value contains extension types.
+// The caller must hold extensionsMu.
+func findExtensions(v interface{}) (found bool, err error) {
+	switch v := v.(type) {
+	case codec.RawExt:
+		if _, ok := extensions[v.Tag]; !ok {
+			return false, &UnknownExtensionError{TypeID: int8(v.Tag)}
+		}
+		return true, nil
+	case []interface{}:
+		for _, item := range v {
+			ok, err := findExtensions(item)
+			if err != nil {
+				return false, err
+			}
+			found = found || ok
+		}
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			for _, x := range [2]interface{}{key, item} {
+				ok, err := findExtensions(x)
+				if err != nil {
+					return false, err
+				}
+				found = found || ok
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// decodeTimestamp decodes the 32, 64 and 96 bit formats
+// of the msgpack timestamps
+func decodeTimestamp(data []byte) (interface{}, error) {
+	switch len(data) {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&0x3ffffffff), int64(v>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(sec, int64(nsec)), nil
+	}
+
+	return nil, fmt.Errorf("malformed msgpack timestamp of %d bytes", len(data))
+}
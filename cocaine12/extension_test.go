@@ -0,0 +1,72 @@
+package cocaine12
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/cocaine/cocaine-framework-go/vendor/src/github.com/ugorji/go/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPoint struct {
+	X, Y int
+}
+
+func TestExtractExtensions(t *testing.T) {
+	// [timestamp, ext(5)] as it's received from a service
+	raw := []byte{0x92, 0xd6, 0xff, 0, 0, 0, 0, 0xd5, 0x05, 1, 2}
+	binary.BigEndian.PutUint32(raw[3:7], 1500000000)
+
+	var payload []interface{}
+	if !assert.NoError(t, codec.NewDecoderBytes(raw, hAsocket).Decode(&payload)) {
+		t.FailNow()
+	}
+	res := &serviceRes{payload: payload}
+
+	var items []interface{}
+	assert.Equal(t, &UnknownExtensionError{TypeID: 5}, res.Extract(&items))
+
+	err := RegisterExtension(5, testPoint{}, func(data []byte) (interface{}, error) {
+		return testPoint{int(data[0]), int(data[1])}, nil
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer RegisterExtension(5, nil, nil)
+
+	var (
+		timestamp time.Time
+		point     testPoint
+	)
+	assert.NoError(t, res.ExtractTuple(&timestamp, &point))
+	assert.Equal(t, int64(1500000000), timestamp.Unix())
+	assert.Equal(t, testPoint{1, 2}, point)
+
+	// the types are kept in interface{}
+	assert.NoError(t, res.Extract(&items))
+	assert.Equal(t, []interface{}{time.Unix(1500000000, 0), testPoint{1, 2}}, items)
+
+	// the payloads without extension types are not affected
+	items = nil
+	assert.NoError(t, (&serviceRes{payload: []interface{}{"a", 1}}).Extract(&items))
+	assert.Equal(t, 2, len(items))
+}
+
+func TestDecodeTimestamp(t *testing.T) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, 500<<34|1500000000)
+	ts, err := decodeTimestamp(data)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1500000000, 500), ts)
+
+	data = make([]byte, 12)
+	binary.BigEndian.PutUint32(data, 7)
+	binary.BigEndian.PutUint64(data[4:], uint64(1<<40))
+	ts, err = decodeTimestamp(data)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1<<40, 7), ts)
+
+	_, err = decodeTimestamp([]byte{1})
+	assert.Error(t, err)
+}
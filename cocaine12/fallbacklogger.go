@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
 type fallbackLogger struct {
 	severity Severity
+	caller   callerReport
+	limit    rateLimit
+	sample   debugSampler
+	hooks    hooks
 }
 
 func newFallbackLogger(args ...string) (Logger, error) {
@@ -25,6 +30,20 @@ func (f *fallbackLogger) WithFields(fields Fields) *Entry {
 	}
 }
 
+func (f *fallbackLogger) WithError(err error) *Entry {
+	return &Entry{
+		Logger: f,
+		Fields: errorFields(nil, err),
+	}
+}
+
+func (f *fallbackLogger) WithContext(ctx context.Context) *Entry {
+	return &Entry{
+		Logger: f,
+		Fields: contextFields(nil, ctx),
+	}
+}
+
 func (f *fallbackLogger) formatFields(fields Fields) string {
 	if len(fields) == 0 {
 		return "[ ]"
@@ -48,15 +67,68 @@ func (f *fallbackLogger) V(level Severity) bool {
 	return level >= f.severity.get()
 }
 
+func (f *fallbackLogger) SetReportCaller(enable bool) {
+	f.caller.set(enable, 0)
+}
+
+func (f *fallbackLogger) SetCallerSkip(skip int) {
+	f.caller.set(true, skip)
+}
+
+func (f *fallbackLogger) WithSource(source string) Logger {
+	return f.WithFields(Fields{"app": source})
+}
+
+func (f *fallbackLogger) WithPersistentFields(fields Fields) Logger {
+	return f.WithFields(fields)
+}
+
+func (f *fallbackLogger) AddHook(hook Hook) {
+	f.hooks.add(hook)
+}
+
+// SetErrorHandler does nothing, as the standard logger reports no errors
+func (f *fallbackLogger) SetErrorHandler(func(error)) {}
+
+func (f *fallbackLogger) Errors() <-chan error {
+	return nil
+}
+
+func (f *fallbackLogger) SetRateLimit(perKey int, window time.Duration) {
+	f.limit.set(perKey, window)
+}
+
+func (f *fallbackLogger) SetDebugSampling(n int) {
+	f.sample.set(n)
+}
+
 func (f *fallbackLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {
 	if !f.V(level) {
 		return
 	}
 
+	fields, ok := f.sample.apply(level, fields, msg, args, f.caller.frames(0))
+	if !ok {
+		return
+	}
+
+	fields, ok = f.limit.apply(fields, msg, args)
+	if !ok {
+		return
+	}
+
+	fields = f.caller.apply(fields, 0)
+
+	text := fmt.Sprintf(msg, args...)
+	if err := f.hooks.fire(level, text, fields); err != nil {
+		f.log(ErrorLevel, errorFields(nil, err), "%s", "log hook failed")
+	}
+
+	fields = withGlobalFields(fields)
 	if len(fields) == 0 {
-		log.Printf("[%s] %s", level.String(), fmt.Sprintf(msg, args...))
+		log.Printf("[%s] %s", level.String(), text)
 	} else {
-		log.Printf("[%s] %s %s", level.String(), fmt.Sprintf(msg, args...), f.formatFields(fields))
+		log.Printf("[%s] %s %s", level.String(), text, f.formatFields(fields))
 	}
 }
 
@@ -92,13 +164,60 @@ func (f *fallbackLogger) Debug(args ...interface{}) {
 	f.log(DebugLevel, defaultFields, fmt.Sprint(args...))
 }
 
+func (f *fallbackLogger) Logf(level Severity, format string, args ...interface{}) {
+	f.log(level, defaultFields, format, args...)
+}
+
+func (f *fallbackLogger) Log(level Severity, args ...interface{}) {
+	f.log(level, defaultFields, "%s", fmt.Sprint(args...))
+}
+
+func (f *fallbackLogger) Tracef(format string, args ...interface{}) {
+	f.log(TraceLevel, defaultFields, format, args...)
+}
+
+func (f *fallbackLogger) Trace(args ...interface{}) {
+	f.log(TraceLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+
 func (f *fallbackLogger) Verbosity(context.Context) Severity {
 	return f.severity.get()
 }
 
+// WatchVerbosity does nothing, as the verbosity is set locally
+func (f *fallbackLogger) WatchVerbosity(context.Context) {}
+
 func (f *fallbackLogger) SetVerbosity(value Severity) {
 	f.severity.set(value)
 }
 
+func (f *fallbackLogger) Flush(context.Context) error {
+	return nil
+}
+
 func (f *fallbackLogger) Close() {
 }
+
+func (f *fallbackLogger) Fatalf(format string, args ...interface{}) {
+	f.log(FatalLevel, defaultFields, format, args...)
+	f.Close()
+	exit(1)
+}
+
+func (f *fallbackLogger) Fatal(args ...interface{}) {
+	f.log(FatalLevel, defaultFields, "%s", fmt.Sprint(args...))
+	f.Close()
+	exit(1)
+}
+
+func (f *fallbackLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	f.log(ErrorLevel, defaultFields, "%s", msg)
+	panic(msg)
+}
+
+func (f *fallbackLogger) Panic(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	f.log(ErrorLevel, defaultFields, "%s", msg)
+	panic(msg)
+}
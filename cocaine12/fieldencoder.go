@@ -0,0 +1,116 @@
+package cocaine12
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// FieldEncoder converts a field value of a particular type
+// before it's sent to the logging service
+type FieldEncoder func(value interface{}) interface{}
+
+var (
+	fieldEncodersMu sync.Mutex
+	// fieldEncoders holds map[reflect.Type]FieldEncoder,
+	// it's replaced as a whole on registration
+	fieldEncoders atomic.Value
+)
+
+// RegisterFieldEncoder sets the encoder of the field values with the type
+// of sample. It applies to fields and to every nested value, it overrides
+// the built-in conversions of time.Time, time.Duration, errors and
+// fmt.Stringers. The result is converted as usual. Values of the types
+// without an encoder are passed unchanged. A nil encoder removes it.
+func RegisterFieldEncoder(sample interface{}, encode FieldEncoder) {
+	typ := reflect.TypeOf(sample)
+	if typ == nil {
+		return
+	}
+
+	fieldEncodersMu.Lock()
+	defer fieldEncodersMu.Unlock()
+
+	current, _ := fieldEncoders.Load().(map[reflect.Type]FieldEncoder)
+	encoders := make(map[reflect.Type]FieldEncoder, len(current)+1)
+	for t, enc := range current {
+		encoders[t] = enc
+	}
+	if encode != nil {
+		encoders[typ] = encode
+	} else {
+		delete(encoders, typ)
+	}
+
+	fieldEncoders.Store(encoders)
+
+	// the global fields are formatted once, so they are formatted again
+	fieldsFormatMu.Lock()
+	refreshGlobalPairsLocked()
+	fieldsFormatMu.Unlock()
+}
+
+// applyFieldEncoder converts the value by the encoder registered for its type
+func applyFieldEncoder(value interface{}) (interface{}, bool) {
+	if value == nil {
+		return nil, false
+	}
+
+	encoders, _ := fieldEncoders.Load().(map[reflect.Type]FieldEncoder)
+	if encode, ok := encoders[reflect.TypeOf(value)]; ok {
+		return encode(value), true
+	}
+	return value, false
+}
+
+// encodeNested returns a copy of maps, slices and structs with the values
+// converted by the registered encoders, as they are encoded to JSON
+// as a whole. Pointers are dereferenced.
+// Values deeper than maxNestedDepth are replaced, so a value referencing
+// itself is encoded as well.
+func encodeNested(value interface{}, depth int) interface{} {
+	if encoded, ok := applyFieldEncoder(value); ok {
+		value = encoded
+	}
+
+	rv := reflect.ValueOf(value)
+	if tooDeep(rv, depth) {
+		return nestedTooDeepValue
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		copied := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			copied[fmt.Sprint(k.Interface())] = encodeNested(rv.MapIndex(k).Interface(), depth+1)
+		}
+		return copied
+	case reflect.Struct:
+		if marshalsItself(value) {
+			return value
+		}
+		fields := structFields(rv)
+		copied := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			copied[f.Name] = encodeNested(f.Value, depth+1)
+		}
+		return copied
+	case reflect.Ptr:
+		if rv.IsNil() || marshalsItself(value) {
+			return value
+		}
+		return encodeNested(rv.Elem().Interface(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if _, ok := value.([]byte); ok {
+			return value
+		}
+		copied := make([]interface{}, rv.Len())
+		for i := range copied {
+			copied[i] = encodeNested(rv.Index(i).Interface(), depth+1)
+		}
+		return copied
+	default:
+		return value
+	}
+}
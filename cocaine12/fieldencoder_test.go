@@ -0,0 +1,60 @@
+package cocaine12
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldEncoder(t *testing.T) {
+	type point struct{ X, Y int }
+	RegisterFieldEncoder(point{}, func(value interface{}) interface{} {
+		p := value.(point)
+		return fmt.Sprintf("%d:%d", p.X, p.Y)
+	})
+	defer RegisterFieldEncoder(point{}, nil)
+
+	fields := Fields{
+		"point": point{1, 2},
+		"time":  time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		"error": errors.New("failure"),
+		"count": 1,
+	}
+	formatted := make(map[string]interface{})
+	for _, attr := range formatFields(fields) {
+		formatted[attr.Name] = attr.Value
+	}
+	assert.Equal(t, map[string]interface{}{
+		"point": "1:2",
+		"time":  "2016-01-02T03:04:05Z",
+		"error": "failure",
+		"count": 1,
+	}, formatted)
+
+	formatted = make(map[string]interface{})
+	for _, attr := range formatFields(Fields{"points": []point{{3, 4}}}) {
+		formatted[attr.Name] = attr.Value
+	}
+	assert.Equal(t, map[string]interface{}{"points.0": "3:4"}, formatted)
+
+	SetNestedFieldsFormat(NestedJSON)
+	defer SetNestedFieldsFormat(NestedFlatten)
+	assert.Equal(t, []attrPair{{"points", `["3:4"]`}}, formatFields(Fields{"points": []point{{3, 4}}}))
+}
+
+func TestFieldEncoderGlobalFields(t *testing.T) {
+	type version struct{ Major, Minor int }
+	SetGlobalFields(Fields{"version": version{1, 2}})
+	defer SetGlobalFields(nil)
+
+	// the formatted global fields are refreshed
+	RegisterFieldEncoder(version{}, func(value interface{}) interface{} {
+		v := value.(version)
+		return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+	})
+	defer RegisterFieldEncoder(version{}, nil)
+	assert.Equal(t, []attrPair{{"version", "1.2"}}, formatFields(nil))
+}
@@ -0,0 +1,480 @@
+package cocaine12
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NestedFieldsFormat sets how maps, slices and structs in Fields
+// are sent to the logging service. Exported fields of structs are named
+// by their "json" tags if set. Pointers are dereferenced.
+type NestedFieldsFormat int
+
+const (
+	// NestedFlatten flattens maps, slices and structs into dotted keys,
+	// e.g. "request.headers.host" and "hosts.0"
+	NestedFlatten NestedFieldsFormat = iota
+	// NestedJSON encodes maps, slices and structs as JSON strings
+	NestedJSON
+)
+
+var (
+	fieldsFormatMu   sync.RWMutex
+	nestedFormat     = NestedFlatten
+	fieldsNormalizer func(key string, value interface{}) (string, interface{})
+	// fieldsRedaction is nil unless keys or redactors are set
+	fieldsRedaction *redaction
+	// globalFields are attached to every record. They are formatted
+	// once into globalPairs, which are refreshed with the settings above.
+	globalFields Fields
+	globalPairs  []attrPair
+)
+
+// RedactedValue replaces the values of redacted fields
+const RedactedValue = "[REDACTED]"
+
+// maxNestedDepth limits the levels of maps, slices, structs
+// and pointers in a field,
+// so a value referencing itself doesn't overflow the stack.
+// Deeper values are sent as nestedTooDeepValue.
+const (
+	maxNestedDepth     = 16
+	nestedTooDeepValue = "[TOO DEEP]"
+)
+
+// SetNestedFieldsFormat sets how maps and slices in Fields
+// are sent to the logging service. The default is NestedFlatten.
+func SetNestedFieldsFormat(format NestedFieldsFormat) {
+	fieldsFormatMu.Lock()
+	nestedFormat = format
+	refreshGlobalPairsLocked()
+	fieldsFormatMu.Unlock()
+}
+
+// SetFieldNormalizer sets the function called for every field before
+// it's sent to the logging service. It allows to convert custom types
+// and to rename keys. The result is converted as usual:
+// time.Time becomes an RFC3339 string, time.Duration becomes
+// microseconds, errors and fmt.Stringers become strings.
+// nil removes the normalizer.
+func SetFieldNormalizer(normalize func(key string, value interface{}) (string, interface{})) {
+	fieldsFormatMu.Lock()
+	fieldsNormalizer = normalize
+	refreshGlobalPairsLocked()
+	fieldsFormatMu.Unlock()
+}
+
+// SetRedactedKeys makes the values of the fields with the given names
+// sent as RedactedValue. Names are matched case-insensitively, they
+// might be patterns of path.Match, e.g. "*_token". A nested field matches
+// by its dotted name and by its last part, so "authorization" redacts
+// "request.headers.authorization". No keys disable the redaction by name.
+func SetRedactedKeys(keys ...string) {
+	patterns := make([]string, 0, len(keys))
+	for _, key := range keys {
+		patterns = append(patterns, strings.ToLower(key))
+	}
+
+	fieldsFormatMu.Lock()
+	defer fieldsFormatMu.Unlock()
+
+	var redactors []func(string, interface{}) (interface{}, bool)
+	if fieldsRedaction != nil {
+		redactors = fieldsRedaction.redactors
+	}
+	fieldsRedaction = newRedaction(patterns, redactors)
+	refreshGlobalPairsLocked()
+}
+
+// RegisterRedactor adds the function called for every field and every
+// nested value before it's sent to the logging service. If it returns
+// true, the returned value is sent instead, e.g. a masked card number.
+func RegisterRedactor(redactor func(key string, value interface{}) (interface{}, bool)) {
+	fieldsFormatMu.Lock()
+	defer fieldsFormatMu.Unlock()
+
+	var (
+		patterns  []string
+		redactors []func(string, interface{}) (interface{}, bool)
+	)
+	if fieldsRedaction != nil {
+		patterns = fieldsRedaction.patterns
+		redactors = append(redactors, fieldsRedaction.redactors...)
+	}
+	fieldsRedaction = newRedaction(patterns, append(redactors, redactor))
+	refreshGlobalPairsLocked()
+}
+
+// SetGlobalFields sets the fields attached to every record of every
+// logger, e.g. the datacenter, the host and the build version.
+// They have the lowest precedence: the fields of Entry and of
+// Logger.WithPersistentFields override them. Hooks don't see them.
+// nil removes them.
+func SetGlobalFields(fields Fields) {
+	var copied Fields
+	if len(fields) > 0 {
+		copied = make(Fields, len(fields))
+		for k, v := range fields {
+			copied[k] = v
+		}
+	}
+
+	fieldsFormatMu.Lock()
+	globalFields = copied
+	refreshGlobalPairsLocked()
+	fieldsFormatMu.Unlock()
+}
+
+func refreshGlobalPairsLocked() {
+	globalPairs = nil
+	if len(globalFields) > 0 {
+		globalPairs = formatFieldsWith(globalFields, nestedFormat, fieldsNormalizer, fieldsRedaction)
+	}
+}
+
+// withGlobalFields returns the fields merged with the global ones.
+// The maps are not copied unless both of them have fields,
+// so the result must not be modified.
+func withGlobalFields(fields Fields) Fields {
+	fieldsFormatMu.RLock()
+	global := globalFields
+	fieldsFormatMu.RUnlock()
+
+	switch {
+	case len(global) == 0:
+		return fields
+	case len(fields) == 0:
+		return global
+	}
+
+	merged := make(Fields, len(global)+len(fields))
+	for k, v := range global {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
+
+// redaction is immutable, it's replaced as a whole
+type redaction struct {
+	patterns  []string
+	redactors []func(key string, value interface{}) (interface{}, bool)
+}
+
+func newRedaction(patterns []string, redactors []func(string, interface{}) (interface{}, bool)) *redaction {
+	if len(patterns) == 0 && len(redactors) == 0 {
+		return nil
+	}
+	return &redaction{patterns: patterns, redactors: redactors}
+}
+
+// redact returns the value to be sent instead of the field
+func (r *redaction) redact(key string, value interface{}) (interface{}, bool) {
+	if len(r.patterns) > 0 {
+		lower := strings.ToLower(key)
+		last := lower
+		if i := strings.LastIndex(lower, "."); i >= 0 {
+			last = lower[i+1:]
+		}
+
+		for _, pattern := range r.patterns {
+			if matched, _ := path.Match(pattern, lower); matched {
+				return RedactedValue, true
+			}
+			if matched, _ := path.Match(pattern, last); matched {
+				return RedactedValue, true
+			}
+		}
+	}
+
+	for _, redactor := range r.redactors {
+		if redacted, ok := redactor(key, value); ok {
+			return redacted, true
+		}
+	}
+
+	return nil, false
+}
+
+// redactNested returns a copy of maps, slices and structs with redacted
+// values, as they are encoded to JSON as a whole. Pointers are dereferenced.
+func (r *redaction) redactNested(key string, value interface{}, depth int) interface{} {
+	if redacted, ok := r.redact(key, value); ok {
+		return redacted
+	}
+
+	rv := reflect.ValueOf(value)
+	if tooDeep(rv, depth) {
+		return nestedTooDeepValue
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		copied := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			name := fmt.Sprint(k.Interface())
+			copied[name] = r.redactNested(key+"."+name, rv.MapIndex(k).Interface(), depth+1)
+		}
+		return copied
+	case reflect.Struct:
+		if marshalsItself(value) {
+			return value
+		}
+		fields := structFields(rv)
+		copied := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			copied[f.Name] = r.redactNested(key+"."+f.Name, f.Value, depth+1)
+		}
+		return copied
+	case reflect.Ptr:
+		if rv.IsNil() || marshalsItself(value) {
+			return value
+		}
+		return r.redactNested(key, rv.Elem().Interface(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if _, ok := value.([]byte); ok {
+			return value
+		}
+		copied := make([]interface{}, rv.Len())
+		for i := range copied {
+			copied[i] = r.redactNested(key+"."+strconv.Itoa(i), rv.Index(i).Interface(), depth+1)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+type attrPair struct {
+	Name  string
+	Value interface{}
+}
+
+type attrPairsByName []attrPair
+
+func (a attrPairsByName) Len() int           { return len(a) }
+func (a attrPairsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a attrPairsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// formatFields returns the fields sorted by name, so the output
+// is reproducible. The same name might be produced twice,
+// e.g. by "a.b" and the flattened {"a": {"b": ...}}. Such pairs
+// are kept in the order of the original keys.
+// The global fields are merged in unless f has the same names.
+func formatFields(f Fields) []attrPair {
+	fieldsFormatMu.RLock()
+	format, normalize, redact, global := nestedFormat, fieldsNormalizer, fieldsRedaction, globalPairs
+	fieldsFormatMu.RUnlock()
+
+	// the precomputed pairs are shared, they are never modified
+	if len(f) == 0 && len(global) > 0 {
+		return global
+	}
+
+	formatted := formatFieldsWith(f, format, normalize, redact)
+	if len(global) > 0 {
+		formatted = mergePairs(formatted, global)
+	}
+	return formatted
+}
+
+func formatFieldsWith(f Fields, format NestedFieldsFormat,
+	normalize func(string, interface{}) (string, interface{}), redact *redaction) []attrPair {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	formatted := make([]attrPair, 0, len(f))
+	for _, k := range keys {
+		key, v := k, f[k]
+		if normalize != nil {
+			key, v = normalize(key, v)
+		}
+		formatted = appendField(formatted, format, redact, key, v, 0)
+	}
+	sort.Stable(attrPairsByName(formatted))
+
+	return formatted
+}
+
+// mergePairs merges the sorted pairs with the sorted base ones,
+// which names are not among the pairs
+func mergePairs(pairs, base []attrPair) []attrPair {
+	merged := make([]attrPair, 0, len(pairs)+len(base))
+	i, j := 0, 0
+	for i < len(pairs) || j < len(base) {
+		switch {
+		case j == len(base) || i < len(pairs) && pairs[i].Name < base[j].Name:
+			merged = append(merged, pairs[i])
+			i++
+		case i == len(pairs) || base[j].Name < pairs[i].Name:
+			merged = append(merged, base[j])
+			j++
+		default:
+			// the pair overrides the base one
+			j++
+		}
+	}
+	return merged
+}
+
+// appendField appends the field converted to the types,
+// which the logging service is able to index. Redaction applies
+// to the field and to every nested value before the encoders.
+// depth is the level of the value within the field.
+func appendField(formatted []attrPair, format NestedFieldsFormat, r *redaction, key string, value interface{}, depth int) []attrPair {
+	if r != nil {
+		if redacted, ok := r.redact(key, value); ok {
+			return append(formatted, attrPair{key, redacted})
+		}
+	}
+
+	if encoded, ok := applyFieldEncoder(value); ok {
+		value = encoded
+	}
+
+	switch v := value.(type) {
+	case nil, string, bool, []byte,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return append(formatted, attrPair{key, value})
+	case time.Time:
+		return append(formatted, attrPair{key, v.Format(time.RFC3339Nano)})
+	case time.Duration:
+		return append(formatted, attrPair{key, int64(v / time.Microsecond)})
+	case error:
+		if isNilPointer(v) {
+			return append(formatted, attrPair{key, "<nil>"})
+		}
+		return append(formatted, attrPair{key, v.Error()})
+	case fmt.Stringer:
+		if isNilPointer(v) {
+			return append(formatted, attrPair{key, "<nil>"})
+		}
+		return append(formatted, attrPair{key, v.String()})
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct, reflect.Ptr:
+	default:
+		return append(formatted, attrPair{key, value})
+	}
+
+	if tooDeep(rv, depth) {
+		return append(formatted, attrPair{key, nestedTooDeepValue})
+	}
+
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return append(formatted, attrPair{key, nil})
+		}
+		// the value is converted and redacted as if it was passed itself
+		return appendField(formatted, format, r, key, rv.Elem().Interface(), depth+1)
+	}
+
+	if format == NestedJSON {
+		if r != nil {
+			value = r.redactNested(key, value, depth)
+		}
+		data, err := json.Marshal(encodeNested(value, depth))
+		if err != nil {
+			return append(formatted, attrPair{key, fmt.Sprint(value)})
+		}
+		return append(formatted, attrPair{key, string(data)})
+	}
+
+	if rv.Kind() == reflect.Map {
+		items := make([]attrPair, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			items = append(items, attrPair{fmt.Sprint(k.Interface()), rv.MapIndex(k).Interface()})
+		}
+		sort.Sort(attrPairsByName(items))
+
+		for _, item := range items {
+			formatted = appendField(formatted, format, r, key+"."+item.Name, item.Value, depth+1)
+		}
+		return formatted
+	}
+
+	if rv.Kind() == reflect.Struct {
+		for _, f := range structFields(rv) {
+			formatted = appendField(formatted, format, r, key+"."+f.Name, f.Value, depth+1)
+		}
+		return formatted
+	}
+
+	for i := 0; i < rv.Len(); i++ {
+		formatted = appendField(formatted, format, r, key+"."+strconv.Itoa(i), rv.Index(i).Interface(), depth+1)
+	}
+	return formatted
+}
+
+// tooDeep reports if the value is a map, a slice, a struct
+// or a pointer nested deeper than maxNestedDepth
+func tooDeep(rv reflect.Value, depth int) bool {
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct, reflect.Ptr:
+		return depth > maxNestedDepth
+	}
+	return false
+}
+
+// structFields returns the exported fields of the struct. They are named
+// by the "json" tag if it's set, as encoding/json does.
+func structFields(rv reflect.Value) []attrPair {
+	typ := rv.Type()
+	fields := make([]attrPair, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if j := strings.Index(tag, ","); j >= 0 {
+				tag = tag[:j]
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, attrPair{name, rv.Field(i).Interface()})
+	}
+	return fields
+}
+
+// marshalsItself reports if encoding/json encodes the value on its own,
+// e.g. time.Time nested in a map, so its fields are not walked
+func marshalsItself(value interface{}) bool {
+	switch value.(type) {
+	case json.Marshaler, encoding.TextMarshaler:
+		return true
+	}
+	return false
+}
+
+// isNilPointer reports if the value is a nil pointer, which methods
+// are likely to panic, e.g. a nil *MyError returned as error
+func isNilPointer(value interface{}) bool {
+	rv := reflect.ValueOf(value)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
@@ -0,0 +1,113 @@
+package cocaine12
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// the idle service is resolved and connected again within the timeout
+const idleReconnectTimeout = 5 * time.Second
+
+// ServiceOption configures the connection of a Service
+type ServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	keepAlive   time.Duration
+	idleTimeout time.Duration
+
+	maxReconnectAttempts int
+	retryOnReconnect     bool
+
+	tlsConfig *tls.Config
+}
+
+// WithKeepAlive enables TCP keepalive probes with the period,
+// so a dead peer or a connection dropped by a firewall is detected
+// without waiting for a call. Zero keeps the default of the OS.
+func WithKeepAlive(period time.Duration) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.keepAlive = period
+	}
+}
+
+// WithIdleTimeout makes the Service reconnect, if no message has been sent
+// or received for the timeout and there are no calls in flight.
+// It prevents the calls from hitting a connection, which has been silently
+// dropped by a load balancer or a NAT. The service is resolved again on
+// reconnect. If the reconnect fails, the old connection is kept.
+func WithIdleTimeout(timeout time.Duration) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.idleTimeout = timeout
+	}
+}
+
+func (service *Service) markActive() {
+	if service.opts.idleTimeout > 0 {
+		atomic.StoreInt64(&service.lastActive, time.Now().UnixNano())
+	}
+}
+
+// watchIdle reconnects the idle service until it's closed
+func (service *Service) watchIdle() {
+	timeout := service.opts.idleTimeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !service.reconnectIdle(timeout) {
+			return
+		}
+	}
+}
+
+// reconnectIdle reconnects the service if it has been idle for the timeout.
+// The new connection is made without the lock, so the calls are not
+// blocked meanwhile. It's dropped if the service has been used or
+// reconnected in the meantime. It returns false after the service is closed.
+func (service *Service) reconnectIdle(timeout time.Duration) bool {
+	service.mutex.RLock()
+	epoch, closed, idle := service.epoch, service.closedLocked(), service.idleLocked(timeout)
+	service.mutex.RUnlock()
+
+	if closed || !idle {
+		return !closed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), idleReconnectTimeout)
+	info, sock, err := service.connect(ctx)
+	cancel()
+	if err != nil {
+		// the old connection is kept
+		return true
+	}
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	if closed = service.closedLocked(); closed || epoch != service.epoch || !service.idleLocked(timeout) {
+		sock.Close()
+		return !closed
+	}
+
+	service.replaceConnectionLocked(info, sock)
+	return true
+}
+
+func (service *Service) closedLocked() bool {
+	return service.stopped() || service.closing
+}
+
+// idleLocked reports if the connected service
+// has not been used for the timeout
+func (service *Service) idleLocked(timeout time.Duration) bool {
+	if service.disconnected() || service.sessions.Len() > 0 {
+		// the lost connection is restored by the next call
+		return false
+	}
+
+	idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&service.lastActive))
+	return idle >= timeout
+}
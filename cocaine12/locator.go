@@ -1,6 +1,7 @@
 package cocaine12
 
 import (
+	"crypto/tls"
 	"time"
 
 	"golang.org/x/net/context"
@@ -19,6 +20,10 @@ type locator struct {
 
 // NewLocator creates a new Locator using given endpoints
 func NewLocator(endpoints []string) (Locator, error) {
+	return newLocator(endpoints, nil)
+}
+
+func newLocator(endpoints []string, tlsConfig *tls.Config) (Locator, error) {
 	if len(endpoints) == 0 {
 		endpoints = append(endpoints, GetDefaults().Locators()...)
 	}
@@ -31,7 +36,7 @@ func NewLocator(endpoints []string) (Locator, error) {
 	// ToDo: Duplicated code with Service connection
 CONN_LOOP:
 	for _, endpoint := range endpoints {
-		sock, err = newAsyncConnection("tcp", endpoint, time.Second*1)
+		sock, err = newAsyncConnection("tcp", endpoint, time.Second*1, 0, tlsConfig)
 		if err != nil {
 			continue
 		}
@@ -50,7 +55,7 @@ CONN_LOOP:
 		args:        endpoints,
 		name:        "locator",
 	}
-	go service.loop()
+	go service.serve(service.socketIO, service.epoch)
 
 	return &locator{
 		Service: &service,
@@ -0,0 +1,156 @@
+package cocaine12
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LogBatch accumulates records to send them at once on Flush.
+// The records keep their order, severities and fields.
+// The logging service has no multi-record emit, so the cocaine logger
+// sends a batch as a burst of messages, other loggers log the records
+// one by one.
+type LogBatch struct {
+	logger Logger
+	fields Fields
+
+	mu      sync.Mutex
+	records []traceRecord
+}
+
+// NewLogBatch creates an empty batch of the logger
+func NewLogBatch(logger Logger) *LogBatch {
+	return newLogBatch(logger, nil)
+}
+
+func newLogBatch(logger Logger, fields Fields) *LogBatch {
+	return &LogBatch{
+		logger: logger,
+		fields: fields,
+	}
+}
+
+// Add appends a record with the fields to the batch.
+// Records below the verbosity of the logger are dropped at once.
+func (b *LogBatch) Add(level Severity, fields Fields, format string, args ...interface{}) {
+	if !b.logger.V(level) {
+		return
+	}
+
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+
+	switch {
+	case len(b.fields) == 0 && fields == nil:
+		fields = defaultFields
+	case len(b.fields) > 0:
+		merged := make(Fields, len(b.fields)+len(fields))
+		for k, v := range b.fields {
+			merged[k] = v
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+		fields = merged
+	}
+
+	b.mu.Lock()
+	b.records = append(b.records, traceRecord{level, fields, msg, time.Now()})
+	b.mu.Unlock()
+}
+
+// Len returns the number of pending records
+func (b *LogBatch) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.records)
+}
+
+// Flush sends the pending records. It's safe to call it several times,
+// e.g. from defer, only the records added after the last Flush are sent.
+func (b *LogBatch) Flush() {
+	b.mu.Lock()
+	records := b.records
+	b.records = nil
+	b.mu.Unlock()
+
+	if len(records) == 0 {
+		return
+	}
+
+	if batch, ok := b.logger.(batchLogger); ok {
+		batch.logBatch(records)
+		return
+	}
+
+	for _, record := range records {
+		b.logger.log(record.level, record.fields, "%s", record.msg)
+	}
+}
+
+func (b *LogBatch) Errf(format string, args ...interface{}) {
+	b.Add(ErrorLevel, nil, format, args...)
+}
+
+func (b *LogBatch) Err(args ...interface{}) {
+	b.Add(ErrorLevel, nil, "%s", fmt.Sprint(args...))
+}
+
+func (b *LogBatch) Warnf(format string, args ...interface{}) {
+	b.Add(WarnLevel, nil, format, args...)
+}
+
+func (b *LogBatch) Warn(args ...interface{}) {
+	b.Add(WarnLevel, nil, "%s", fmt.Sprint(args...))
+}
+
+func (b *LogBatch) Infof(format string, args ...interface{}) {
+	b.Add(InfoLevel, nil, format, args...)
+}
+
+func (b *LogBatch) Info(args ...interface{}) {
+	b.Add(InfoLevel, nil, "%s", fmt.Sprint(args...))
+}
+
+func (b *LogBatch) Debugf(format string, args ...interface{}) {
+	b.Add(DebugLevel, nil, format, args...)
+}
+
+func (b *LogBatch) Debug(args ...interface{}) {
+	b.Add(DebugLevel, nil, "%s", fmt.Sprint(args...))
+}
+
+func (b *LogBatch) Tracef(format string, args ...interface{}) {
+	b.Add(TraceLevel, nil, format, args...)
+}
+
+func (b *LogBatch) Trace(args ...interface{}) {
+	b.Add(TraceLevel, nil, "%s", fmt.Sprint(args...))
+}
+
+// just for the type check
+var _ EntryLogger = &LogBatch{}
+
+func (c *cocaineLogger) Batch() *LogBatch {
+	return NewLogBatch(c)
+}
+
+func (j *consoleLogger) Batch() *LogBatch {
+	return NewLogBatch(j)
+}
+
+func (f *fallbackLogger) Batch() *LogBatch {
+	return NewLogBatch(f)
+}
+
+func (n NopLogger) Batch() *LogBatch {
+	return NewLogBatch(n)
+}
+
+// Batch returns a batch, which records carry the fields of the Entry
+func (e *Entry) Batch() *LogBatch {
+	return newLogBatch(e.Logger, e.Fields)
+}
@@ -0,0 +1,95 @@
+package cocaine12
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// the default error handler reports an error once per interval
+	// not to flood stderr when the logging pipeline is broken
+	logErrorReportInterval = time.Minute
+	// errors are dropped if the channel returned by Errors is full
+	logErrorsBufferSize = 64
+)
+
+var (
+	// ErrLoggerQueueFull is reported when a record is dropped
+	// because the queue of an asynchronous logger is full
+	ErrLoggerQueueFull = errors.New("logger queue is full")
+	// ErrLoggerBacklogFull is reported when records are dropped
+	// because the reconnect buffer is full
+	ErrLoggerBacklogFull = errors.New("logger reconnect buffer is full")
+	// ErrLoggerDisconnected is reported when the connection
+	// to the logging service is lost
+	ErrLoggerDisconnected = errors.New("logging service is disconnected")
+)
+
+// errorReport delivers errors of a logger to the handler and
+// the channel returned by Errors. The zero value writes them to stderr
+// at most once per minute.
+type errorReport struct {
+	mu       sync.Mutex
+	handler  func(error)
+	ch       chan error
+	reported time.Time
+	// stderr is replaced in tests
+	stderr io.Writer
+}
+
+func (e *errorReport) setHandler(handler func(error)) {
+	e.mu.Lock()
+	e.handler = handler
+	e.mu.Unlock()
+}
+
+func (e *errorReport) errors() <-chan error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.ch == nil {
+		e.ch = make(chan error, logErrorsBufferSize)
+	}
+	return e.ch
+}
+
+func (e *errorReport) report(err error) {
+	e.mu.Lock()
+	handler, ch := e.handler, e.ch
+	if handler == nil {
+		handler = e.reportDefault
+	}
+	e.mu.Unlock()
+
+	if ch != nil {
+		select {
+		case ch <- err:
+		default:
+		}
+	}
+
+	handler(err)
+}
+
+// reportDefault writes the error to stderr
+// unless an error has been written within the interval
+func (e *errorReport) reportDefault(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if !e.reported.IsZero() && now.Sub(e.reported) < logErrorReportInterval {
+		return
+	}
+	e.reported = now
+
+	w := e.stderr
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "cocaine logger: %v\n", err)
+}
@@ -1,6 +1,15 @@
 package cocaine12
 
 import (
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"golang.org/x/net/context"
 )
 
@@ -20,6 +29,9 @@ type EntryLogger interface {
 
 	Debugf(format string, args ...interface{})
 	Debug(args ...interface{})
+
+	Tracef(format string, args ...interface{})
+	Trace(args ...interface{})
 }
 
 // Logger represents an interface for a cocaine.Logger
@@ -27,26 +39,318 @@ type Logger interface {
 	EntryLogger
 
 	log(level Severity, fields Fields, msg string, args ...interface{})
+	// Log and Logf log with the level chosen at the call site
+	Log(level Severity, args ...interface{})
+	Logf(level Severity, format string, args ...interface{})
 	WithFields(Fields) *Entry
+	WithError(error) *Entry
+	// WithContext returns an Entry with trace_id, span_id and parent_id
+	// of the span attached to the context
+	WithContext(context.Context) *Entry
+	// WithSource returns a logger, which records come from the given
+	// source instead of the application name. Loggers, which don't send
+	// the source, attach it as "app" field.
+	WithSource(source string) Logger
+	// WithPersistentFields returns a logger, which attaches the fields
+	// to every record. They override the global fields (see SetGlobalFields),
+	// the fields of Entry override them.
+	WithPersistentFields(fields Fields) Logger
 
 	Verbosity(context.Context) Severity
 	V(level Severity) bool
+	// WatchVerbosity keeps the verbosity in sync with the logging
+	// service until the context is cancelled
+	WatchVerbosity(context.Context)
+	// SetReportCaller enables "file", "line" and "source" fields
+	// pointing to the place a record is logged at
+	SetReportCaller(bool)
+	// SetCallerSkip enables the fields of SetReportCaller
+	// skipping the given number of frames of wrappers around the logger
+	SetCallerSkip(skip int)
+	// SetRateLimit limits the number of records with the same format
+	// to perKey per window. The first record after the window resets
+	// carries "suppressed" field with the number of dropped records.
+	// Zero perKey disables the limit.
+	SetRateLimit(perKey int, window time.Duration)
+	// SetDebugSampling logs 1 of every n debug records with the same
+	// file and format. Logged records carry "sampled" and "sample_rate"
+	// fields. Zero n disables sampling.
+	SetDebugSampling(n int)
+	// Writer returns io.WriteCloser, which logs every written line
+	// with the given severity. A partial line is logged on Close.
+	Writer(level Severity) io.WriteCloser
+	// Batch returns an empty batch of records, which are sent at once
+	// on LogBatch.Flush
+	Batch() *LogBatch
+	// AddHook adds the hook called for every record
+	// with one of the levels of the hook
+	AddHook(Hook)
+	// SetErrorHandler sets the function called when records cannot be
+	// delivered, e.g. the queue is full, a record cannot be encoded
+	// or written, or the connection is lost.
+	// The handler must not log to the same logger. By default errors
+	// are written to stderr at most once per minute. nil restores the default.
+	SetErrorHandler(handler func(error))
+	// Errors returns a channel receiving the same errors as the handler.
+	// Errors are dropped if the channel is full.
+	Errors() <-chan error
+
+	// Fatal and Fatalf log with FatalLevel, close the logger
+	// to deliver the record and call the exit function (see SetExitFunc)
+	Fatalf(format string, args ...interface{})
+	Fatal(args ...interface{})
+	// Panic and Panicf log with ErrorLevel and panic with the message,
+	// as the panic might be recovered
+	Panicf(format string, args ...interface{})
+	Panic(args ...interface{})
 
+	// Flush waits until the records logged before are delivered
+	// or ctx is done. Loggers writing synchronously return at once.
+	Flush(ctx context.Context) error
 	Close()
 }
 
+var (
+	exitFuncMu sync.RWMutex
+	exitFunc   = os.Exit
+)
+
+// SetExitFunc replaces the function called by Fatal and Fatalf.
+// It allows to test them without exiting. nil restores os.Exit.
+func SetExitFunc(exit func(code int)) {
+	if exit == nil {
+		exit = os.Exit
+	}
+
+	exitFuncMu.Lock()
+	exitFunc = exit
+	exitFuncMu.Unlock()
+}
+
+func exit(code int) {
+	exitFuncMu.RLock()
+	exit := exitFunc
+	exitFuncMu.RUnlock()
+
+	exit(code)
+}
+
 var defaultFields = Fields{}
 
+// callerSkip is the number of frames between callerReport.apply
+// and the user's call site: Logger.log and Logger.Info (or Entry.Info)
+const callerSkip = 3
+
+// callerReport adds the location of the user's call site to records.
+// The zero value is disabled.
+type callerReport struct {
+	enabled int32
+	// skip is the number of frames of the user's wrappers
+	skip int32
+}
+
+func (c *callerReport) set(enable bool, skip int) {
+	var value int32
+	if enable {
+		value = 1
+	}
+	atomic.StoreInt32(&c.skip, int32(skip))
+	atomic.StoreInt32(&c.enabled, value)
+}
+
+// apply returns a copy of fields with "file", "line" and
+// "source" ("dir/file.go:42") of the user's call site.
+// depth is the number of frames between Logger.log and apply.
+func (c *callerReport) apply(fields Fields, depth int) Fields {
+	if atomic.LoadInt32(&c.enabled) == 0 {
+		return fields
+	}
+
+	result := make(Fields, len(fields)+3)
+	for k, v := range fields {
+		result[k] = v
+	}
+
+	if _, file, line, ok := runtime.Caller(c.frames(depth)); ok {
+		result["file"] = file
+		result["line"] = line
+		result["source"] = shortSource(file, line)
+	}
+
+	return result
+}
+
+// frames returns the number of frames to skip to reach the user's
+// call site from a function called by Logger.log
+func (c *callerReport) frames(depth int) int {
+	return callerSkip + depth + int(atomic.LoadInt32(&c.skip))
+}
+
+// shortSource returns the file with its directory and the line
+func shortSource(file string, line int) string {
+	short := file
+	if i := strings.LastIndex(file, "/"); i >= 0 {
+		if j := strings.LastIndex(file[:i], "/"); j >= 0 {
+			short = file[j+1:]
+		}
+	}
+	return short + ":" + strconv.Itoa(line)
+}
+
+// Hook is called for every record emitted by a logger
+// with one of its levels, e.g. to count errors
+type Hook interface {
+	Levels() []Severity
+	// Fire is called before the record is sent. The first error
+	// of a hook is logged, the record is sent anyway.
+	Fire(level Severity, msg string, fields Fields) error
+}
+
+type registeredHook struct {
+	Hook
+	levels []Severity
+	failed int32
+}
+
+// hooks is the list of the hooks of a logger. The zero value is empty.
+type hooks struct {
+	count int32
+
+	mu    sync.RWMutex
+	hooks []*registeredHook
+}
+
+func (h *hooks) add(hook Hook) {
+	h.mu.Lock()
+	h.hooks = append(h.hooks, &registeredHook{Hook: hook, levels: hook.Levels()})
+	atomic.StoreInt32(&h.count, int32(len(h.hooks)))
+	h.mu.Unlock()
+}
+
+// fire calls the hooks of the level. It returns the error
+// of a hook, unless the hook has failed before.
+func (h *hooks) fire(level Severity, msg string, fields Fields) error {
+	if atomic.LoadInt32(&h.count) == 0 {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var firstErr error
+	for _, hook := range h.hooks {
+		if !hook.fires(level) {
+			continue
+		}
+
+		err := hook.Fire(level, msg, fields)
+		if err != nil && firstErr == nil && atomic.CompareAndSwapInt32(&hook.failed, 0, 1) {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (h *registeredHook) fires(level Severity) bool {
+	for _, l := range h.levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// CountingHook counts records by level, e.g. to export them as metrics
+type CountingHook struct {
+	levels []Severity
+	counts [FatalLevel - TraceLevel + 1]uint64
+}
+
+// NewCountingHook creates a hook counting the records of the levels.
+// No levels mean all levels.
+func NewCountingHook(levels ...Severity) *CountingHook {
+	if len(levels) == 0 {
+		levels = []Severity{TraceLevel, DebugLevel, InfoLevel, WarnLevel, ErrorLevel, FatalLevel}
+	}
+	return &CountingHook{levels: levels}
+}
+
+func (h *CountingHook) Levels() []Severity {
+	return h.levels
+}
+
+func (h *CountingHook) Fire(level Severity, msg string, fields Fields) error {
+	if level >= TraceLevel && level <= FatalLevel {
+		atomic.AddUint64(&h.counts[level-TraceLevel], 1)
+	}
+	return nil
+}
+
+// Count returns the number of records of the level
+func (h *CountingHook) Count(level Severity) uint64 {
+	if level < TraceLevel || level > FatalLevel {
+		return 0
+	}
+	return atomic.LoadUint64(&h.counts[level-TraceLevel])
+}
+
 // NewLogger tries to create a cocaine.Logger. It fallbacks to a simple implementation
 // if the cocaine.Logger is unavailable
 func NewLogger(ctx context.Context, endpoints ...string) (Logger, error) {
 	return NewLoggerWithName(ctx, defaultLoggerName, endpoints...)
 }
 
+// NewLoggerWithSource creates a logger like NewLogger, which records
+// come from the given source instead of the application name. It allows
+// several components of an application to log under distinct names.
+func NewLoggerWithSource(ctx context.Context, source string, endpoints ...string) (Logger, error) {
+	l, err := NewLogger(ctx, endpoints...)
+	if err != nil {
+		return nil, err
+	}
+	return l.WithSource(source), nil
+}
+
 func NewLoggerWithName(ctx context.Context, name string, endpoints ...string) (Logger, error) {
 	l, err := newCocaineLogger(ctx, name, endpoints...)
 	if err != nil {
+		if w := getLoggerFallbackSink(); w != nil {
+			return NewFallbackLogger(w), nil
+		}
 		return newFallbackLogger()
 	}
 	return l, nil
 }
+
+// NewLoggerWithFallback creates a logger like NewLogger, but it never
+// fails. If the logging service is unavailable, it falls back to
+// the sink set by SetLoggerFallbackSink or to the standard logger.
+func NewLoggerWithFallback(ctx context.Context, endpoints ...string) Logger {
+	l, err := NewLogger(ctx, endpoints...)
+	if err != nil {
+		// NewLogger falls back on its own, so it's not expected
+		l, _ = newFallbackLogger()
+	}
+	return l
+}
+
+var (
+	loggerFallbackSinkMu sync.RWMutex
+	loggerFallbackSink   io.Writer
+)
+
+// SetLoggerFallbackSink makes NewLogger return NewFallbackLogger writing
+// to w if the logging service is unavailable. By default records are
+// written to the standard logger. nil restores the default.
+func SetLoggerFallbackSink(w io.Writer) {
+	loggerFallbackSinkMu.Lock()
+	loggerFallbackSink = w
+	loggerFallbackSinkMu.Unlock()
+}
+
+func getLoggerFallbackSink() io.Writer {
+	loggerFallbackSinkMu.RLock()
+	defer loggerFallbackSinkMu.RUnlock()
+	return loggerFallbackSink
+}
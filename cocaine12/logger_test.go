@@ -1,8 +1,23 @@
 package cocaine12
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
 
@@ -19,6 +34,1661 @@ func TestLogger(t *testing.T) {
 	log.WithFields(Fields{"a": 1, "b": 2}).Debugf("Debug %v", log.Verbosity(ctx))
 }
 
+func TestLoggerFallbackSink(t *testing.T) {
+	var buf bytes.Buffer
+	SetLoggerFallbackSink(&buf)
+	defer SetLoggerFallbackSink(nil)
+
+	log, err := NewLoggerWithName(context.Background(), "logging", "127.0.0.1:1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer log.Close()
+
+	log.WithFields(Fields{"a": 1}).Debugf("message %d", 1)
+
+	var record map[string]interface{}
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &record)) {
+		assert.Equal(t, "DEBUG", record["level"])
+		assert.Equal(t, "message 1", record["message"])
+		assert.Equal(t, float64(1), record["a"])
+	}
+
+	// NewLoggerWithFallback falls back the same way
+	buf.Reset()
+	fallback := NewLoggerWithFallback(context.Background(), "127.0.0.1:1")
+	defer fallback.Close()
+	fallback.Info("fallback")
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &record)) {
+		assert.Equal(t, "fallback", record["message"])
+	}
+}
+
+func TestAsyncCocaineLogger(t *testing.T) {
+	s, peer := newTestService("logging", &ServiceInfo{})
+	log := newAsyncCocaineLogger(s, 2)
+
+	// block the sending goroutine to overflow the buffer
+	log.mu.Lock()
+	for i := 0; i < 5; i++ {
+		log.Info("message")
+	}
+	dropped := log.Dropped()
+	assert.True(t, dropped >= 2 && dropped <= 3, "dropped %d", dropped)
+	log.mu.Unlock()
+
+	for i := uint64(0); i < 5-dropped; i++ {
+		select {
+		case msg := <-peer.Read():
+			assert.Equal(t, uint64(loggerEmit), msg.MsgType)
+		case <-time.After(time.Second):
+			t.Fatal("buffered message is lost")
+		}
+	}
+
+	log.mu.Lock()
+	log.Info("message")
+	log.Info("message")
+	closed := make(chan struct{})
+	go func() {
+		log.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close does not wait for buffered messages")
+	case <-time.After(10 * time.Millisecond):
+	}
+	log.mu.Unlock()
+	<-closed
+
+	assert.Equal(t, 0, len(log.pending))
+	assert.Equal(t, dropped, log.Dropped())
+	log.Info("after close")
+	assert.Equal(t, dropped+1, log.Dropped())
+}
+
+// slowConn delays every write to the connection
+type slowConn struct {
+	io.ReadWriteCloser
+	delay time.Duration
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.ReadWriteCloser.Write(b)
+}
+
+func TestAsyncCocaineLoggerFlush(t *testing.T) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(&slowConn{ReadWriteCloser: out, delay: 100 * time.Millisecond})
+	peer, _ := newAsyncRW(in)
+	s := &Service{
+		socketIO:    sock,
+		ServiceInfo: &ServiceInfo{},
+		sessions:    newSessions(),
+		stop:        make(chan struct{}),
+		name:        "logging",
+	}
+	go s.serve(s.socketIO, s.epoch)
+
+	log := newAsyncCocaineLogger(s, 16)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		log.Infof("message %d", i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, log.Flush(ctx))
+
+	assert.NoError(t, log.Flush(context.Background()))
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-peer.Read():
+			assert.Equal(t, fmt.Sprintf("message %d", i), fmt.Sprintf("%s", msg.Payload[2]))
+		case <-time.After(time.Second):
+			t.Fatal("flushed message is lost")
+		}
+	}
+}
+
+func TestAsyncCocaineLoggerErrorHandler(t *testing.T) {
+	s, _ := newTestService("logging", &ServiceInfo{})
+	log := newAsyncCocaineLogger(s, 1)
+	defer log.Close()
+
+	var (
+		mu       sync.Mutex
+		reported []error
+	)
+	log.SetErrorHandler(func(err error) {
+		mu.Lock()
+		reported = append(reported, err)
+		mu.Unlock()
+	})
+	errs := log.Errors()
+
+	// block the sending goroutine to overflow the buffer
+	log.mu.Lock()
+	for i := 0; i < 3; i++ {
+		log.Info("message")
+	}
+	log.mu.Unlock()
+
+	mu.Lock()
+	assert.True(t, len(reported) > 0)
+	for _, err := range reported {
+		assert.Equal(t, ErrLoggerQueueFull, err)
+	}
+	mu.Unlock()
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrLoggerQueueFull, err)
+	default:
+		t.Fatal("the error is not sent to the channel")
+	}
+}
+
+func TestCocaineLoggerWriteError(t *testing.T) {
+	s, _ := newTestService("logging", &ServiceInfo{})
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	errs := log.Errors()
+	log.SetErrorHandler(func(error) {})
+
+	// the record cannot be encoded, so the connection is closed
+	log.WithFields(Fields{"callback": func() {}}).Info("message")
+	select {
+	case err := <-errs:
+		assert.Contains(t, err.Error(), "unable to send records")
+	case <-time.After(time.Second):
+		t.Fatal("the write error is not reported")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestConsoleLoggerErrors(t *testing.T) {
+	log := NewConsoleLogger(failingWriter{}, DebugLevel)
+	errs := log.Errors()
+	log.SetErrorHandler(func(error) {})
+
+	log.Info("message")
+	select {
+	case err := <-errs:
+		assert.EqualError(t, err, "broken pipe")
+	default:
+		t.Fatal("the write error is not reported")
+	}
+}
+
+func TestErrorReportDefault(t *testing.T) {
+	var buf bytes.Buffer
+	report := errorReport{stderr: &buf}
+
+	report.report(ErrLoggerQueueFull)
+	report.report(ErrLoggerDisconnected)
+	assert.Equal(t, "cocaine logger: logger queue is full\n", buf.String())
+
+	report.reported = time.Now().Add(-logErrorReportInterval)
+	report.report(ErrLoggerDisconnected)
+	assert.Contains(t, buf.String(), ErrLoggerDisconnected.Error())
+}
+
+func TestAsyncCocaineLoggerQueuePolicy(t *testing.T) {
+	s, peer := newTestService("logging", &ServiceInfo{})
+	log := newAsyncCocaineLogger(s, 2)
+	defer log.Close()
+
+	// the sending goroutine is blocked, so the queue keeps the newest messages
+	log.SetQueuePolicy(QueueDropOldest)
+	log.mu.Lock()
+	log.Info("message 0")
+	for i := 0; i < 100 && log.QueueDepth() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < 5; i++ {
+		log.Infof("message %d", i)
+	}
+	assert.Equal(t, 2, log.QueueDepth())
+	assert.Equal(t, uint64(2), log.DroppedMessages())
+	log.mu.Unlock()
+
+	for _, expected := range []string{"message 0", "message 3", "message 4"} {
+		msg := <-peer.Read()
+		assert.Equal(t, expected, fmt.Sprintf("%s", msg.Payload[2]))
+	}
+
+	// the caller waits for room in the queue
+	log.SetQueuePolicy(QueueBlock)
+	log.mu.Lock()
+	log.Info("message")
+	for i := 0; i < 100 && log.QueueDepth() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	log.Info("message")
+	log.Info("message")
+	logged := make(chan struct{})
+	go func() {
+		log.Info("blocked")
+		close(logged)
+	}()
+	select {
+	case <-logged:
+		t.Fatal("the caller is not blocked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	log.mu.Unlock()
+	<-logged
+	assert.Equal(t, uint64(2), log.DroppedMessages())
+}
+
+func TestAsyncCocaineLoggerCloseTimeout(t *testing.T) {
+	s, _ := newTestService("logging", &ServiceInfo{})
+	log := newAsyncCocaineLogger(s, 4)
+	log.closeTimeout = 10 * time.Millisecond
+
+	// the sending goroutine never sends the queued messages
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.Info("message")
+	for i := 0; i < 100 && log.QueueDepth() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	log.Info("message")
+	log.Info("message")
+
+	closed := make(chan struct{})
+	go func() {
+		log.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close does not respect the timeout")
+	}
+	assert.Equal(t, uint64(2), log.DroppedMessages())
+}
+
+func TestAsyncCocaineLoggerCloseBlocked(t *testing.T) {
+	s, _ := newTestService("logging", &ServiceInfo{})
+	log := newAsyncCocaineLogger(s, 1)
+	log.closeTimeout = 10 * time.Millisecond
+	log.SetQueuePolicy(QueueBlock)
+
+	// the sending goroutine never sends the queued messages
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.Info("message")
+	for i := 0; i < 100 && log.QueueDepth() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	log.Info("message")
+	logged := make(chan struct{})
+	go func() {
+		log.Info("blocked")
+		close(logged)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		log.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close does not respect the timeout")
+	}
+	<-logged
+	assert.Equal(t, uint64(2), log.DroppedMessages())
+}
+
+func TestCocaineLoggerReconnect(t *testing.T) {
+	s, peer := newTestService("logging", &ServiceInfo{})
+	// the locator is unavailable, so the logger can't reconnect
+	s.args = []string{"127.0.0.1:1"}
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+
+	assert.True(t, log.Connected())
+	peer.Close()
+	select {
+	case <-s.IsClosed():
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+
+	for i := 0; i < loggerReconnectQueueSize+10; i++ {
+		log.Info("message")
+	}
+	assert.False(t, log.Connected())
+	assert.Equal(t, uint64(10), log.Dropped())
+}
+
+func TestCocaineLoggerReplay(t *testing.T) {
+	s, peer := newTestService("logging", &ServiceInfo{})
+	log := newCocaineLoggerWithService(s)
+	log.SetReconnectBuffer(3)
+
+	// the service is unavailable for two attempts and recovers then
+	var (
+		attempts int32
+		newPeer  = make(chan *asyncRWSocket, 1)
+	)
+	log.redial = func(ctx context.Context) error {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			return errors.New("unavailable")
+		}
+
+		in, out := testConn()
+		sock, _ := newAsyncRW(out)
+		p, _ := newAsyncRW(in)
+		s.mutex.Lock()
+		s.socketIO = sock
+		s.mutex.Unlock()
+		go s.serve(s.socketIO, s.epoch)
+		newPeer <- p
+		return nil
+	}
+
+	peer.Close()
+	<-s.IsClosed()
+
+	for i := 0; i < 5; i++ {
+		log.Infof("message %d", i)
+	}
+	assert.Equal(t, uint64(2), log.DroppedMessages())
+
+	var p *asyncRWSocket
+	select {
+	case p = <-newPeer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the logger has not reconnected")
+	}
+
+	// the oldest messages are dropped
+	for i := 2; i < 5; i++ {
+		msg := <-p.Read()
+		assert.Equal(t, fmt.Sprintf("message %d", i), fmt.Sprintf("%s", msg.Payload[2]))
+	}
+	assert.True(t, log.Connected())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestCocaineLoggerFollowsEndpoint(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	log.severity.set(DebugLevel)
+	log.SetReconnectBackoff(time.Second)
+	log.SetClientTimestamps(false)
+	defer log.Close()
+
+	// the locator is unavailable at first
+	// and moves the service to another endpoint then
+	var resolved int32
+	s.resolve = func(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error) {
+		if atomic.AddInt32(&resolved, 1) == 1 {
+			return nil, errors.New("locator is unavailable")
+		}
+		info := newLoggingServiceInfo()
+		info.Endpoints = []EndpointItem{{IP: "127.0.0.2", Port: 10053}}
+		return info, nil
+	}
+	newPeer := make(chan *asyncRWSocket, 1)
+	s.dial = func(endpoints []EndpointItem) (socketIO, error) {
+		assert.Equal(t, "127.0.0.2:10053", endpoints[0].String())
+		in, out := testConn()
+		sock, _ := newAsyncRW(out)
+		p, _ := newAsyncRW(in)
+		newPeer <- p
+		return sock, nil
+	}
+
+	peer.Close()
+	<-s.IsClosed()
+	log.Info("lost")
+
+	var p *asyncRWSocket
+	select {
+	case p = <-newPeer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the logger has not reconnected")
+	}
+	for i := 0; i < 1000 && !log.Connected(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, log.Connected())
+
+	log.Info("first")
+	log.Info("second")
+
+	fields := func(msg *Message) map[string]string {
+		result := make(map[string]string)
+		for _, pair := range msg.Payload[3].([]interface{}) {
+			pair := pair.([]interface{})
+			result[fmt.Sprintf("%s", pair[0])] = fmt.Sprint(pair[1])
+		}
+		return result
+	}
+	for _, expected := range []struct {
+		msg    string
+		fields map[string]string
+	}{
+		{"lost", map[string]string{}},
+		{"first", map[string]string{"reconnects": "1"}},
+		{"second", map[string]string{}},
+	} {
+		msg := <-p.Read()
+		assert.Equal(t, expected.msg, fmt.Sprintf("%s", msg.Payload[2]))
+		assert.Equal(t, expected.fields, fields(msg))
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&resolved))
+}
+
+type testStackError struct{}
+
+func (testStackError) Error() string      { return "stack error" }
+func (testStackError) StackTrace() string { return "main.go:1" }
+
+func TestCocaineLoggerWithSource(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(DebugLevel)
+
+	source := func() string {
+		msg := <-peer.Read()
+		return fmt.Sprintf("%s", msg.Payload[1])
+	}
+
+	component := log.WithSource("component")
+	component.Info("message")
+	assert.Equal(t, "component", source())
+	component.WithFields(Fields{"a": 1}).Errf("message %d", 1)
+	assert.Equal(t, "component", source())
+	io.WriteString(component.Writer(WarnLevel), "line\n")
+	assert.Equal(t, "component", source())
+
+	// the original logger keeps the application name
+	log.Info("message")
+	assert.Equal(t, log.source(), source())
+	log.WithFields(Fields{"a": 1}).WithSource("other").Info("message")
+	assert.Equal(t, "other", source())
+}
+
+func TestCocaineLoggerAppName(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(DebugLevel)
+
+	source := func() string {
+		msg := <-peer.Read()
+		return fmt.Sprintf("%s", msg.Payload[1])
+	}
+
+	log.Info("message")
+	assert.Equal(t, "app/"+GetDefaults().ApplicationName(), source())
+
+	log.SetAppName("tenant")
+	log.Info("message")
+	assert.Equal(t, "app/tenant", source())
+	log.WithFields(Fields{"a": 1}).Info("message")
+	assert.Equal(t, "app/tenant", source())
+
+	log.SetAppName("")
+	log.Info("message")
+	assert.Equal(t, "app/"+GetDefaults().ApplicationName(), source())
+}
+
+func TestCocaineLoggerBatch(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(InfoLevel)
+
+	batch := log.WithFields(Fields{"request": 1}).Batch()
+	batch.Warnf("first %d", 1)
+	batch.Debug("filtered")
+	batch.Add(ErrorLevel, Fields{"a": 2}, "second")
+	assert.Equal(t, 2, batch.Len())
+
+	select {
+	case <-peer.Read():
+		t.Fatal("the batch is sent before Flush")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	batch.Flush()
+	batch.Flush()
+	for _, expected := range []struct {
+		level  Severity
+		msg    string
+		fields int
+	}{
+		{WarnLevel, "first 1", 2},
+		{ErrorLevel, "second", 3},
+	} {
+		msg := <-peer.Read()
+		assert.Equal(t, fmt.Sprint(int(expected.level)), fmt.Sprint(msg.Payload[0]))
+		assert.Equal(t, expected.msg, fmt.Sprintf("%s", msg.Payload[2]))
+		assert.Equal(t, expected.fields, len(msg.Payload[3].([]interface{})))
+	}
+	assert.Equal(t, 0, batch.Len())
+}
+
+func TestCocaineLoggerClientTimestamps(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(InfoLevel)
+
+	fields := func(msg *Message) map[string]string {
+		result := make(map[string]string)
+		for _, pair := range msg.Payload[3].([]interface{}) {
+			pair := pair.([]interface{})
+			result[fmt.Sprintf("%s", pair[0])] = fmt.Sprint(pair[1])
+		}
+		return result
+	}
+
+	// the batched record keeps the time of the call
+	before := time.Now().UnixNano()
+	batch := log.Batch()
+	batch.Info("batched")
+	after := time.Now().UnixNano()
+	time.Sleep(20 * time.Millisecond)
+	batch.Flush()
+
+	var timestamp int64
+	fmt.Sscan(fields(<-peer.Read())["timestamp"], &timestamp)
+	assert.True(t, timestamp >= before && timestamp <= after)
+
+	// the timestamp of the caller is kept
+	log.WithFields(Fields{"timestamp": 1}).Info("message")
+	assert.Equal(t, "1", fields(<-peer.Read())["timestamp"])
+
+	log.SetClientTimestamps(false)
+	log.Info("message")
+	assert.Equal(t, map[string]string{}, fields(<-peer.Read()))
+}
+
+func TestLogBatch(t *testing.T) {
+	log := &testRecordLogger{}
+	batch := log.Batch()
+	func() {
+		defer batch.Flush()
+		batch.Info("first")
+		batch.Errf("second %d", 2)
+	}()
+	batch.Flush()
+
+	records := log.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, InfoLevel, records[0].level)
+		assert.Equal(t, "first", records[0].msg)
+		assert.Equal(t, Severity(ErrorLevel), records[1].level)
+		assert.Equal(t, "second 2", records[1].msg)
+	}
+}
+
+func TestLoggerWithError(t *testing.T) {
+	log := &testRecordLogger{}
+
+	log.WithError(errors.New("failure")).Err("message")
+	log.WithFields(Fields{"a": 1}).WithError(testStackError{}).Warn("message")
+	log.WithError(nil).Info("message")
+
+	records := log.Records()
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, Fields{"error": "failure"}, records[0].fields)
+		assert.Equal(t, Fields{"a": 1, "error": "stack error", "stack": "main.go:1"}, records[1].fields)
+		assert.Equal(t, 0, len(records[2].fields))
+	}
+}
+
+func TestEntryWithErrorCause(t *testing.T) {
+	log := &testRecordLogger{}
+
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("resolve: %w", fmt.Errorf("dial: %w", cause))
+	log.WithError(err).Err("message")
+
+	records := log.Records()
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, "resolve: dial: connection refused", records[0].fields["error"])
+		assert.Equal(t, []string{"dial: connection refused", "connection refused"},
+			records[0].fields["error_cause"])
+	}
+}
+
+func TestEntryCopyOnWrite(t *testing.T) {
+	log := &testRecordLogger{}
+
+	fields := Fields{"a": 1}
+	base := log.WithFields(fields)
+	first := base.WithFields(Fields{"a": 2, "b": 1})
+	second := base.WithError(errors.New("failure"))
+
+	assert.Equal(t, Fields{"a": 1}, fields)
+	assert.Equal(t, Fields{"a": 1}, base.Fields)
+	assert.Equal(t, Fields{"a": 2, "b": 1}, first.Fields)
+	assert.Equal(t, Fields{"a": 1, "error": "failure"}, second.Fields)
+}
+
+func TestEntryWithFieldsChain(t *testing.T) {
+	log := &testRecordLogger{}
+
+	parent := log.WithFields(Fields{"a": 1, "b": 1})
+	parent.WithFields(Fields{"b": 2}).WithFields(Fields{"c": 3}).Info("child")
+	parent.Info("parent")
+
+	records := log.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, Fields{"a": 1, "b": 2, "c": 3}, records[0].fields)
+		assert.Equal(t, Fields{"a": 1, "b": 1}, records[1].fields)
+	}
+}
+
+func TestLoggerWithContext(t *testing.T) {
+	log := &testRecordLogger{}
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(10, 11, 12))
+	log.WithContext(ctx).WithFields(Fields{"a": 1}).Info("message")
+	log.WithContext(context.Background()).Info("message")
+
+	records := log.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, Fields{"trace_id": "a", "span_id": "b", "parent_id": "c", "a": 1}, records[0].fields)
+		assert.Equal(t, 0, len(records[1].fields))
+	}
+}
+
+func TestLoggerReportCaller(t *testing.T) {
+	var buf bytes.Buffer
+	stdlog.SetOutput(&buf)
+	defer stdlog.SetOutput(os.Stderr)
+
+	log, _ := newFallbackLogger()
+	log.SetReportCaller(true)
+
+	_, file, line, _ := runtime.Caller(0)
+	log.Info("message")
+	log.WithFields(Fields{"a": 1}).Infof("message")
+
+	output := buf.String()
+	assert.Contains(t, output, "file="+file)
+	assert.Contains(t, output, "line="+strconv.Itoa(line+1))
+	assert.Contains(t, output, "line="+strconv.Itoa(line+2))
+	assert.Contains(t, output, "source=cocaine12/logger_test.go:"+strconv.Itoa(line+1))
+}
+
+func TestLoggerCallerSkip(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewConsoleLogger(&buf, DebugLevel)
+	log.SetCallerSkip(1)
+
+	logWrapper := func(msg string) {
+		log.Info(msg)
+	}
+	_, _, line, _ := runtime.Caller(0)
+	logWrapper("message")
+	assert.Contains(t, buf.String(), "source=cocaine12/logger_test.go:"+strconv.Itoa(line+1))
+
+	// the filtered records are not inspected
+	buf.Reset()
+	log.SetVerbosity(InfoLevel)
+	log.Debug("filtered")
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestLogWriter(t *testing.T) {
+	log := &testRecordLogger{}
+
+	std := NewStdLogger(log, WarnLevel)
+	std.Print("first")
+	std.Printf("second\nthird %d", 3)
+
+	records := log.Records()
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, "first", records[0].msg)
+		assert.Equal(t, "second", records[1].msg)
+		assert.Equal(t, "third 3", records[2].msg)
+		assert.Equal(t, WarnLevel, records[2].level)
+	}
+}
+
+func TestLogWriterPartialLines(t *testing.T) {
+	log := &testRecordLogger{}
+	w := log.WithFields(Fields{"a": 1}).Writer(InfoLevel)
+
+	io.WriteString(w, "fir")
+	io.WriteString(w, "st\nsec")
+	assert.Equal(t, 1, len(log.Records()))
+	io.WriteString(w, "ond\n\nthi")
+	assert.Equal(t, 2, len(log.Records()))
+	w.Close()
+
+	records := log.Records()
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, "first", records[0].msg)
+		assert.Equal(t, "second", records[1].msg)
+		assert.Equal(t, "thi", records[2].msg)
+		assert.Equal(t, Fields{"a": 1}, records[2].fields)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var limit rateLimit
+	limit.set(2, time.Minute)
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		_, ok := limit.allow("error %d", now)
+		assert.True(t, ok)
+	}
+	for i := 0; i < 3; i++ {
+		_, ok := limit.allow("error %d", now)
+		assert.False(t, ok)
+	}
+	_, ok := limit.allow("other", now)
+	assert.True(t, ok)
+
+	suppressed, ok := limit.allow("error %d", now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, 3, suppressed)
+
+	// keys are forgotten after two idle windows
+	limit.allow("error %d", now.Add(4*time.Minute))
+	assert.Equal(t, 1, len(limit.keys))
+
+	limit.set(0, 0)
+	fields, ok := limit.apply(defaultFields, "error %d", nil)
+	assert.True(t, ok)
+	assert.Equal(t, defaultFields, fields)
+}
+
+func TestRateLimitedLogger(t *testing.T) {
+	records := &testRecordLogger{}
+	now := time.Now()
+	r := newRateLimitedLogger(records, 2)
+	r.now = func() time.Time { return now }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.Errf("db", "query failed %d", i)
+		}(i)
+	}
+	wg.Wait()
+	r.Warnf("cache", "cache miss")
+	assert.Equal(t, 3, len(records.Records()))
+
+	// a token is refilled every half a second
+	now = now.Add(500 * time.Millisecond)
+	r.Errf("db", "query failed")
+	r.Errf("db", "query failed")
+	assert.Equal(t, 4, len(records.Records()))
+
+	r.summarize()
+	summary := records.Records()[4]
+	assert.Equal(t, Severity(ErrorLevel), summary.level)
+	assert.Equal(t, "suppressed 9 similar messages in the last 10s", summary.msg)
+	assert.Equal(t, Fields{"key": "db", "suppressed": 9}, summary.fields)
+
+	// idle keys are forgotten
+	now = now.Add(time.Second)
+	r.summarize()
+	assert.Equal(t, 5, len(records.Records()))
+	assert.Equal(t, 0, len(r.buckets))
+}
+
+func TestRateLimitedLoggerReportCaller(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewConsoleLogger(&buf, DebugLevel)
+	log.SetReportCaller(true)
+	r := newRateLimitedLogger(log, 10)
+
+	_, _, line, _ := runtime.Caller(0)
+	r.Errf("db", "query failed")
+	r.Infof("db", "query failed")
+
+	output := buf.String()
+	assert.Contains(t, output, "source=cocaine12/logger_test.go:"+strconv.Itoa(line+1))
+	assert.Contains(t, output, "source=cocaine12/logger_test.go:"+strconv.Itoa(line+2))
+}
+
+func TestConsoleLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewConsoleLogger(&buf, InfoLevel)
+
+	log.Debug("skipped")
+	log.WithFields(Fields{"b": "two words", "a": 1}).Infof("hello %s", "world")
+	logfmt := regexp.MustCompile(`^time=\S+ level=INFO message="hello world" a=1 b="two words"\n$`)
+	assert.True(t, logfmt.MatchString(buf.String()), buf.String())
+
+	buf.Reset()
+	log.SetFormat(ConsoleJSON)
+	log.WithFields(Fields{"a": 1}).Warn("hello")
+	assert.Contains(t, buf.String(), `"a":1`)
+	assert.Contains(t, buf.String(), `"level":"WARNING"`)
+	assert.Contains(t, buf.String(), `"message":"hello"`)
+
+	buf.Reset()
+	log.SetVerbosity(ErrorLevel)
+	log.Warn("skipped")
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestJSONLoggerRateLimit(t *testing.T) {
+	var buf bytes.Buffer
+	log := newJSONLogger(&buf)
+	log.SetRateLimit(1, time.Hour)
+
+	log.Info("first")
+	log.Info("first")
+	log.Info("second")
+	log.Infof("third %d", 1)
+	log.Infof("third %d", 2)
+
+	assert.Equal(t, 3, bytes.Count(buf.Bytes(), []byte("\n")))
+}
+
+func TestJSONLoggerDebugSampling(t *testing.T) {
+	var buf bytes.Buffer
+	log := newJSONLogger(&buf)
+	log.SetDebugSampling(3)
+
+	for i := 0; i < 7; i++ {
+		log.Debugf("loop %d", i)
+	}
+	assert.Equal(t, 3, bytes.Count(buf.Bytes(), []byte("\n")))
+	assert.Contains(t, buf.String(), `"message":"loop 0"`)
+	assert.Contains(t, buf.String(), `"message":"loop 3"`)
+	assert.Contains(t, buf.String(), `"sampled":true`)
+	assert.Contains(t, buf.String(), `"sample_rate":3`)
+
+	// another format is another key
+	buf.Reset()
+	log.Debugf("other %d", 7)
+	assert.Contains(t, buf.String(), `"message":"other 7"`)
+
+	// other levels are not sampled
+	buf.Reset()
+	for i := 0; i < 3; i++ {
+		log.Info("info")
+	}
+	assert.Equal(t, 3, bytes.Count(buf.Bytes(), []byte("\n")))
+	assert.NotContains(t, buf.String(), "sampled")
+
+	// the least recently used keys are forgotten
+	SetDebugSamplingKeys(1)
+	defer SetDebugSamplingKeys(0)
+	buf.Reset()
+	for i := 0; i < 2; i++ {
+		log.Debug("first")
+		log.Debug("second")
+	}
+	assert.Equal(t, 4, bytes.Count(buf.Bytes(), []byte("\n")))
+
+	buf.Reset()
+	log.SetDebugSampling(0)
+	for i := 0; i < 2; i++ {
+		log.Debug("plain")
+	}
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+	assert.NotContains(t, buf.String(), "sampled")
+}
+
+func TestEntryAsLogger(t *testing.T) {
+	log := &testRecordLogger{}
+
+	var traced Logger = log.WithContext(AttachTraceInfo(nil, NewTraceInfo(10, 11, 12)))
+	traced.Info("message")
+	traced.WithFields(Fields{"a": 1}).Warnf("message %d", 1)
+
+	var plain Logger = log.WithContext(context.Background())
+	plain.Info("message")
+
+	records := log.Records()
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, "a", records[0].fields["trace_id"])
+		assert.Equal(t, "b", records[1].fields["span_id"])
+		assert.Equal(t, 1, records[1].fields["a"])
+		assert.Equal(t, 0, len(records[2].fields))
+	}
+}
+
+func TestCocaineLoggerBatching(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(DebugLevel)
+
+	log.SetBatching(3, time.Hour)
+	log.Warn("first")
+	log.Info("second")
+
+	select {
+	case <-peer.Read():
+		t.Fatal("batch is sent before it's full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	log.WithFields(Fields{"a": 1}).Err("third")
+	log.Debug("fourth")
+	log.Flush(context.Background())
+
+	for _, level := range []Severity{WarnLevel, InfoLevel, ErrorLevel, DebugLevel} {
+		select {
+		case msg := <-peer.Read():
+			assert.Equal(t, fmt.Sprint(int(level)), fmt.Sprint(msg.Payload[0]))
+		case <-time.After(time.Second):
+			t.Fatal("batched message is lost")
+		}
+	}
+}
+
+func newLoggingServiceInfo() *ServiceInfo {
+	return &ServiceInfo{
+		API: dispatchMap{
+			0: dispatchItem{
+				Name:       "emit",
+				Downstream: emptyDescription,
+				Upstream:   emptyDescription,
+			},
+			1: dispatchItem{
+				Name:       "verbosity",
+				Downstream: emptyDescription,
+				Upstream: &streamDescription{
+					0: &StreamDescriptionItem{
+						Name:        "value",
+						Description: emptyDescription,
+					},
+					1: &StreamDescriptionItem{
+						Name:        "error",
+						Description: emptyDescription,
+					},
+				},
+			},
+			2: dispatchItem{
+				Name:       "set_verbosity",
+				Downstream: emptyDescription,
+				Upstream: &streamDescription{
+					0: &StreamDescriptionItem{
+						Name:        "value",
+						Description: emptyDescription,
+					},
+					1: &StreamDescriptionItem{
+						Name:        "error",
+						Description: emptyDescription,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestWatchVerbosity(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go log.watchVerbosity(ctx, time.Millisecond)
+
+	for _, level := range []Severity{InfoLevel, ErrorLevel} {
+		msg := <-peer.Read()
+		assert.Equal(t, uint64(1), msg.MsgType)
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{level},
+		}
+
+		for i := 0; i < 100 && log.severity.get() != level; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		assert.True(t, log.V(level))
+		assert.False(t, log.V(level-1))
+	}
+
+	cancel()
+}
+
+func TestVerbosityRefresh(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+
+	log.SetVerbosityRefresh(time.Millisecond)
+	for _, level := range []Severity{ErrorLevel, DebugLevel, WarnLevel} {
+		msg := <-peer.Read()
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{level},
+		}
+
+		for i := 0; i < 100 && log.severity.get() != level; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, level, log.severity.get())
+	}
+
+	// the last poll might be in flight
+	log.SetVerbosityRefresh(0)
+	select {
+	case msg := <-peer.Read():
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{InfoLevel},
+		}
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	select {
+	case <-peer.Read():
+		t.Fatal("the verbosity is polled after the refresh is stopped")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestCocaineLoggerSetVerbosity(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+
+	// the unknown verbosity is fetched in background,
+	// records are sent meanwhile
+	assert.True(t, log.V(DebugLevel))
+	msg := <-peer.Read()
+	assert.Equal(t, uint64(1), msg.MsgType)
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{InfoLevel},
+	}
+	for i := 0; i < 100 && log.severity.get() != InfoLevel; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, log.V(DebugLevel))
+
+	// the cached verbosity is changed after the reply
+	done := make(chan error, 1)
+	go func() {
+		done <- log.SetVerbosity(context.Background(), ErrorLevel)
+	}()
+	msg = <-peer.Read()
+	assert.Equal(t, uint64(2), msg.MsgType)
+	assert.Equal(t, fmt.Sprint(int(ErrorLevel)), fmt.Sprint(msg.Payload[0]))
+	assert.True(t, log.V(InfoLevel))
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{},
+	}
+	assert.NoError(t, <-done)
+	assert.False(t, log.V(InfoLevel))
+	assert.True(t, log.V(ErrorLevel))
+}
+
+func TestCocaineLoggerVerbosityConcurrency(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+
+	// the service replies to every call
+	go func() {
+		for msg := range peer.Read() {
+			payload := []interface{}{}
+			if msg.MsgType == 1 {
+				payload = []interface{}{DebugLevel}
+			}
+			peer.Write() <- &Message{
+				CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+				Payload:           payload,
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				log.V(Severity(j % 5))
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.NoError(t, log.SetVerbosity(context.Background(), Severity((i+j)%4)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the fetched verbosity never overrides the one set
+	assert.NoError(t, log.SetVerbosity(context.Background(), WarnLevel))
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, log.V(InfoLevel))
+	assert.True(t, log.V(WarnLevel))
+}
+
+func TestCocaineLoggerLocalFiltering(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(InfoLevel)
+
+	log.Debugf("dropped %d", 1)
+	log.WithFields(Fields{"a": 1}).Debugf("dropped %d", 2)
+	log.Infof("sent %d", 1)
+	msg := <-peer.Read()
+	assert.Equal(t, "sent 1", fmt.Sprintf("%s", msg.Payload[2]))
+
+	log.SetLocalFiltering(false)
+	assert.True(t, log.V(DebugLevel))
+	log.Debugf("sent %d", 2)
+	msg = <-peer.Read()
+	assert.Equal(t, "sent 2", fmt.Sprintf("%s", msg.Payload[2]))
+}
+
+func TestLoggerTraceLevel(t *testing.T) {
+	var buf bytes.Buffer
+	console := NewConsoleLogger(&buf, DebugLevel)
+	console.Tracef("dropped %d", 1)
+	assert.Equal(t, 0, buf.Len())
+
+	console.(ConsoleLogger).SetVerbosity(TraceLevel)
+	console.WithFields(Fields{"a": 1}).Tracef("sent %d", 1)
+	assert.Contains(t, buf.String(), "level=TRACE")
+	assert.Contains(t, buf.String(), "sent 1")
+
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(DebugLevel)
+	log.SetClientTimestamps(false)
+
+	log.Trace("dropped")
+	log.SetTraceEnabled(true)
+	log.Trace("sent")
+	// the logging service has no trace level
+	msg := <-peer.Read()
+	assert.Equal(t, fmt.Sprint(int(DebugLevel)), fmt.Sprint(msg.Payload[0]))
+	assert.Equal(t, "sent", fmt.Sprintf("%s", msg.Payload[2]))
+	assert.Equal(t, "[[original_level trace]]", fmt.Sprintf("%s", msg.Payload[3]))
+}
+
+func TestCocaineLoggerFatalLevel(t *testing.T) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(DebugLevel)
+	log.SetClientTimestamps(false)
+
+	// the logging service has no fatal level
+	log.Log(FatalLevel, "failure")
+	msg := <-peer.Read()
+	assert.Equal(t, fmt.Sprint(int(ErrorLevel)), fmt.Sprint(msg.Payload[0]))
+	assert.Equal(t, "failure", fmt.Sprintf("%s", msg.Payload[2]))
+	assert.Equal(t, "[[original_level fatal]]", fmt.Sprintf("%s", msg.Payload[3]))
+}
+
+func TestLoggerLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewConsoleLogger(&buf, InfoLevel)
+	hook := NewCountingHook()
+	log.AddHook(hook)
+
+	for _, status := range []int{404, 502} {
+		level := InfoLevel
+		if status >= 500 {
+			level = ErrorLevel
+		}
+		log.WithFields(Fields{"status": status}).Logf(level, "upstream replied %d", status)
+	}
+	log.Log(DebugLevel, "dropped")
+
+	assert.Contains(t, buf.String(), "level=INFO")
+	assert.Contains(t, buf.String(), "level=ERROR")
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Equal(t, uint64(1), hook.Count(InfoLevel))
+	assert.Equal(t, uint64(1), hook.Count(ErrorLevel))
+	assert.Equal(t, uint64(0), hook.Count(DebugLevel))
+}
+
+func TestMultiLogger(t *testing.T) {
+	var buf bytes.Buffer
+	console := NewConsoleLogger(&buf, InfoLevel)
+	records := &testRecordLogger{}
+	log := MultiLogger(console.WithPersistentFields(Fields{"backend": "console"}), records)
+	hook := NewCountingHook()
+	log.AddHook(hook)
+
+	assert.True(t, log.V(DebugLevel))
+	assert.Equal(t, DebugLevel, log.Verbosity(context.Background()))
+
+	log.WithPersistentFields(Fields{"a": 1}).WithFields(Fields{"b": 2}).Infof("info %d", 1)
+	log.Debug("debug")
+	batch := log.Batch()
+	batch.Warn("batched")
+	batch.Flush()
+
+	// the console logger drops the debug record
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Contains(t, lines[0], "message=\"info 1\" a=1 b=2 backend=console")
+		assert.Contains(t, lines[1], "message=batched backend=console")
+	}
+	logged := records.Records()
+	if assert.Equal(t, 3, len(logged)) {
+		assert.Equal(t, testLogRecord{InfoLevel, Fields{"a": 1, "b": 2}, "info 1"}, logged[0])
+		assert.Equal(t, "debug", logged[1].msg)
+		assert.Equal(t, "batched", logged[2].msg)
+	}
+	assert.Equal(t, uint64(1), hook.Count(InfoLevel))
+	assert.Equal(t, uint64(1), hook.Count(DebugLevel))
+
+	assert.NoError(t, log.Flush(context.Background()))
+	assert.Equal(t, "a; b", loggerErrors{errors.New("a"), errors.New("b")}.Error())
+}
+
+type testHook struct {
+	levels []Severity
+	err    error
+	fired  []string
+}
+
+func (h *testHook) Levels() []Severity { return h.levels }
+
+func (h *testHook) Fire(level Severity, msg string, fields Fields) error {
+	h.fired = append(h.fired, fmt.Sprintf("%s %s %v", level, msg, fields["a"]))
+	return h.err
+}
+
+func TestLoggerHooks(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewConsoleLogger(&buf, InfoLevel)
+
+	errorHook := &testHook{levels: []Severity{ErrorLevel}}
+	failing := &testHook{levels: []Severity{InfoLevel}, err: fmt.Errorf("hook error")}
+	log.AddHook(errorHook)
+	log.AddHook(failing)
+
+	log.Debugf("filtered")
+	log.WithFields(Fields{"a": 1}).Infof("info %d", 1)
+	log.Infof("info %d", 2)
+	log.Errf("error")
+
+	assert.Equal(t, []string{"INFO info 1 1", "INFO info 2 <nil>"}, failing.fired)
+	// the error of the hook is logged once
+	assert.Equal(t, []string{"ERROR log hook failed <nil>", "ERROR error <nil>"}, errorHook.fired)
+	assert.Equal(t, 4, bytes.Count(buf.Bytes(), []byte("\n")))
+	assert.Contains(t, buf.String(), "hook error")
+}
+
+func TestCountingHook(t *testing.T) {
+	hook := NewCountingHook(WarnLevel, ErrorLevel)
+	assert.Equal(t, []Severity{WarnLevel, ErrorLevel}, hook.Levels())
+
+	console := NewConsoleLogger(&bytes.Buffer{}, DebugLevel)
+	console.AddHook(hook)
+	console.Info("info")
+	console.WithFields(Fields{"a": 1}).Warn("warning")
+	console.Errf("error")
+	console.Errf("error")
+
+	assert.Equal(t, uint64(0), hook.Count(InfoLevel))
+	assert.Equal(t, uint64(1), hook.Count(WarnLevel))
+	assert.Equal(t, uint64(2), hook.Count(ErrorLevel))
+	assert.Equal(t, uint64(0), hook.Count(Severity(100)))
+	assert.Equal(t, 6, len(NewCountingHook().Levels()))
+}
+
+func TestLoggerFatal(t *testing.T) {
+	var code int
+	SetExitFunc(func(c int) { code = c })
+	defer SetExitFunc(nil)
+
+	logger := &testRecordLogger{}
+	logger.WithFields(Fields{"key": "value"}).Fatalf("fatal %d", 1)
+	assert.Equal(t, 1, code)
+
+	records := logger.Records()
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, FatalLevel, records[0].level)
+		assert.Equal(t, "fatal 1", records[0].msg)
+		assert.Equal(t, "value", records[0].fields["key"])
+	}
+
+	code = 0
+	NewNopLogger().Fatal("discarded")
+	assert.Equal(t, 1, code)
+}
+
+func TestAsyncCocaineLoggerFatal(t *testing.T) {
+	s, peer := newTestService("logging", &ServiceInfo{})
+	log := newAsyncCocaineLogger(s, 16)
+	log.SetBatching(10, time.Hour)
+
+	// the batch and the queue are written before the exit
+	var (
+		code   int
+		closed bool
+	)
+	SetExitFunc(func(c int) {
+		code = c
+		closed = s.disconnected()
+	})
+	defer SetExitFunc(nil)
+
+	log.Info("buffered")
+	log.Fatal("fatal")
+	assert.Equal(t, 1, code)
+	assert.True(t, closed)
+
+	for _, expected := range []string{"buffered", "fatal"} {
+		select {
+		case msg := <-peer.Read():
+			assert.Equal(t, expected, fmt.Sprintf("%s", msg.Payload[2]))
+		case <-time.After(time.Second):
+			t.Fatalf("%s record is lost", expected)
+		}
+	}
+}
+
+func TestLoggerPanic(t *testing.T) {
+	logger := &testRecordLogger{}
+	assert.Panics(t, func() {
+		logger.WithFields(Fields{"key": "value"}).Panicf("panic %d", 1)
+	})
+
+	records := logger.Records()
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, Severity(ErrorLevel), records[0].level)
+		assert.Equal(t, "panic 1", records[0].msg)
+	}
+
+	var buf bytes.Buffer
+	func() {
+		defer func() {
+			assert.Equal(t, "json panic", recover())
+		}()
+		newJSONLogger(&buf).Panic("json ", "panic")
+	}()
+	assert.Contains(t, buf.String(), `"message":"json panic"`)
+}
+
+func TestNopLogger(t *testing.T) {
+	var log Logger = NewNopLogger()
+	assert.False(t, log.V(ErrorLevel))
+	log.WithFields(Fields{"a": 1}).Errf("discarded %d", 1)
+	log.WithError(errors.New("failure")).Info("discarded")
+	log.Close()
+}
+
+func benchmarkSuppressedDebugf(b *testing.B, localFiltering bool) {
+	s, peer := newTestService("logging", newLoggingServiceInfo())
+	log := newCocaineLoggerWithService(s)
+	defer log.Close()
+	log.severity.set(InfoLevel)
+	log.SetLocalFiltering(localFiltering)
+
+	go func() {
+		for range peer.Read() {
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		log.Debugf("request %d is handled in %s", i, time.Millisecond)
+	}
+}
+
+func BenchmarkCocaineLoggerSuppressedDebugf(b *testing.B) {
+	benchmarkSuppressedDebugf(b, true)
+}
+
+func BenchmarkCocaineLoggerServerFilteredDebugf(b *testing.B) {
+	benchmarkSuppressedDebugf(b, false)
+}
+
+func formattedFields(f Fields) map[string]interface{} {
+	result := make(map[string]interface{})
+	for _, attr := range formatFields(f) {
+		result[attr.Name] = attr.Value
+	}
+	return result
+}
+
+func TestFormatFields(t *testing.T) {
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 6, time.UTC)
+	fields := Fields{
+		"int":      1,
+		"time":     ts,
+		"duration": 1500 * time.Microsecond,
+		"error":    errors.New("failure"),
+		"severity": WarnLevel,
+		"request": map[string]interface{}{
+			"headers": map[string]string{"host": "localhost"},
+			"hosts":   []string{"a", "b"},
+		},
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"int":                  1,
+		"time":                 "2016-01-02T03:04:05.000000006Z",
+		"duration":             int64(1500),
+		"error":                "failure",
+		"severity":             "WARNING",
+		"request.headers.host": "localhost",
+		"request.hosts.0":      "a",
+		"request.hosts.1":      "b",
+	}, formattedFields(fields))
+
+	SetNestedFieldsFormat(NestedJSON)
+	defer SetNestedFieldsFormat(NestedFlatten)
+	assert.Equal(t, map[string]interface{}{
+		"hosts": `["a","b"]`,
+	}, formattedFields(Fields{"hosts": []string{"a", "b"}}))
+
+	type point struct{ X, Y int }
+	SetFieldNormalizer(func(key string, value interface{}) (string, interface{}) {
+		if p, ok := value.(point); ok {
+			return key, []int{p.X, p.Y}
+		}
+		return key, value
+	})
+	defer SetFieldNormalizer(nil)
+	assert.Equal(t, map[string]interface{}{
+		"point": "[1,2]",
+	}, formattedFields(Fields{"point": point{1, 2}}))
+}
+
+type testStringer struct{ name string }
+
+func (s testStringer) String() string { return s.name }
+
+func TestFormatFieldsNilPointer(t *testing.T) {
+	var (
+		err      *ErrRequest
+		stringer *testStringer
+	)
+	assert.Equal(t, map[string]interface{}{
+		"error":    "<nil>",
+		"stringer": "<nil>",
+		"list.0":   "<nil>",
+	}, formattedFields(Fields{"error": err, "stringer": stringer, "list": []interface{}{stringer}}))
+}
+
+func TestFormatFieldsDepth(t *testing.T) {
+	cycle := map[string]interface{}{}
+	cycle["self"] = cycle
+
+	key := "cycle" + strings.Repeat(".self", maxNestedDepth+1)
+	assert.Equal(t, map[string]interface{}{
+		key: nestedTooDeepValue,
+	}, formattedFields(Fields{"cycle": cycle}))
+
+	SetNestedFieldsFormat(NestedJSON)
+	defer SetNestedFieldsFormat(NestedFlatten)
+	SetRedactedKeys("password")
+	defer SetRedactedKeys()
+
+	formatted := formattedFields(Fields{"cycle": cycle})
+	assert.Contains(t, formatted["cycle"], `{"self":{"self":`)
+	assert.Contains(t, formatted["cycle"], `"self":"`+nestedTooDeepValue+`"`)
+}
+
+func TestFormatFieldsOrder(t *testing.T) {
+	fields := Fields{
+		"b":   2,
+		"a.b": 1,
+		"a":   map[string]int{"c": 3, "b": 2},
+		"c":   []int{1},
+	}
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []attrPair{
+			{"a.b", 2}, {"a.b", 1}, {"a.c", 3}, {"b", 2}, {"c.0", 1},
+		}, formatFields(fields))
+	}
+}
+
+// resetRedaction removes the redacted keys and redactors
+func resetRedaction() {
+	fieldsFormatMu.Lock()
+	fieldsRedaction = nil
+	fieldsFormatMu.Unlock()
+}
+
+func TestFormatFieldsRedaction(t *testing.T) {
+	defer resetRedaction()
+	SetRedactedKeys("password", "*_TOKEN")
+	RegisterRedactor(func(key string, value interface{}) (interface{}, bool) {
+		if s, ok := value.(string); ok && len(s) == 16 && strings.Trim(s, "0123456789") == "" {
+			return "****" + s[12:], true
+		}
+		return nil, false
+	})
+
+	fields := Fields{
+		"Password":     "secret",
+		"access_token": "token",
+		"user":         "john",
+		"request": map[string]interface{}{
+			"refresh_token": "token",
+			"card":          "4111111111111111",
+			"tokens":        []string{"a"},
+		},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"Password":              RedactedValue,
+		"access_token":          RedactedValue,
+		"user":                  "john",
+		"request.refresh_token": RedactedValue,
+		"request.card":          "****1111",
+		"request.tokens.0":      "a",
+	}, formattedFields(fields))
+
+	SetNestedFieldsFormat(NestedJSON)
+	defer SetNestedFieldsFormat(NestedFlatten)
+	assert.Equal(t, map[string]interface{}{
+		"request": `{"card":"****1111","id":1,"refresh_token":"[REDACTED]"}`,
+	}, formattedFields(Fields{"request": map[string]interface{}{
+		"refresh_token": "token",
+		"card":          "4111111111111111",
+		"id":            1,
+	}}))
+
+	SetRedactedKeys()
+	assert.Equal(t, map[string]interface{}{
+		"password": "secret",
+	}, formattedFields(Fields{"password": "secret"}))
+}
+
+func TestFormatFieldsRedactionStruct(t *testing.T) {
+	type Req struct {
+		ID        int
+		AuthToken string
+		Header    *struct {
+			SessionToken string `json:"session_token"`
+		}
+		secret string
+	}
+	req := &Req{ID: 1, AuthToken: "secret", secret: "secret"}
+	req.Header = &struct {
+		SessionToken string `json:"session_token"`
+	}{"secret"}
+
+	SetRedactedKeys("*token")
+	defer SetRedactedKeys()
+
+	assert.Equal(t, map[string]interface{}{
+		"request.ID":                   1,
+		"request.AuthToken":            RedactedValue,
+		"request.Header.session_token": RedactedValue,
+	}, formattedFields(Fields{"request": req}))
+
+	SetNestedFieldsFormat(NestedJSON)
+	defer SetNestedFieldsFormat(NestedFlatten)
+	assert.Equal(t, map[string]interface{}{
+		"request": `{"AuthToken":"[REDACTED]","Header":{"session_token":"[REDACTED]"},"ID":1}`,
+	}, formattedFields(Fields{"request": req}))
+
+	// time.Time is encoded by itself
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, map[string]interface{}{
+		"request": `{"time":"2016-01-02T03:04:05Z"}`,
+	}, formattedFields(Fields{"request": map[string]interface{}{"time": ts}}))
+}
+
+func TestGlobalFields(t *testing.T) {
+	SetGlobalFields(Fields{"dc": "sas", "host": "h1", "build": map[string]int{"version": 1}})
+	defer SetGlobalFields(nil)
+
+	var buf bytes.Buffer
+	console := NewConsoleLogger(&buf, DebugLevel)
+	console.SetFormat(ConsoleJSON)
+	api := console.WithPersistentFields(Fields{"host": "h2", "component": "api"})
+	api.WithFields(Fields{"component": "db"}).Info("message")
+
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "sas", record["dc"])
+	assert.Equal(t, "h2", record["host"])
+	assert.Equal(t, "db", record["component"])
+
+	// the global fields are formatted once and merged by name
+	global := formatFields(nil)
+	assert.Equal(t, []attrPair{{"build.version", 1}, {"dc", "sas"}, {"host", "h1"}}, global)
+	assert.Equal(t, []attrPair{
+		{"a", 1}, {"build.version", 2}, {"dc", "sas"}, {"host", "h1"},
+	}, formatFields(Fields{"a": 1, "build": map[string]int{"version": 2}}))
+
+	SetRedactedKeys("host")
+	defer resetRedaction()
+	assert.Equal(t, RedactedValue, formattedFields(nil)["host"])
+
+	SetGlobalFields(nil)
+	assert.Equal(t, []attrPair{}, formatFields(nil))
+}
+
 func BenchmarkFormatFields5(b *testing.B) {
 	fields := Fields{
 		"A":    1,
@@ -30,3 +1700,38 @@ func BenchmarkFormatFields5(b *testing.B) {
 		formatFields(fields)
 	}
 }
+
+func BenchmarkFormatFields5Redacted(b *testing.B) {
+	defer resetRedaction()
+	SetRedactedKeys("*_token", "password")
+
+	fields := Fields{
+		"A":    1,
+		"B":    2,
+		"C":    3,
+		"TEXT": "TEXT",
+	}
+	for i := 0; i < b.N; i++ {
+		formatFields(fields)
+	}
+}
+
+func BenchmarkFormatFieldsGlobal(b *testing.B) {
+	SetGlobalFields(Fields{"dc": "sas", "host": "h1", "version": "1.0"})
+	defer SetGlobalFields(nil)
+
+	for i := 0; i < b.N; i++ {
+		formatFields(defaultFields)
+	}
+}
+
+func BenchmarkEntryWithFields(b *testing.B) {
+	// the entry of WithSource has no fields
+	entry := &Entry{Logger: NewNopLogger()}
+	fields := Fields{"a": 1}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		entry.WithFields(fields).Info("message")
+	}
+}
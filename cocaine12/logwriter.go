@@ -0,0 +1,108 @@
+package cocaine12
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+)
+
+// logWriter logs every line written to it with the given severity.
+// A partial line is kept until the rest of it is written or Close.
+type logWriter struct {
+	logger Logger
+	level  Severity
+	fields Fields
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newLogWriter(logger Logger, level Severity, fields Fields) io.WriteCloser {
+	if fields == nil {
+		fields = defaultFields
+	}
+
+	return &logWriter{
+		logger: logger,
+		level:  level,
+		fields: fields,
+	}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	if !w.logger.V(w.level) {
+		return len(p), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data := p
+	if len(w.buf) > 0 {
+		w.buf = append(w.buf, p...)
+		data = w.buf
+	}
+
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(data[:i])
+		data = data[i+1:]
+	}
+
+	// the partial line is copied, as p must not be retained
+	w.buf = append(w.buf[:0], data...)
+	return len(p), nil
+}
+
+// Close logs the partial line
+func (w *logWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.emit(w.buf)
+	w.buf = nil
+	return nil
+}
+
+func (w *logWriter) emit(line []byte) {
+	if len(line) > 0 {
+		w.logger.log(w.level, w.fields, "%s", line)
+	}
+}
+
+// NewStdLogger returns log.Logger, which logs to the logger
+// with the given severity. It allows to pass the logs of third-party
+// libraries to Cocaine.
+func NewStdLogger(l Logger, level Severity) *log.Logger {
+	return log.New(l.Writer(level), "", 0)
+}
+
+// Writer returns io.WriteCloser, which logs every written line
+// with the given severity
+func (c *cocaineLogger) Writer(level Severity) io.WriteCloser {
+	return newLogWriter(c, level, nil)
+}
+
+// StdLogger returns log.Logger, which logs to the logging service
+// with the given severity
+func (c *cocaineLogger) StdLogger(level Severity) *log.Logger {
+	return NewStdLogger(c, level)
+}
+
+func (j *consoleLogger) Writer(level Severity) io.WriteCloser {
+	return newLogWriter(j, level, nil)
+}
+
+func (f *fallbackLogger) Writer(level Severity) io.WriteCloser {
+	return newLogWriter(f, level, nil)
+}
+
+// Writer returns io.WriteCloser, which logs every written line
+// with the fields of the Entry
+func (e *Entry) Writer(level Severity) io.WriteCloser {
+	return newLogWriter(e.Logger, level, e.Fields)
+}
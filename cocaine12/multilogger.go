@@ -0,0 +1,375 @@
+package cocaine12
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// multiLogger forwards every record to each of the loggers
+type multiLogger struct {
+	loggers []Logger
+	// hooks are shared with the derived loggers and fire once per record
+	hooks *hooks
+
+	errsOnce sync.Once
+	errs     chan error
+}
+
+// just for the type check
+var _ batchLogger = &multiLogger{}
+
+// MultiLogger returns a logger, which sends every record to all
+// of the loggers, e.g. to the logging service and to stderr.
+// A record is logged if any of the loggers wants its level,
+// each logger drops the records below its own verbosity.
+// Hooks added to the returned logger fire once per record.
+func MultiLogger(loggers ...Logger) Logger {
+	switch len(loggers) {
+	case 0:
+		return NewNopLogger()
+	case 1:
+		return loggers[0]
+	}
+
+	return &multiLogger{
+		loggers: append([]Logger(nil), loggers...),
+		hooks:   &hooks{},
+	}
+}
+
+// loggerFields returns the fields of the record merged with the fields
+// of the logger, if it's an Entry, as log of Entry doesn't attach them
+func loggerFields(l Logger, fields Fields) Fields {
+	e, ok := l.(*Entry)
+	if !ok || len(e.Fields) == 0 {
+		return fields
+	}
+	if len(fields) == 0 {
+		return e.Fields
+	}
+
+	merged := make(Fields, len(e.Fields)+len(fields))
+	for k, v := range e.Fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (m *multiLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {
+	if atomic.LoadInt32(&m.hooks.count) > 0 {
+		text := msg
+		if len(args) > 0 {
+			text = fmt.Sprintf(msg, args...)
+		}
+		if err := m.hooks.fire(level, text, fields); err != nil {
+			m.log(ErrorLevel, errorFields(nil, err), "%s", "log hook failed")
+		}
+	}
+
+	for _, l := range m.loggers {
+		if l.V(level) {
+			l.log(level, loggerFields(l, fields), msg, args...)
+		}
+	}
+}
+
+func (m *multiLogger) logBatch(records []traceRecord) {
+	for _, l := range m.loggers {
+		if batch, ok := l.(batchLogger); ok {
+			batch.logBatch(records)
+			continue
+		}
+
+		for _, record := range records {
+			if l.V(record.level) {
+				l.log(record.level, loggerFields(l, record.fields), "%s", record.msg)
+			}
+		}
+	}
+}
+
+func (m *multiLogger) WithFields(fields Fields) *Entry {
+	return &Entry{
+		Logger: m,
+		Fields: fields,
+	}
+}
+
+func (m *multiLogger) WithError(err error) *Entry {
+	return &Entry{
+		Logger: m,
+		Fields: errorFields(nil, err),
+	}
+}
+
+func (m *multiLogger) WithContext(ctx context.Context) *Entry {
+	return &Entry{
+		Logger: m,
+		Fields: contextFields(nil, ctx),
+	}
+}
+
+func (m *multiLogger) WithSource(source string) Logger {
+	loggers := make([]Logger, 0, len(m.loggers))
+	for _, l := range m.loggers {
+		loggers = append(loggers, l.WithSource(source))
+	}
+
+	return &multiLogger{
+		loggers: loggers,
+		hooks:   m.hooks,
+	}
+}
+
+func (m *multiLogger) WithPersistentFields(fields Fields) Logger {
+	return m.WithFields(fields)
+}
+
+// Verbosity returns the lowest verbosity of the loggers
+func (m *multiLogger) Verbosity(ctx context.Context) Severity {
+	level := m.loggers[0].Verbosity(ctx)
+	for _, l := range m.loggers[1:] {
+		if lvl := l.Verbosity(ctx); lvl < level {
+			level = lvl
+		}
+	}
+	return level
+}
+
+func (m *multiLogger) V(level Severity) bool {
+	for _, l := range m.loggers {
+		if l.V(level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *multiLogger) WatchVerbosity(ctx context.Context) {
+	for _, l := range m.loggers {
+		l.WatchVerbosity(ctx)
+	}
+}
+
+// SetReportCaller makes the loggers skip the frame of multiLogger
+func (m *multiLogger) SetReportCaller(enable bool) {
+	for _, l := range m.loggers {
+		if enable {
+			l.SetCallerSkip(1)
+		} else {
+			l.SetReportCaller(false)
+		}
+	}
+}
+
+func (m *multiLogger) SetCallerSkip(skip int) {
+	for _, l := range m.loggers {
+		l.SetCallerSkip(skip + 1)
+	}
+}
+
+func (m *multiLogger) SetRateLimit(perKey int, window time.Duration) {
+	for _, l := range m.loggers {
+		l.SetRateLimit(perKey, window)
+	}
+}
+
+func (m *multiLogger) SetDebugSampling(n int) {
+	for _, l := range m.loggers {
+		l.SetDebugSampling(n)
+	}
+}
+
+func (m *multiLogger) Writer(level Severity) io.WriteCloser {
+	return newLogWriter(m, level, nil)
+}
+
+func (m *multiLogger) Batch() *LogBatch {
+	return NewLogBatch(m)
+}
+
+func (m *multiLogger) AddHook(hook Hook) {
+	m.hooks.add(hook)
+}
+
+func (m *multiLogger) SetErrorHandler(handler func(error)) {
+	for _, l := range m.loggers {
+		l.SetErrorHandler(handler)
+	}
+}
+
+// Errors returns a channel receiving the errors of all loggers
+func (m *multiLogger) Errors() <-chan error {
+	m.errsOnce.Do(func() {
+		m.errs = make(chan error, logErrorsBufferSize)
+		for _, l := range m.loggers {
+			if ch := l.Errors(); ch != nil {
+				go m.forwardErrors(ch)
+			}
+		}
+	})
+	return m.errs
+}
+
+func (m *multiLogger) forwardErrors(ch <-chan error) {
+	for err := range ch {
+		select {
+		case m.errs <- err:
+		default:
+		}
+	}
+}
+
+// Flush flushes all loggers. If several of them fail,
+// the error lists all failures.
+func (m *multiLogger) Flush(ctx context.Context) error {
+	var errs loggerErrors
+	for _, l := range m.loggers {
+		if err := l.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
+// Close closes all loggers. Their failures, e.g. records dropped
+// on close, are reported to their error handlers.
+func (m *multiLogger) Close() {
+	for _, l := range m.loggers {
+		l.Close()
+	}
+}
+
+// loggerErrors is returned when several loggers fail
+type loggerErrors []error
+
+func (e loggerErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (m *multiLogger) Errf(format string, args ...interface{}) {
+	if m.V(ErrorLevel) {
+		m.log(ErrorLevel, defaultFields, format, args...)
+	}
+}
+
+func (m *multiLogger) Err(args ...interface{}) {
+	if m.V(ErrorLevel) {
+		m.log(ErrorLevel, defaultFields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (m *multiLogger) Warnf(format string, args ...interface{}) {
+	if m.V(WarnLevel) {
+		m.log(WarnLevel, defaultFields, format, args...)
+	}
+}
+
+func (m *multiLogger) Warn(args ...interface{}) {
+	if m.V(WarnLevel) {
+		m.log(WarnLevel, defaultFields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (m *multiLogger) Infof(format string, args ...interface{}) {
+	if m.V(InfoLevel) {
+		m.log(InfoLevel, defaultFields, format, args...)
+	}
+}
+
+func (m *multiLogger) Info(args ...interface{}) {
+	if m.V(InfoLevel) {
+		m.log(InfoLevel, defaultFields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (m *multiLogger) Debugf(format string, args ...interface{}) {
+	if m.V(DebugLevel) {
+		m.log(DebugLevel, defaultFields, format, args...)
+	}
+}
+
+func (m *multiLogger) Debug(args ...interface{}) {
+	if m.V(DebugLevel) {
+		m.log(DebugLevel, defaultFields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (m *multiLogger) Tracef(format string, args ...interface{}) {
+	if m.V(TraceLevel) {
+		m.log(TraceLevel, defaultFields, format, args...)
+	}
+}
+
+func (m *multiLogger) Trace(args ...interface{}) {
+	if m.V(TraceLevel) {
+		m.log(TraceLevel, defaultFields, "%s", fmt.Sprint(args...))
+	}
+}
+
+func (m *multiLogger) Logf(level Severity, format string, args ...interface{}) {
+	if m.V(level) {
+		m.log(level, defaultFields, format, args...)
+	}
+}
+
+func (m *multiLogger) Log(level Severity, args ...interface{}) {
+	if m.V(level) {
+		m.log(level, defaultFields, "%s", fmt.Sprint(args...))
+	}
+}
+
+// Fatalf logs the record to all loggers before closing them,
+// so the first of them doesn't exit the process alone
+func (m *multiLogger) Fatalf(format string, args ...interface{}) {
+	if m.V(FatalLevel) {
+		m.log(FatalLevel, defaultFields, format, args...)
+	}
+	m.Close()
+	exit(1)
+}
+
+func (m *multiLogger) Fatal(args ...interface{}) {
+	if m.V(FatalLevel) {
+		m.log(FatalLevel, defaultFields, "%s", fmt.Sprint(args...))
+	}
+	m.Close()
+	exit(1)
+}
+
+func (m *multiLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if m.V(ErrorLevel) {
+		m.log(ErrorLevel, defaultFields, "%s", msg)
+	}
+	panic(msg)
+}
+
+func (m *multiLogger) Panic(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	if m.V(ErrorLevel) {
+		m.log(ErrorLevel, defaultFields, "%s", msg)
+	}
+	panic(msg)
+}
@@ -0,0 +1,108 @@
+package cocaine12
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// NopLogger discards all records. It might be used to silence
+// logging in tests and benchmarks, e.g. SetTraceLogger(NewNopLogger()).
+type NopLogger struct{}
+
+// NewNopLogger returns Logger, which discards all records
+func NewNopLogger() *NopLogger {
+	return &NopLogger{}
+}
+
+func (n NopLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {}
+
+func (n NopLogger) WithFields(fields Fields) *Entry {
+	return &Entry{
+		Logger: n,
+		Fields: fields,
+	}
+}
+
+func (n NopLogger) WithError(err error) *Entry {
+	return &Entry{
+		Logger: n,
+	}
+}
+
+func (n NopLogger) WithContext(ctx context.Context) *Entry {
+	return &Entry{
+		Logger: n,
+	}
+}
+
+func (n NopLogger) Verbosity(context.Context) Severity {
+	return ErrorLevel
+}
+
+func (n NopLogger) V(level Severity) bool {
+	return false
+}
+
+func (n NopLogger) WatchVerbosity(context.Context) {}
+
+func (n NopLogger) SetReportCaller(bool) {}
+
+func (n NopLogger) SetCallerSkip(skip int) {}
+
+func (n NopLogger) SetRateLimit(perKey int, window time.Duration) {}
+
+func (n NopLogger) SetDebugSampling(int) {}
+
+func (n NopLogger) SetErrorHandler(func(error)) {}
+
+func (n NopLogger) Errors() <-chan error { return nil }
+
+func (n NopLogger) Flush(context.Context) error { return nil }
+
+func (n NopLogger) AddHook(Hook) {}
+
+func (n NopLogger) WithSource(string) Logger { return n }
+
+func (n NopLogger) WithPersistentFields(Fields) Logger { return n }
+
+func (n NopLogger) Writer(level Severity) io.WriteCloser {
+	return newLogWriter(n, level, nil)
+}
+
+func (n NopLogger) Close() {}
+
+func (n NopLogger) Errf(format string, args ...interface{})   {}
+func (n NopLogger) Err(args ...interface{})                   {}
+func (n NopLogger) Warnf(format string, args ...interface{})  {}
+func (n NopLogger) Warn(args ...interface{})                  {}
+func (n NopLogger) Infof(format string, args ...interface{})  {}
+func (n NopLogger) Info(args ...interface{})                  {}
+func (n NopLogger) Debugf(format string, args ...interface{}) {}
+func (n NopLogger) Debug(args ...interface{})                 {}
+func (n NopLogger) Tracef(format string, args ...interface{}) {}
+func (n NopLogger) Trace(args ...interface{})                 {}
+
+func (n NopLogger) Logf(level Severity, format string, args ...interface{}) {}
+func (n NopLogger) Log(level Severity, args ...interface{})                 {}
+
+// Fatal and Panic methods discard the record,
+// but still exit and panic as the callers expect
+
+func (n NopLogger) Fatalf(format string, args ...interface{}) {
+	exit(1)
+}
+
+func (n NopLogger) Fatal(args ...interface{}) {
+	exit(1)
+}
+
+func (n NopLogger) Panicf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (n NopLogger) Panic(args ...interface{}) {
+	panic(fmt.Sprint(args...))
+}
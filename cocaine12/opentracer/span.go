@@ -0,0 +1,128 @@
+package opentracer
+
+import (
+	"fmt"
+	"sync"
+
+	cocaine "github.com/cocaine/cocaine-framework-go/cocaine12"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// SpanContext holds the ids of a span and its baggage
+type SpanContext struct {
+	traceInfo cocaine.TraceInfo
+	baggage   map[string]string
+}
+
+// TraceInfo returns the ids of the span
+func (c SpanContext) TraceInfo() cocaine.TraceInfo {
+	return c.traceInfo
+}
+
+// ForeachBaggageItem implements opentracing.SpanContext
+func (c SpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range c.baggage {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+// span adapts cocaine12.Span to opentracing.Span.
+// Tags and logged fields are attached to the closing record of the span.
+type span struct {
+	tracer *Tracer
+	sp     *cocaine.Span
+
+	mu            sync.Mutex
+	operationName string
+	context       SpanContext
+}
+
+func (s *span) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (s *span) FinishWithOptions(opts opentracing.FinishOptions) {
+	for _, record := range opts.LogRecords {
+		s.LogFields(record.Fields...)
+	}
+
+	s.mu.Lock()
+	operationName := s.operationName
+	s.mu.Unlock()
+
+	s.sp.Close("%s", operationName)
+}
+
+func (s *span) Context() opentracing.SpanContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.context
+}
+
+// SetOperationName changes the message of the closing record.
+// The name the span was started with is still logged as RPC.
+func (s *span) SetOperationName(operationName string) opentracing.Span {
+	s.mu.Lock()
+	s.operationName = operationName
+	s.mu.Unlock()
+	return s
+}
+
+func (s *span) SetTag(key string, value interface{}) opentracing.Span {
+	s.sp.SetTag(key, value)
+	return s
+}
+
+func (s *span) LogFields(fields ...log.Field) {
+	for _, field := range fields {
+		s.sp.SetTag(field.Key(), field.Value())
+	}
+}
+
+func (s *span) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		s.LogFields(log.Error(err))
+		return
+	}
+	s.LogFields(fields...)
+}
+
+// SetBaggageItem copies the baggage, so the SpanContexts
+// obtained before are not changed.
+func (s *span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.mu.Lock()
+	baggage := make(map[string]string, len(s.context.baggage)+1)
+	for k, v := range s.context.baggage {
+		baggage[k] = v
+	}
+	baggage[restrictedKey] = value
+	s.context.baggage = baggage
+	s.mu.Unlock()
+	return s
+}
+
+func (s *span) BaggageItem(restrictedKey string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.context.baggage[restrictedKey]
+}
+
+func (s *span) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s *span) LogEvent(event string) {
+	s.sp.LogEvent(event)
+}
+
+func (s *span) LogEventWithPayload(event string, payload interface{}) {
+	s.sp.LogEvent(fmt.Sprintf("%s: %v", event, payload))
+}
+
+func (s *span) Log(data opentracing.LogData) {
+	s.LogEventWithPayload(data.Event, data.Payload)
+}
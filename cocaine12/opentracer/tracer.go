@@ -0,0 +1,141 @@
+// Package opentracer implements opentracing.Tracer on top of
+// the spans of cocaine12. Spans are logged by cocaine12 the same way
+// as the spans started by WithTrace, so they share trace ids with
+// the rest of the Cocaine cloud.
+package opentracer
+
+import (
+	"net/http"
+
+	cocaine "github.com/cocaine/cocaine-framework-go/cocaine12"
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+)
+
+// Tracer is an opentracing.Tracer, which starts cocaine12 spans.
+// Inject and Extract use B3 headers.
+type Tracer struct{}
+
+var _ opentracing.Tracer = NewTracer()
+
+// NewTracer creates new Tracer
+func NewTracer() *Tracer {
+	return &Tracer{}
+}
+
+// StartSpan starts a span. The first ChildOf or FollowsFrom reference
+// to a SpanContext of this Tracer becomes the parent of the span,
+// otherwise a new trace is started.
+func (t *Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var options opentracing.StartSpanOptions
+	for _, opt := range opts {
+		opt.Apply(&options)
+	}
+
+	var (
+		parent  *SpanContext
+		refType opentracing.SpanReferenceType
+	)
+	for _, ref := range options.References {
+		if sc, ok := ref.ReferencedContext.(SpanContext); ok {
+			parent, refType = &sc, ref.Type
+			break
+		}
+	}
+
+	var (
+		ctx     context.Context
+		baggage map[string]string
+	)
+	if parent != nil {
+		ctx = cocaine.AttachTraceInfo(nil, parent.traceInfo)
+		baggage = parent.baggage
+	} else {
+		// the root span has no parent, so its TraceInfo has zero span id
+		traceInfo, _ := cocaine.TraceInfoFromContext(cocaine.BeginNewTraceContext(nil))
+		ctx = cocaine.AttachTraceInfo(nil, cocaine.NewTraceInfo(traceInfo.TraceID(), 0, 0))
+	}
+
+	var sp *cocaine.Span
+	if refType == opentracing.FollowsFromRef {
+		ctx, sp = cocaine.StartFollowsFromSpan(ctx, operationName)
+	} else {
+		ctx, sp = cocaine.StartSpan(ctx, operationName)
+	}
+
+	// an unsampled span passes the parent's TraceInfo downstream
+	traceInfo, _ := cocaine.TraceInfoFromContext(ctx)
+	s := &span{
+		tracer:        t,
+		sp:            sp,
+		operationName: operationName,
+		context: SpanContext{
+			traceInfo: traceInfo,
+			baggage:   baggage,
+		},
+	}
+
+	for key, value := range options.Tags {
+		s.SetTag(key, value)
+	}
+
+	return s
+}
+
+// Inject writes B3 headers to the carrier. HTTPHeaders and TextMap
+// formats are supported.
+func (t *Tracer) Inject(sc opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	spanContext, ok := sc.(SpanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+
+	switch format {
+	case opentracing.HTTPHeaders, opentracing.TextMap:
+	default:
+		return opentracing.ErrUnsupportedFormat
+	}
+
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	h := make(http.Header)
+	cocaine.InjectB3(cocaine.AttachTraceInfo(nil, spanContext.traceInfo), h)
+	for key := range h {
+		writer.Set(key, h.Get(key))
+	}
+
+	return nil
+}
+
+// Extract reads B3 headers from the carrier. HTTPHeaders and TextMap
+// formats are supported.
+func (t *Tracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	switch format {
+	case opentracing.HTTPHeaders, opentracing.TextMap:
+	default:
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+
+	h := make(http.Header)
+	if err := reader.ForeachKey(func(key, value string) error {
+		h.Add(key, value)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	traceInfo, ok := cocaine.ExtractB3(h)
+	if !ok {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+
+	return SpanContext{traceInfo: traceInfo}, nil
+}
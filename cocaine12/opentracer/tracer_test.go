@@ -0,0 +1,66 @@
+package opentracer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	cocaine "github.com/cocaine/cocaine-framework-go/cocaine12"
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type testObserver struct {
+	finished []cocaine.Fields
+}
+
+func (o *testObserver) StartSpan(rpcName string, traceInfo cocaine.TraceInfo, startTime time.Time, fields cocaine.Fields) {
+}
+
+func (o *testObserver) FinishSpan(rpcName string, traceInfo cocaine.TraceInfo, startTime, finishTime time.Time,
+	err error, fields cocaine.Fields, msg string) {
+	o.finished = append(o.finished, fields)
+}
+
+func TestTracerStartSpan(t *testing.T) {
+	observer := &testObserver{}
+	cocaine.SetSpanObserver(observer)
+	defer cocaine.SetSpanObserver(nil)
+
+	tracer := NewTracer()
+	root := tracer.StartSpan("root")
+	child := tracer.StartSpan("child", opentracing.ChildOf(root.Context()), opentracing.Tag{Key: "k", Value: 1})
+	child.Finish()
+	root.Finish()
+
+	rootInfo := root.Context().(SpanContext).TraceInfo()
+	childInfo := child.Context().(SpanContext).TraceInfo()
+	assert.Equal(t, uint64(0), rootInfo.ParentID())
+	assert.Equal(t, rootInfo.TraceID(), childInfo.TraceID())
+	assert.Equal(t, rootInfo.SpanID(), childInfo.ParentID())
+
+	if assert.Equal(t, 2, len(observer.finished)) {
+		assert.Equal(t, 1, observer.finished[0]["k"])
+	}
+}
+
+func TestTracerInjectExtract(t *testing.T) {
+	cocaine.SetSpanObserver(&testObserver{})
+	defer cocaine.SetSpanObserver(nil)
+
+	tracer := NewTracer()
+	sp := tracer.StartSpan("root")
+	defer sp.Finish()
+
+	h := make(http.Header)
+	err := tracer.Inject(sp.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+	assert.NoError(t, err)
+
+	sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+	if assert.NoError(t, err) {
+		assert.Equal(t, sp.Context().(SpanContext).TraceInfo(), sc.(SpanContext).TraceInfo())
+	}
+
+	_, err = tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(http.Header{}))
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+
+	"golang.org/x/net/context"
 )
 
 const (
@@ -103,7 +105,7 @@ func (h CocaineHeaders) getTraceData() (traceInfo TraceInfo, err error) {
 		number, buffer, _ := getTrace(header)
 		switch number {
 		case traceId:
-			if traceInfo.trace, err = decodeTracingId(buffer); err != nil {
+			if traceInfo.trace, traceInfo.traceHi, err = decodeTraceId(buffer); err != nil {
 				return
 			}
 
@@ -134,6 +136,44 @@ func (h CocaineHeaders) getTraceData() (traceInfo TraceInfo, err error) {
 	return traceInfo, ErrNotAllTracesPresent
 }
 
+func traceInfoToHeaders(traceInfo TraceInfo) CocaineHeaders {
+	return CocaineHeaders{
+		[]interface{}{false, traceId, encodeTraceId(traceInfo.trace, traceInfo.traceHi)},
+		[]interface{}{false, spanId, encodeTracingId(traceInfo.span)},
+		[]interface{}{false, parentId, encodeTracingId(traceInfo.parent)},
+	}
+}
+
+func encodeTracingId(tracingId uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, tracingId)
+	return b
+}
+
+// encodeTraceId encodes the high 64 bits of the trace id
+// after the low ones only if they are not zero,
+// so 64-bit ids are sent as before.
+func encodeTraceId(trace, traceHi uint64) []byte {
+	if traceHi == 0 {
+		return encodeTracingId(trace)
+	}
+
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint64(b, trace)
+	binary.LittleEndian.PutUint64(b[8:], traceHi)
+	return b
+}
+
+// decodeTraceId accepts both 8-byte and 16-byte trace ids
+func decodeTraceId(b []byte) (trace, traceHi uint64, err error) {
+	if len(b) == 16 {
+		return binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:]), nil
+	}
+
+	trace, err = decodeTracingId(b)
+	return trace, 0, err
+}
+
 func decodeTracingId(b []byte) (uint64, error) {
 	var tracingId uint64
 	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &tracingId)
@@ -145,6 +185,25 @@ type Message struct {
 	CommonMessageInfo
 	Payload []interface{}
 	Headers CocaineHeaders
+
+	// written is set for a flush marker, which is not sent. It's closed
+	// once the messages queued before the marker are written.
+	written chan struct{}
+}
+
+func newFlushMarker() *Message {
+	return &Message{written: make(chan struct{})}
+}
+
+// waitWritten waits until the messages queued before the marker
+// are written to the connection
+func (m *Message) waitWritten(ctx context.Context) error {
+	select {
+	case <-m.written:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (m *Message) String() string {
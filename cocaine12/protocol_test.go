@@ -140,6 +140,29 @@ func TestHeaders(t *testing.T) {
 	assert.Equal(t, uint64(8000), traceInfo.parent)
 }
 
+func TestHeaders128(t *testing.T) {
+	encodeDecode := func(traceInfo TraceInfo) (headers CocaineHeaders) {
+		var buff []byte
+		codec.NewEncoderBytes(&buff, hAsocket).MustEncode(traceInfoToHeaders(traceInfo))
+		codec.NewDecoderBytes(buff, hAsocket).MustDecode(&headers)
+		return headers
+	}
+
+	headers := encodeDecode(NewTraceInfo(9000, 11000, 8000))
+	_, b, err := getTrace(headers[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(b))
+
+	headers = encodeDecode(NewTraceInfo128(7000, 9000, 11000, 8000))
+	_, b, err = getTrace(headers[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 16, len(b))
+
+	traceInfo, err := headers.getTraceData()
+	assert.NoError(t, err)
+	assert.Equal(t, NewTraceInfo128(7000, 9000, 11000, 8000), traceInfo)
+}
+
 func BenchmarkTraceExtract(b *testing.B) {
 	var (
 		//trace.pack_trace(trace.Trace(traceid=9000, spanid=11000, parentid=8000))
@@ -0,0 +1,306 @@
+package cocaine12
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type rateKey struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// rateLimit limits the number of records with the same format per window.
+// The zero value allows every record.
+type rateLimit struct {
+	enabled int32
+
+	mu        sync.Mutex
+	perKey    int
+	window    time.Duration
+	keys      map[uint64]*rateKey
+	lastSweep time.Time
+}
+
+func (r *rateLimit) set(perKey int, window time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.perKey, r.window = perKey, window
+	r.keys = make(map[uint64]*rateKey)
+	if perKey > 0 && window > 0 {
+		atomic.StoreInt32(&r.enabled, 1)
+	} else {
+		atomic.StoreInt32(&r.enabled, 0)
+	}
+}
+
+// apply returns false if the record must be dropped. Otherwise it returns
+// fields to be logged, which contain "suppressed" if records
+// of the format were dropped in the previous window.
+func (r *rateLimit) apply(fields Fields, format string, args []interface{}) (Fields, bool) {
+	if atomic.LoadInt32(&r.enabled) == 0 {
+		return fields, true
+	}
+
+	suppressed, ok := r.allow(rateLimitKey(format, args), time.Now())
+	if !ok {
+		return nil, false
+	}
+
+	if suppressed > 0 {
+		result := make(Fields, len(fields)+1)
+		for k, v := range fields {
+			result[k] = v
+		}
+		result["suppressed"] = suppressed
+		fields = result
+	}
+
+	return fields, true
+}
+
+// rateLimitKey returns the format of the record. Print-like methods
+// might log their text via "%s", so the text is used instead.
+func rateLimitKey(format string, args []interface{}) string {
+	if format == "%s" && len(args) == 1 {
+		if text, ok := args[0].(string); ok {
+			return text
+		}
+	}
+	return format
+}
+
+func (r *rateLimit) allow(format string, now time.Time) (suppressed int, ok bool) {
+	h := fnv.New64a()
+	h.Write([]byte(format))
+	hash := h.Sum64()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.perKey <= 0 {
+		return 0, true
+	}
+
+	r.sweepLocked(now)
+
+	key, found := r.keys[hash]
+	if !found {
+		key = &rateKey{windowStart: now}
+		r.keys[hash] = key
+	}
+
+	if now.Sub(key.windowStart) >= r.window {
+		// the window resets, so report the dropped records
+		suppressed = key.suppressed
+		key.windowStart, key.count, key.suppressed = now, 0, 0
+	}
+
+	if key.count >= r.perKey {
+		key.suppressed++
+		return 0, false
+	}
+
+	key.count++
+	return suppressed, true
+}
+
+// sweepLocked forgets the formats, which have not been logged
+// for two windows, so the map does not grow infinitely
+func (r *rateLimit) sweepLocked(now time.Time) {
+	if now.Sub(r.lastSweep) < r.window {
+		return
+	}
+	r.lastSweep = now
+
+	for hash, key := range r.keys {
+		if now.Sub(key.windowStart) >= 2*r.window {
+			delete(r.keys, hash)
+		}
+	}
+}
+
+// rateLimitSummaryInterval is the period of the summary records
+// logged by RateLimitedLogger
+const rateLimitSummaryInterval = 10 * time.Second
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	level      Severity
+	suppressed int
+}
+
+// RateLimitedLogger wraps a Logger and limits records per key
+// with a token bucket. Keys are provided by the caller, so the formatted
+// messages are not hashed. Every 10 seconds it logs a summary record
+// for each key, which records have been suppressed.
+// It is safe for concurrent use.
+type RateLimitedLogger struct {
+	logger    Logger
+	perSecond float64
+	burst     float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// now is replaced in tests
+	now func() time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRateLimitedLogger creates a RateLimitedLogger, which allows
+// perSecond records per key and bursts of the same size (at least one).
+// Close stops the summary records, the wrapped logger stays open.
+func NewRateLimitedLogger(l Logger, perSecond float64) *RateLimitedLogger {
+	r := newRateLimitedLogger(l, perSecond)
+	go r.summaryLoop(rateLimitSummaryInterval)
+	return r
+}
+
+func newRateLimitedLogger(l Logger, perSecond float64) *RateLimitedLogger {
+	burst := perSecond
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimitedLogger{
+		logger:    l,
+		perSecond: perSecond,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		now:       time.Now,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Errf logs with ErrorLevel unless the records of the key are suppressed
+func (r *RateLimitedLogger) Errf(key string, format string, args ...interface{}) {
+	if r.enabled(ErrorLevel, key) {
+		r.logger.log(ErrorLevel, defaultFields, format, args...)
+	}
+}
+
+// Warnf logs with WarnLevel unless the records of the key are suppressed
+func (r *RateLimitedLogger) Warnf(key string, format string, args ...interface{}) {
+	if r.enabled(WarnLevel, key) {
+		r.logger.log(WarnLevel, defaultFields, format, args...)
+	}
+}
+
+// Infof logs with InfoLevel unless the records of the key are suppressed
+func (r *RateLimitedLogger) Infof(key string, format string, args ...interface{}) {
+	if r.enabled(InfoLevel, key) {
+		r.logger.log(InfoLevel, defaultFields, format, args...)
+	}
+}
+
+// Debugf logs with DebugLevel unless the records of the key are suppressed
+func (r *RateLimitedLogger) Debugf(key string, format string, args ...interface{}) {
+	if r.enabled(DebugLevel, key) {
+		r.logger.log(DebugLevel, defaultFields, format, args...)
+	}
+}
+
+// Close stops the summary records
+func (r *RateLimitedLogger) Close() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.summarize()
+	})
+}
+
+// enabled reports whether the record must be logged. The methods call
+// the wrapped logger themselves, so its caller reporting (SetReportCaller)
+// sees the same number of frames as for Logger.Errf and the like.
+func (r *RateLimitedLogger) enabled(level Severity, key string) bool {
+	// records filtered by the verbosity don't consume tokens
+	return r.logger.V(level) && r.allow(level, key)
+}
+
+func (r *RateLimitedLogger) allow(level Severity, key string) bool {
+	now := r.now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, lastRefill: now}
+		r.buckets[key] = b
+	}
+	b.refill(now, r.perSecond, r.burst)
+
+	if b.tokens < 1 {
+		b.suppressed++
+		b.level = level
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time, perSecond, burst float64) {
+	if elapsed := now.Sub(b.lastRefill); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * perSecond
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.lastRefill = now
+	}
+}
+
+func (r *RateLimitedLogger) summaryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.summarize()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+type rateLimitSummary struct {
+	key        string
+	level      Severity
+	suppressed int
+}
+
+// summarize logs the number of suppressed records per key and forgets
+// the keys, which buckets are full, so the map does not grow infinitely
+func (r *RateLimitedLogger) summarize() {
+	now := r.now()
+
+	var summaries []rateLimitSummary
+	r.mu.Lock()
+	for key, b := range r.buckets {
+		if b.suppressed > 0 {
+			summaries = append(summaries, rateLimitSummary{key, b.level, b.suppressed})
+			b.suppressed = 0
+			continue
+		}
+
+		b.refill(now, r.perSecond, r.burst)
+		if b.tokens >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+	r.mu.Unlock()
+
+	// the records are logged without the lock,
+	// as the wrapped logger might block
+	for _, s := range summaries {
+		r.logger.log(s.level, Fields{"key": s.key, "suppressed": s.suppressed},
+			"suppressed %d similar messages in the last %s", s.suppressed, rateLimitSummaryInterval)
+	}
+}
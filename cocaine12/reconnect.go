@@ -0,0 +1,192 @@
+package cocaine12
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// the calls waiting for resubmission are resolved
+// and connected again within the timeout
+const serviceReconnectTimeout = 5 * time.Second
+
+// serviceReconnectBackoff is the delay between failed reconnections
+var serviceReconnectBackoff = RetryPolicy{
+	BaseDelay: 100 * time.Millisecond,
+	MaxDelay:  10 * time.Second,
+}
+
+// ErrReconnectAttemptsExceeded is returned by Service.Call once
+// the service has failed to reconnect the number of times set by
+// WithMaxReconnectAttempts
+var ErrReconnectAttemptsExceeded = errors.New("service reconnection attempts are exceeded")
+
+// WithMaxReconnectAttempts limits the number of consecutive failed
+// reconnections. Once it's reached, calls fail with
+// ErrReconnectAttemptsExceeded without connecting, until Reconnect
+// is forced. Zero means no limit, which is the default.
+func WithMaxReconnectAttempts(attempts int) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.maxReconnectAttempts = attempts
+	}
+}
+
+// WithRetryOnReconnect makes the calls in flight be sent again once
+// the lost connection is restored, instead of failing them with
+// ErrDisconnected. Only the calls, which have neither got a reply nor
+// sent anything after the first message, are resubmitted. The service
+// reconnects in background while there are such calls. It's disabled
+// by default, enable it only if the methods are idempotent.
+func WithRetryOnReconnect(enable bool) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.retryOnReconnect = enable
+	}
+}
+
+// OnReconnect sets the function called with the remote address
+// of the new connection after every reconnection. It's called
+// from a separate goroutine.
+func (service *Service) OnReconnect(fn func(endpoint string)) {
+	service.mutex.Lock()
+	service.onReconnect = fn
+	service.mutex.Unlock()
+}
+
+// setWriteErrorHandler sets the function called with the errors, which
+// close the connection while sending. It's called from a separate goroutine.
+func (service *Service) setWriteErrorHandler(fn func(err error)) {
+	service.mutex.Lock()
+	service.onWriteError = fn
+	service.mutex.Unlock()
+}
+
+// stopped reports if the service has been closed by the user
+func (service *Service) stopped() bool {
+	select {
+	case <-service.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconnectAllowedLocked fails fast while the service backs off
+// after a failed reconnection
+func (service *Service) reconnectAllowedLocked() error {
+	if max := service.opts.maxReconnectAttempts; max > 0 && service.reconnectFailures >= max {
+		return ErrReconnectAttemptsExceeded
+	}
+
+	if service.reconnectErr != nil && time.Now().Before(service.nextReconnect) {
+		return service.reconnectErr
+	}
+
+	return nil
+}
+
+// reconnectFailedLocked backs off the next reconnection. Forced
+// reconnections don't count, as the old connection is kept.
+func (service *Service) reconnectFailedLocked(force bool, err error) error {
+	if force {
+		return err
+	}
+
+	service.reconnectFailures++
+	service.reconnectErr = err
+	service.nextReconnect = time.Now().Add(serviceReconnectBackoff.delay(service.reconnectFailures))
+
+	if max := service.opts.maxReconnectAttempts; max > 0 && service.reconnectFailures >= max {
+		// nobody is going to answer the kept calls
+		service.failSessions(false)
+	}
+	return err
+}
+
+func (service *Service) reconnectedLocked(sock socketIO) {
+	service.reconnectFailures = 0
+	service.reconnectErr = nil
+
+	if service.opts.retryOnReconnect {
+		service.resubmitLocked()
+	}
+
+	if fn := service.onReconnect; fn != nil {
+		go fn(remoteEndpoint(sock))
+	}
+}
+
+type sessionIDs []uint64
+
+func (s sessionIDs) Len() int           { return len(s) }
+func (s sessionIDs) Less(i, j int) bool { return s[i] < s[j] }
+func (s sessionIDs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// resubmitLocked sends the kept calls over the new connection.
+// They are sent in the order of the sessions, as the sessions
+// must be opened in the monotonic order.
+func (service *Service) resubmitLocked() {
+	keys := sessionIDs(service.sessions.Keys())
+	sort.Sort(keys)
+
+	for _, key := range keys {
+		ch, ok := service.sessions.Get(key)
+		if !ok {
+			continue
+		}
+
+		if !resubmittable(ch) {
+			// something has been sent to the lost connection meanwhile
+			service.failSession(key, ch)
+			continue
+		}
+
+		c := ch.(*channel)
+		c.tx.mu.Lock()
+		msg := c.tx.call
+		c.tx.mu.Unlock()
+
+		service.markActive()
+		service.socketIO.Send(msg)
+	}
+}
+
+// reconnectPending reconnects the service in background
+// while there are calls waiting for resubmission
+func (service *Service) reconnectPending() {
+	for {
+		service.mutex.Lock()
+		if service.stopped() {
+			service.failSessions(false)
+			service.mutex.Unlock()
+			return
+		}
+		if service.sessions.Len() == 0 {
+			service.mutex.Unlock()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), serviceReconnectTimeout)
+		err := service.reconnectLocked(ctx, false)
+		cancel()
+		wait := service.nextReconnect.Sub(time.Now())
+		service.mutex.Unlock()
+
+		if err == nil || err == ErrReconnectAttemptsExceeded {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// remoteEndpoint returns the address of the connected service
+func remoteEndpoint(sock socketIO) string {
+	if s, ok := sock.(*asyncRWSocket); ok {
+		if conn, ok := s.conn.(net.Conn); ok {
+			return conn.RemoteAddr().String()
+		}
+	}
+	return ""
+}
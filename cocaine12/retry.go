@@ -0,0 +1,112 @@
+package cocaine12
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RetryPolicy configures Service.CallRetry
+type RetryPolicy struct {
+	// MaxAttempts is the number of calls including the first one.
+	// Zero means a single call.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles
+	// with every retry, the actual delay is chosen randomly
+	// between the half and the whole of it.
+	BaseDelay time.Duration
+	// MaxDelay limits the delay. Zero means no limit.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy makes 3 attempts starting with 100ms delay
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    time.Second,
+}
+
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half+1))
+	}
+	return d
+}
+
+// CallRetry calls a remote method and waits for the first result.
+// The call is repeated in a new session according to the policy
+// if the connection fails. Error replies of the service are returned
+// as the result without retries, just like Channel.Get does.
+// The method must be idempotent, as it might have been called before
+// the connection failed. The cancellation of ctx stops retries at once.
+func (service *Service) CallRetry(ctx context.Context, policy RetryPolicy, name string, args ...interface{}) (ServiceResult, error) {
+	service.mutex.RLock()
+	_, err := service.API.MethodByName(name)
+	service.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		res, err := service.callOnce(ctx, name, args...)
+		failure := err
+		if failure == nil && res != nil {
+			failure = res.Err()
+		}
+
+		if failure == nil || ctx.Err() != nil || !isTransportError(failure) ||
+			attempt >= policy.MaxAttempts {
+			return res, err
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (service *Service) callOnce(ctx context.Context, name string, args ...interface{}) (ServiceResult, error) {
+	ch, err := service.Call(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ch.Get(ctx)
+	if c, ok := ch.(*channel); ok && err == nil {
+		// the rest of a stream is not read
+		c.rx.stop()
+	}
+	return res, err
+}
+
+// isTransportError reports if the call has failed because
+// of the connection rather than the service. Only the lost connection
+// and the failures to resolve or to connect the service are retried.
+func isTransportError(err error) bool {
+	switch err := err.(type) {
+	case *ServiceError:
+		return err.Code == ErrDisconnected
+	case net.Error:
+		return true
+	}
+
+	return false
+}
@@ -1,8 +1,11 @@
 package cocaine12
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -12,6 +15,13 @@ const (
 	ErrDisconnected = -100
 )
 
+// ErrTimeout is returned by CallWithTimeout if the result
+// has not been received in time
+var ErrTimeout = errors.New("service call timed out")
+
+// ErrServiceClosing is returned by Call after CloseGracefully is called
+var ErrServiceClosing = errors.New("service is closing")
+
 type ServiceInfo struct {
 	Endpoints []EndpointItem
 	Version   uint64
@@ -35,6 +45,7 @@ type serviceRes struct {
 
 //Unpacks the result of the called method in the passed structure.
 //You can transfer the structure of a particular type that will avoid the type checking. Look at examples.
+//Msgpack extension types are decoded by the decoders registered with RegisterExtension.
 func (s *serviceRes) Extract(target interface{}) (err error) {
 	if s.err != nil {
 		return s.err
@@ -98,12 +109,63 @@ type Service struct {
 	name string
 
 	epoch uint
+	// closing is set by CloseGracefully to reject new calls
+	closing bool
+
+	stats serviceStats
+
+	opts serviceOptions
+	// lastActive is the time of the last message in nanoseconds,
+	// it's tracked if the idle timeout is set
+	lastActive int64
+
+	// the state of reconnection. After a failed attempt calls fail
+	// with reconnectErr until nextReconnect.
+	reconnectFailures int
+	nextReconnect     time.Time
+	reconnectErr      error
+	onReconnect       func(endpoint string)
+	// onWriteError is called with the error, which has closed
+	// the connection while sending
+	onWriteError func(err error)
+
+	// resolve and dial are replaced in tests, nil means the locator
+	// and TCP connections
+	resolve func(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error)
+	dial    func(endpoints []EndpointItem) (socketIO, error)
+}
+
+// ServiceStats contains the counters of the calls of a Service
+type ServiceStats struct {
+	// Outstanding is the number of calls, which results have not been read yet
+	Outstanding int
+	// Calls is the total number of calls
+	Calls uint64
+	// Completed is the number of finished calls including failed ones
+	Completed uint64
+	// Errors is the number of calls finished with an error,
+	// lost with the connection or cancelled by the caller before
+	// a successful result
+	Errors uint64
+}
+
+type serviceStats struct {
+	calls     uint64
+	completed uint64
+	errors    uint64
+}
+
+func (s *serviceStats) finished(err error) {
+	atomic.AddUint64(&s.completed, 1)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
 }
 
 //Creates new service instance with specifed name.
 //Optional parameter is a network endpoint of the locator (default ":10053"). Look at Locator.
-func serviceResolve(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error) {
-	l, err := NewLocator(endpoints)
+func serviceResolve(ctx context.Context, name string, endpoints []string, tlsConfig *tls.Config) (*ServiceInfo, error) {
+	l, err := newLocator(endpoints, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -112,10 +174,10 @@ func serviceResolve(ctx context.Context, name string, endpoints []string) (*Serv
 	return l.Resolve(ctx, name)
 }
 
-func serviceCreateIO(endpoints []EndpointItem) (sock socketIO, err error) {
+func serviceCreateIO(endpoints []EndpointItem, opts serviceOptions) (sock socketIO, err error) {
 CONN_LOOP:
 	for _, endpoint := range endpoints {
-		sock, err = newAsyncConnection("tcp", endpoint.String(), time.Second*1)
+		sock, err = newAsyncConnection("tcp", endpoint.String(), time.Second*1, opts.keepAlive, opts.tlsConfig)
 		if err != nil {
 			continue
 		}
@@ -126,18 +188,31 @@ CONN_LOOP:
 	return
 }
 
-func NewService(ctx context.Context, name string, endpoints []string) (s *Service, err error) {
-	info, err := serviceResolve(ctx, name, endpoints)
+// NewService resolves the service through the locator and connects to it.
+// The connection is configured by the options, see WithKeepAlive,
+// WithIdleTimeout, WithMaxReconnectAttempts, WithRetryOnReconnect and WithTLS.
+// A lost connection is restored by the next call.
+func NewService(ctx context.Context, name string, endpoints []string, options ...ServiceOption) (s *Service, err error) {
+	var opts serviceOptions
+	for _, option := range options {
+		option(&opts)
+	}
+
+	info, err := serviceResolve(ctx, name, endpoints, opts.tlsConfig)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to resolve service %s: %v", name, err)
 	}
 
-	sock, err := serviceCreateIO(info.Endpoints)
+	sock, err := serviceCreateIO(info.Endpoints, opts)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to connect to service %s: %s", name, err)
 	}
 
-	s = &Service{
+	return newService(name, endpoints, info, sock, opts), nil
+}
+
+func newService(name string, endpoints []string, info *ServiceInfo, sock socketIO, opts serviceOptions) *Service {
+	s := &Service{
 		socketIO:    sock,
 		ServiceInfo: info,
 		sessions:    newSessions(),
@@ -145,15 +220,23 @@ func NewService(ctx context.Context, name string, endpoints []string) (s *Servic
 		args:        endpoints,
 		name:        name,
 		epoch:       0,
+		opts:        opts,
 	}
-	go s.loop()
-	return s, nil
-}
+	go s.serve(s.socketIO, s.epoch)
 
-func (service *Service) loop() {
-	epoch := service.epoch
+	if opts.idleTimeout > 0 {
+		s.markActive()
+		go s.watchIdle()
+	}
+	return s
+}
 
-	for data := range service.socketIO.Read() {
+// serve dispatches the messages of the connection. The connection
+// and the epoch are passed by the caller, as a reconnection replaces
+// them while the old connection is being drained.
+func (service *Service) serve(sock socketIO, epoch uint) {
+	for data := range sock.Read() {
+		service.markActive()
 		if rx, ok := service.sessions.Get(data.Session); ok {
 			rx.push(&serviceRes{
 				payload: data.Payload,
@@ -164,8 +247,16 @@ func (service *Service) loop() {
 
 	service.mutex.Lock()
 	defer service.mutex.Unlock()
+	if fn := service.onWriteError; fn != nil {
+		if err := socketWriteError(sock); err != nil {
+			go fn(err)
+		}
+	}
 	if epoch == service.epoch {
 		service.pushDisconnectedError()
+		if service.opts.retryOnReconnect && !service.stopped() {
+			go service.reconnectPending()
+		}
 	}
 }
 
@@ -173,22 +264,59 @@ func (service *Service) Reconnect(ctx context.Context, force bool) error {
 	service.mutex.Lock()
 	defer service.mutex.Unlock()
 
+	return service.reconnectLocked(ctx, force)
+}
+
+func (service *Service) reconnectLocked(ctx context.Context, force bool) error {
 	if !force && !service.disconnected() {
 		return nil
 	}
 
+	if !force {
+		if err := service.reconnectAllowedLocked(); err != nil {
+			return err
+		}
+	}
+
 	service.pushDisconnectedError()
 
-	// Create new socket
-	info, err := serviceResolve(ctx, service.name, service.args)
+	info, sock, err := service.connect(ctx)
 	if err != nil {
-		return err
+		return service.reconnectFailedLocked(force, err)
 	}
-	sock, err := serviceCreateIO(info.Endpoints)
+
+	service.replaceConnectionLocked(info, sock)
+	return nil
+}
+
+// connect creates new socket. The service is resolved again,
+// as it might have moved to other endpoints.
+func (service *Service) connect(ctx context.Context) (*ServiceInfo, socketIO, error) {
+	resolve, dial := service.resolve, service.dial
+	if resolve == nil {
+		resolve = func(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error) {
+			return serviceResolve(ctx, name, endpoints, service.opts.tlsConfig)
+		}
+	}
+	if dial == nil {
+		dial = func(endpoints []EndpointItem) (socketIO, error) {
+			return serviceCreateIO(endpoints, service.opts)
+		}
+	}
+
+	info, err := resolve(ctx, service.name, service.args)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	sock, err := dial(info.Endpoints)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return info, sock, nil
+}
 
+func (service *Service) replaceConnectionLocked(info *ServiceInfo, sock socketIO) {
 	// Dispose old IO interface
 	service.close()
 
@@ -196,34 +324,74 @@ func (service *Service) Reconnect(ctx context.Context, force bool) error {
 	service.stop = make(chan struct{})
 	service.epoch++
 	service.socketIO = sock
+	service.ServiceInfo = info
+	service.markActive()
 	// Start service loop
-	go service.loop()
-	return nil
+	go service.serve(sock, service.epoch)
+	service.reconnectedLocked(sock)
 }
 
+// pushDisconnectedError fails the calls in flight. The calls, which are
+// able to be resubmitted on reconnect, are kept if it's enabled.
 func (service *Service) pushDisconnectedError() {
+	service.failSessions(service.opts.retryOnReconnect && !service.stopped())
+}
+
+func (service *Service) failSessions(keepResubmittable bool) {
 	for _, key := range service.sessions.Keys() {
-		service.sessions.RLock()
-		if ch, ok := service.sessions.Get(key); ok {
-			ch.push(&serviceRes{
-				payload: nil,
-				method:  1,
-				err:     &ServiceError{ErrDisconnected, "Disconnected"}})
+		ch, ok := service.sessions.Get(key)
+		if !ok {
+			continue
+		}
+		if keepResubmittable && resubmittable(ch) {
+			continue
 		}
-		service.sessions.RUnlock()
-		service.sessions.Detach(key)
+		service.failSession(key, ch)
 	}
 }
 
+// failSession fails the call with ErrDisconnected and closes its session.
+// Nothing is sent to the remote side, as the session is gone with
+// the connection.
+func (service *Service) failSession(key uint64, ch Channel) {
+	err := &ServiceError{ErrDisconnected, "Disconnected"}
+
+	service.sessions.RLock()
+	ch.push(&serviceRes{
+		payload: nil,
+		method:  1,
+		err:     err})
+	service.sessions.RUnlock()
+
+	if c, ok := ch.(*channel); ok && c.rx.detach != nil {
+		c.tx.finish()
+		c.rx.detach(err, "disconnected")
+		return
+	}
+	service.sessions.Detach(key)
+}
+
 func (service *Service) call(ctx context.Context, name string, args ...interface{}) (Channel, error) {
 	service.mutex.RLock()
 	defer service.mutex.RUnlock()
 
+	if service.closing {
+		return nil, ErrServiceClosing
+	}
+
 	methodNum, err := service.API.MethodByName(name)
 	if err != nil {
 		return nil, err
 	}
 
+	// TraceInfo of the new span is passed to the remote side,
+	// so it's able to continue the trace
+	ctx, finishSpan := WithTraceFinish(ctx, service.name+"."+name)
+	headers := CocaineHeaders{}
+	if traceInfo := getTraceInfo(ctx); traceInfo != nil {
+		headers = traceInfoToHeaders(*traceInfo)
+	}
+
 	ch := channel{
 		rx: rx{
 			pushBuffer: make(chan ServiceResult, 1),
@@ -244,12 +412,52 @@ func (service *Service) call(ctx context.Context, name string, args ...interface
 	defer service.muKeepSessionOrder.Unlock()
 
 	ch.tx.id = service.sessions.Attach(&ch)
+	id := ch.tx.id
+	var (
+		detachOnce sync.Once
+		finished   = make(chan struct{})
+	)
+	detach := func(err error, status string) (detached bool) {
+		detachOnce.Do(func() {
+			close(finished)
+			service.sessions.Detach(id)
+			service.stats.finished(err)
+			finishSpan(err, nil, "%s", status)
+			detached = true
+		})
+		return detached
+	}
+	ch.rx.detach = detach
+	ch.rx.cancelTx = ch.tx.cancel
+	atomic.AddUint64(&service.stats.calls, 1)
+
+	// the session is closed once the context of the call is done,
+	// even if nobody waits for the result
+	if ctx.Done() != nil {
+		ch.rx.cancelled = make(chan struct{})
+		ch.rx.callCtx = ctx
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-finished:
+				return
+			}
+
+			if detach(ch.rx.cancellationError(ctx.Err()), "cancelled") {
+				ch.tx.cancel(ctx.Err())
+				close(ch.rx.cancelled)
+			}
+		}()
+	}
 
 	msg := &Message{
 		CommonMessageInfo: CommonMessageInfo{ch.tx.id, methodNum},
 		Payload:           args,
-		Headers:           []interface{}{},
+		Headers:           headers,
 	}
+	ch.tx.mu.Lock()
+	ch.tx.call = msg
+	ch.tx.mu.Unlock()
 
 	service.sendMsg(msg)
 	return &ch, nil
@@ -266,16 +474,24 @@ func (service *Service) disconnected() bool {
 
 func (service *Service) sendMsg(msg *Message) {
 	service.mutex.RLock()
+	service.markActive()
 	service.socketIO.Send(msg)
 	service.mutex.RUnlock()
 }
 
-//Calls a remote method by name and pass args
+//Calls a remote method by name and pass args.
+// Once ctx is done, the session is closed, the waiters of the Channel
+// get the error of ctx and the remote side is sent an error,
+// if the protocol of the stream allows it.
 func (service *Service) Call(ctx context.Context, name string, args ...interface{}) (Channel, error) {
 	service.mutex.RLock()
-	disconnected := service.disconnected()
+	disconnected, closing := service.disconnected(), service.closing
 	service.mutex.RUnlock()
 
+	if closing {
+		return nil, ErrServiceClosing
+	}
+
 	if disconnected {
 		if err := service.Reconnect(ctx, false); err != nil {
 			return nil, err
@@ -285,6 +501,32 @@ func (service *Service) Call(ctx context.Context, name string, args ...interface
 	return service.call(ctx, name, args...)
 }
 
+// CallWithTimeout calls a remote method and waits for the first result
+// no longer than timeout. On timeout the session is closed and ErrTimeout
+// is returned. The cancellation of ctx is returned as is.
+// The rest of a stream is not read, its session is closed after
+// the first result.
+func (service *Service) CallWithTimeout(ctx context.Context, timeout time.Duration, name string, args ...interface{}) (ServiceResult, error) {
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ch, err := service.Call(callCtx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ch.Get(callCtx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, ErrTimeout
+	}
+	if c, ok := ch.(*channel); ok && err == nil {
+		// the session is closed before cancel, which would count
+		// the call as a cancelled one
+		c.rx.stop()
+	}
+	return res, err
+}
+
 // Disposes resources of a service. You must call this method if the service isn't used anymore.
 func (service *Service) Close() {
 	service.mutex.RLock()
@@ -294,6 +536,44 @@ func (service *Service) Close() {
 	service.mutex.RUnlock()
 }
 
+// Stats returns the counters of the calls
+func (service *Service) Stats() ServiceStats {
+	return ServiceStats{
+		Outstanding: service.sessions.Len(),
+		Calls:       atomic.LoadUint64(&service.stats.calls),
+		Completed:   atomic.LoadUint64(&service.stats.completed),
+		Errors:      atomic.LoadUint64(&service.stats.errors),
+	}
+}
+
+// PendingCalls returns the number of calls, which results
+// have not been read yet
+func (service *Service) PendingCalls() int {
+	return service.sessions.Len()
+}
+
+// CloseGracefully rejects new calls with ErrServiceClosing, waits for
+// the results of the pending calls to be read (or the calls to be cancelled)
+// and closes the service. If ctx expires first, the service is closed
+// anyway and the error of ctx is returned.
+func (service *Service) CloseGracefully(ctx context.Context) error {
+	// sessions are attached under the read lock,
+	// so no session is being opened after the write lock is released
+	service.mutex.Lock()
+	service.closing = true
+	service.mutex.Unlock()
+
+	var err error
+	select {
+	case <-service.sessions.Idle():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	service.Close()
+	return err
+}
+
 func (service *Service) close() {
 	close(service.stop)
 	service.socketIO.Close()
@@ -1,7 +1,9 @@
 package cocaine12
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -11,6 +13,655 @@ import (
 	"golang.org/x/net/context"
 )
 
+// newTestService creates a Service connected to a pipe.
+// The other side of the pipe is returned to play a role of the remote service.
+func newTestService(name string, info *ServiceInfo) (*Service, *asyncRWSocket) {
+	return newTestServiceWithOptions(name, info, serviceOptions{})
+}
+
+func newTestServiceWithOptions(name string, info *ServiceInfo, opts serviceOptions) (*Service, *asyncRWSocket) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	peer, _ := newAsyncRW(in)
+
+	s := &Service{
+		socketIO:    sock,
+		ServiceInfo: info,
+		sessions:    newSessions(),
+		stop:        make(chan struct{}),
+		name:        name,
+		opts:        opts,
+	}
+	go s.serve(s.socketIO, s.epoch)
+
+	return s, peer
+}
+
+// testDialer connects the service to new pipes,
+// the other sides of them are sent to peers
+type testDialer struct {
+	dials int32
+	err   error
+	mu    sync.Mutex
+	peers chan *asyncRWSocket
+}
+
+func newTestDialer() *testDialer {
+	return &testDialer{peers: make(chan *asyncRWSocket, 10)}
+}
+
+func (d *testDialer) setError(err error) {
+	d.mu.Lock()
+	d.err = err
+	d.mu.Unlock()
+}
+
+func (d *testDialer) attach(s *Service) {
+	s.resolve = func(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error) {
+		return s.ServiceInfo, nil
+	}
+	s.dial = func(endpoints []EndpointItem) (socketIO, error) {
+		atomic.AddInt32(&d.dials, 1)
+		d.mu.Lock()
+		err := d.err
+		d.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		in, out := testConn()
+		sock, _ := newAsyncRW(out)
+		peer, _ := newAsyncRW(in)
+		d.peers <- peer
+		return sock, nil
+	}
+}
+
+func TestServiceCallPropagatesTrace(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1000, 2000, 0))
+	ch, err := s.Call(ctx, "resolve", "echo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	msg := <-peer.Read()
+	traceInfo, err := msg.Headers.getTraceData()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), traceInfo.trace)
+	assert.Equal(t, uint64(2000), traceInfo.parent)
+	assert.NotEqual(t, uint64(2000), traceInfo.span)
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+	}
+	_, err = ch.Get(ctx)
+	assert.NoError(t, err)
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "locator.resolve", records[1].fields["RPC"])
+		assert.Equal(t, fmt.Sprintf("%x", traceInfo.span), records[1].fields["span_id"])
+	}
+}
+
+func TestServiceCallCancel(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(AttachTraceInfo(nil, NewTraceInfo(1000, 2000, 0)))
+	ch, err := s.Call(ctx, "resolve", "echo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := <-peer.Read()
+	assert.Equal(t, 1, len(s.sessions.Keys()))
+
+	go cancel()
+	_, err = ch.Get(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, len(s.sessions.Keys()))
+
+	_, err = ch.Get(context.Background())
+	assert.Equal(t, ErrStreamIsClosed, err)
+
+	// the late answer is ignored
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+	}
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "cancelled", records[1].msg)
+		assert.Equal(t, context.Canceled.Error(), records[1].fields["error"])
+	}
+}
+
+func TestServiceCallCancelWithoutGet(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	s, peer := newTestService("app", newStreamingServiceInfo())
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(AttachTraceInfo(nil, NewTraceInfo(1000, 2000, 0)))
+	_, err := s.Call(ctx, "enqueue", "event")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	<-peer.Read()
+
+	// nobody reads the stream, the span is closed anyway
+	cancel()
+	<-peer.Read()
+	for i := 0; i < 100 && s.PendingCalls() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "cancelled", records[1].msg)
+		assert.Equal(t, context.Canceled.Error(), records[1].fields["error"])
+	}
+}
+
+func TestServiceCallDisconnect(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	s, peer := newTestService("app", newStreamingServiceInfo())
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(AttachTraceInfo(nil, NewTraceInfo(1000, 2000, 0)), 50*time.Millisecond)
+	defer cancel()
+	ch, err := s.Call(ctx, "enqueue", "event")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	<-peer.Read()
+
+	peer.Close()
+	<-s.IsClosed()
+	for i := 0; i < 100 && s.PendingCalls() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, ServiceStats{Calls: 1, Completed: 1, Errors: 1}, s.Stats())
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "disconnected", records[1].msg)
+	}
+
+	// the deadline of the failed call changes nothing
+	<-ctx.Done()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, ServiceStats{Calls: 1, Completed: 1, Errors: 1}, s.Stats())
+	assert.Equal(t, 2, len(logger.Records()))
+
+	_, err = ch.Get(context.Background())
+	if assert.IsType(t, &ServiceError{}, err) {
+		assert.Equal(t, ErrDisconnected, err.(*ServiceError).Code)
+	}
+}
+
+func newStreamingServiceInfo() *ServiceInfo {
+	stream := &streamDescription{
+		0: &StreamDescriptionItem{Name: "write", Description: recursiveDescription},
+		1: &StreamDescriptionItem{Name: "error", Description: emptyDescription},
+		2: &StreamDescriptionItem{Name: "close", Description: emptyDescription},
+	}
+
+	return &ServiceInfo{
+		API: dispatchMap{
+			0: dispatchItem{
+				Name:       "enqueue",
+				Downstream: stream,
+				Upstream:   stream,
+			},
+		},
+	}
+}
+
+func TestServiceCallContextCancel(t *testing.T) {
+	s, peer := newTestService("app", newStreamingServiceInfo())
+	defer s.Close()
+
+	reply := func(session, method uint64, payload ...interface{}) {
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{session, method},
+			Payload:           payload,
+		}
+	}
+
+	// before the first chunk the waiter is unblocked
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := s.Call(ctx, "enqueue", "event")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := <-peer.Read()
+	go cancel()
+	_, err = ch.Get(context.Background())
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, s.PendingCalls())
+
+	// the remote side is notified
+	cancelled := <-peer.Read()
+	assert.Equal(t, msg.Session, cancelled.Session)
+	assert.Equal(t, uint64(1), cancelled.MsgType)
+	assert.Equal(t, context.Canceled.Error(), fmt.Sprintf("%s", cancelled.Payload[1]))
+
+	// between chunks the pending chunks are dropped
+	ctx, cancel = context.WithCancel(context.Background())
+	ch, _ = s.Call(ctx, "enqueue", "event")
+	msg = <-peer.Read()
+	reply(msg.Session, 0, "A")
+	res, err := ch.Get(context.Background())
+	assert.NoError(t, err)
+	var chunk string
+	assert.NoError(t, res.ExtractTuple(&chunk))
+	assert.Equal(t, "A", chunk)
+
+	reply(msg.Session, 0, "B")
+	cancel()
+	cancelled = <-peer.Read()
+	assert.Equal(t, msg.Session, cancelled.Session)
+	_, err = ch.Get(context.Background())
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, s.PendingCalls())
+
+	// after close the cancellation is ignored
+	ctx, cancel = context.WithCancel(context.Background())
+	ch, _ = s.Call(ctx, "enqueue", "event")
+	msg = <-peer.Read()
+	reply(msg.Session, 2)
+	_, err = ch.Get(context.Background())
+	assert.NoError(t, err)
+	stats := s.Stats()
+	cancel()
+
+	select {
+	case msg = <-peer.Read():
+		t.Fatalf("the closed session is cancelled: %v", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, stats, s.Stats())
+	_, err = ch.Get(context.Background())
+	assert.Equal(t, ErrStreamIsClosed, err)
+}
+
+func TestServiceCallWithTimeout(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	_, err := s.CallWithTimeout(context.Background(), 10*time.Millisecond, "resolve", "echo")
+	assert.Equal(t, ErrTimeout, err)
+	assert.Equal(t, 0, len(s.sessions.Keys()))
+	<-peer.Read()
+
+	go func() {
+		msg := <-peer.Read()
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+		}
+	}()
+	res, err := s.CallWithTimeout(context.Background(), time.Second, "resolve", "echo")
+	assert.NoError(t, err)
+	assert.NoError(t, res.Err())
+}
+
+func TestServiceCallWithTimeoutStream(t *testing.T) {
+	s, peer := newTestService("app", newStreamingServiceInfo())
+	defer s.Close()
+
+	go func() {
+		msg := <-peer.Read()
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{"A"},
+		}
+	}()
+	res, err := s.CallWithTimeout(context.Background(), time.Second, "enqueue", "event")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var chunk string
+	assert.NoError(t, res.ExtractTuple(&chunk))
+	assert.Equal(t, "A", chunk)
+
+	// the open stream is closed as a successful call,
+	// the cancellation of its context changes nothing
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, ServiceStats{Calls: 1, Completed: 1}, s.Stats())
+}
+
+func TestServiceCallRetry(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	disconnect := func() {
+		<-peer.Read()
+		s.mutex.Lock()
+		s.pushDisconnectedError()
+		s.mutex.Unlock()
+	}
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	// the error reply is not retried
+	go func() {
+		disconnect()
+		msg := <-peer.Read()
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 1},
+			Payload:           []interface{}{[]interface{}{1, 2}, "failure"},
+		}
+	}()
+	res, err := s.CallRetry(context.Background(), policy, "resolve", "echo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ErrRequest{Message: "failure", Category: 1, Code: 2}, res.Err())
+	}
+	assert.Equal(t, uint64(2), s.Stats().Calls)
+
+	// the attempts are exhausted
+	go func() {
+		for i := 0; i < 3; i++ {
+			disconnect()
+		}
+	}()
+	_, err = s.CallRetry(context.Background(), policy, "resolve", "echo")
+	if assert.IsType(t, &ServiceError{}, err) {
+		assert.Equal(t, ErrDisconnected, err.(*ServiceError).Code)
+	}
+	assert.Equal(t, uint64(5), s.Stats().Calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.CallRetry(ctx, policy, "resolve", "echo")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, uint64(5), s.Stats().Calls)
+
+	_, err = s.CallRetry(context.Background(), policy, "unknown")
+	assert.Error(t, err)
+}
+
+func TestServiceCallRetryStream(t *testing.T) {
+	s, peer := newTestService("app", newStreamingServiceInfo())
+	defer s.Close()
+
+	go func() {
+		msg := <-peer.Read()
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{"A"},
+		}
+	}()
+	res, err := s.CallRetry(context.Background(), DefaultRetryPolicy, "enqueue", "event")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var chunk string
+	assert.NoError(t, res.ExtractTuple(&chunk))
+	assert.Equal(t, "A", chunk)
+
+	// the session of the stream is closed after the first result
+	assert.Equal(t, 0, s.PendingCalls())
+	stopped := <-peer.Read()
+	assert.Equal(t, uint64(1), stopped.MsgType)
+}
+
+func TestIsTransportError(t *testing.T) {
+	assert.True(t, isTransportError(&ServiceError{Code: ErrDisconnected}))
+	assert.True(t, isTransportError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+
+	assert.False(t, isTransportError(&ErrRequest{Message: "failure"}))
+	assert.False(t, isTransportError(ErrServiceClosing))
+	assert.False(t, isTransportError(ErrReconnectAttemptsExceeded))
+	assert.False(t, isTransportError(errors.New("Unknown method")))
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := policy.delay(i + 1)
+		assert.True(t, d >= max/2 && d <= max, "retry %d: %s", i+1, d)
+	}
+}
+
+func TestChannelRange(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	reply := func(session, method uint64, payload ...interface{}) {
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{session, method},
+			Payload:           payload,
+		}
+	}
+
+	ch, err := s.Call(context.Background(), "connect", "app")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := <-peer.Read()
+	reply(msg.Session, 0, "A")
+	reply(msg.Session, 0, "B")
+	reply(msg.Session, 2)
+
+	var chunks []string
+	err = ch.Range(context.Background(), func(res ServiceResult) bool {
+		var chunk string
+		assert.NoError(t, res.ExtractTuple(&chunk))
+		chunks = append(chunks, chunk)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"A", "B"}, chunks)
+	assert.Equal(t, 0, s.PendingCalls())
+
+	// the error reply
+	ch, _ = s.Call(context.Background(), "connect", "app")
+	msg = <-peer.Read()
+	reply(msg.Session, 0, "A")
+	reply(msg.Session, 1, []interface{}{1, 2}, "failure")
+	err = ch.Range(context.Background(), func(ServiceResult) bool { return true })
+	assert.Equal(t, &ErrRequest{Message: "failure", Category: 1, Code: 2}, err)
+
+	// the loop is stopped early, so the session is closed
+	ch, _ = s.Call(context.Background(), "connect", "app")
+	msg = <-peer.Read()
+	reply(msg.Session, 0, "A")
+	calls := 0
+	err = ch.Range(context.Background(), func(ServiceResult) bool {
+		calls++
+		return false
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 0, s.PendingCalls())
+}
+
+func TestChannelRangeStop(t *testing.T) {
+	s, peer := newTestService("app", newStreamingServiceInfo())
+	defer s.Close()
+
+	ch, err := s.Call(context.Background(), "enqueue", "event")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := <-peer.Read()
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{"A"},
+	}
+
+	err = ch.Range(context.Background(), func(ServiceResult) bool { return false })
+	assert.NoError(t, err)
+	assert.Equal(t, 0, s.PendingCalls())
+
+	// the remote side is told to stop streaming
+	stopped := <-peer.Read()
+	assert.Equal(t, msg.Session, stopped.Session)
+	assert.Equal(t, uint64(1), stopped.MsgType)
+	assert.Equal(t, errStreamStopped.Error(), fmt.Sprintf("%s", stopped.Payload[1]))
+}
+
+func TestServiceCloseGracefully(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+
+	ch, err := s.Call(context.Background(), "resolve", "echo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := <-peer.Read()
+	assert.Equal(t, 1, s.PendingCalls())
+
+	closed := make(chan error)
+	go func() {
+		closed <- s.CloseGracefully(context.Background())
+	}()
+
+	// new calls are rejected while the pending one is finishing
+	closing := false
+	for i := 0; i < 100 && !closing; i++ {
+		time.Sleep(time.Millisecond)
+		s.mutex.RLock()
+		closing = s.closing
+		s.mutex.RUnlock()
+	}
+	_, err = s.Call(context.Background(), "resolve", "echo")
+	assert.Equal(t, ErrServiceClosing, err)
+
+	select {
+	case <-closed:
+		t.Fatal("the service is closed before the pending call is finished")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+	}
+	_, err = ch.Get(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, <-closed)
+	<-s.IsClosed()
+}
+
+func TestServiceCloseGracefullyTimeout(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+
+	_, err := s.Call(context.Background(), "resolve", "echo")
+	assert.NoError(t, err)
+	<-peer.Read()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.CloseGracefully(ctx))
+	<-s.IsClosed()
+}
+
+func TestServiceStats(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := s.Call(ctx, "resolve", "echo")
+	assert.NoError(t, err)
+	<-peer.Read()
+
+	ch, err := s.Call(context.Background(), "resolve", "echo")
+	assert.NoError(t, err)
+	msg := <-peer.Read()
+	assert.Equal(t, ServiceStats{Outstanding: 2, Calls: 2}, s.Stats())
+
+	cancel()
+	cancelled.Get(ctx)
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+	}
+	_, err = ch.Get(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, ServiceStats{Calls: 2, Completed: 2, Errors: 1}, s.Stats())
+}
+
+func TestServiceStatsStreams(t *testing.T) {
+	s, peer := newTestService("app", newStreamingServiceInfo())
+	defer s.Close()
+
+	// the stream cancelled after a chunk is not a failure
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := s.Call(ctx, "enqueue", "event")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := <-peer.Read()
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{"A"},
+	}
+	_, err = ch.Get(ctx)
+	assert.NoError(t, err)
+	cancel()
+	<-peer.Read()
+	assert.Equal(t, ServiceStats{Calls: 1, Completed: 1}, s.Stats())
+
+	// the calls lost with the connection are failures
+	_, err = s.Call(context.Background(), "enqueue", "event")
+	assert.NoError(t, err)
+	<-peer.Read()
+	peer.Close()
+	<-s.IsClosed()
+	for i := 0; i < 100 && s.PendingCalls() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, ServiceStats{Calls: 2, Completed: 2, Errors: 1}, s.Stats())
+}
+
+func TestServiceCallDetachesSession(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	ch, err := s.Call(context.Background(), "resolve", "echo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := <-peer.Read()
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+	}
+	_, err = ch.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(s.sessions.Keys()))
+}
+
+func TestServiceCallWithoutTrace(t *testing.T) {
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	_, err := s.Call(context.Background(), "resolve", "echo")
+	assert.NoError(t, err)
+
+	msg := <-peer.Read()
+	assert.Equal(t, 0, len(msg.Headers))
+}
+
 func TestService(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipped without Cocaine")
@@ -122,6 +773,195 @@ func TestReconnection(t *testing.T) {
 	}
 }
 
+func TestServiceIdleTimeout(t *testing.T) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	peer, _ := newAsyncRW(in)
+
+	var dials int32
+	dialed := make(chan struct{}, 10)
+	s := &Service{
+		socketIO:    sock,
+		ServiceInfo: newLocatorServiceInfo(),
+		sessions:    newSessions(),
+		stop:        make(chan struct{}),
+		name:        "locator",
+		opts:        serviceOptions{idleTimeout: 30 * time.Millisecond},
+		resolve: func(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error) {
+			return newLocatorServiceInfo(), nil
+		},
+		dial: func(endpoints []EndpointItem) (socketIO, error) {
+			in, out := testConn()
+			sock, _ := newAsyncRW(out)
+			newAsyncRW(in)
+			atomic.AddInt32(&dials, 1)
+			dialed <- struct{}{}
+			return sock, nil
+		},
+	}
+	go s.serve(s.socketIO, s.epoch)
+	s.markActive()
+	go s.watchIdle()
+
+	// the call in flight keeps the connection
+	ch, err := s.Call(context.Background(), "resolve", "echo")
+	assert.NoError(t, err)
+	msg := <-peer.Read()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+	}
+	_, err = ch.Get(context.Background())
+	assert.NoError(t, err)
+
+	select {
+	case <-dialed:
+	case <-time.After(time.Second):
+		t.Fatal("the idle service has not been reconnected")
+	}
+	s.mutex.RLock()
+	assert.False(t, s.disconnected())
+	s.mutex.RUnlock()
+
+	s.Close()
+	n := atomic.LoadInt32(&dials)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&dials))
+}
+
+func TestServiceIdleReconnectUnlocked(t *testing.T) {
+	s, peer := newTestServiceWithOptions("locator", newLocatorServiceInfo(),
+		serviceOptions{idleTimeout: 20 * time.Millisecond})
+
+	dialing, release := make(chan struct{}, 10), make(chan struct{})
+	s.resolve = func(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error) {
+		return newLocatorServiceInfo(), nil
+	}
+	s.dial = func(endpoints []EndpointItem) (socketIO, error) {
+		dialing <- struct{}{}
+		<-release
+		in, out := testConn()
+		sock, _ := newAsyncRW(out)
+		newAsyncRW(in)
+		return sock, nil
+	}
+	s.markActive()
+	go s.watchIdle()
+
+	// the calls are not blocked while the idle service is dialed
+	<-dialing
+	_, err := s.Call(context.Background(), "resolve", "echo")
+	assert.NoError(t, err)
+	<-peer.Read()
+
+	// the new connection is dropped, as the service has been used
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	s.mutex.RLock()
+	assert.Equal(t, uint(0), s.epoch)
+	s.mutex.RUnlock()
+
+	s.Close()
+}
+
+func TestServiceReconnectBackoff(t *testing.T) {
+	s, peer := newTestServiceWithOptions("locator", newLocatorServiceInfo(),
+		serviceOptions{maxReconnectAttempts: 2})
+	defer s.Close()
+
+	d := newTestDialer()
+	d.attach(s)
+	dialErr := errors.New("connection refused")
+	d.setError(dialErr)
+	endpoints := make(chan string, 1)
+	s.OnReconnect(func(endpoint string) { endpoints <- endpoint })
+
+	skipBackoff := func() {
+		s.mutex.Lock()
+		s.nextReconnect = time.Time{}
+		s.mutex.Unlock()
+	}
+
+	peer.Close()
+	<-s.IsClosed()
+
+	ctx := context.Background()
+	_, err := s.Call(ctx, "resolve", "echo")
+	assert.Equal(t, dialErr, err)
+	// the call fails fast while the service backs off
+	_, err = s.Call(ctx, "resolve", "echo")
+	assert.Equal(t, dialErr, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.dials))
+
+	skipBackoff()
+	_, err = s.Call(ctx, "resolve", "echo")
+	assert.Equal(t, dialErr, err)
+	skipBackoff()
+	_, err = s.Call(ctx, "resolve", "echo")
+	assert.Equal(t, ErrReconnectAttemptsExceeded, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&d.dials))
+
+	// the forced reconnection resets the attempts
+	d.setError(nil)
+	assert.NoError(t, s.Reconnect(ctx, true))
+	<-endpoints
+	peer = <-d.peers
+	_, err = s.Call(ctx, "resolve", "echo")
+	assert.NoError(t, err)
+	<-peer.Read()
+}
+
+func TestServiceRetryOnReconnect(t *testing.T) {
+	s, peer := newTestServiceWithOptions("locator", newLocatorServiceInfo(),
+		serviceOptions{retryOnReconnect: true})
+	defer s.Close()
+
+	d := newTestDialer()
+	d.attach(s)
+
+	ctx := context.Background()
+	resubmitted, err := s.Call(ctx, "resolve", "echo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	first := <-peer.Read()
+
+	// the stream has got a chunk, so it's not resubmitted
+	failed, _ := s.Call(ctx, "connect", "app")
+	msg := <-peer.Read()
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{"A"},
+	}
+	_, err = failed.Get(ctx)
+	assert.NoError(t, err)
+
+	peer.Close()
+	peer = <-d.peers
+
+	msg = <-peer.Read()
+	assert.Equal(t, first.Session, msg.Session)
+	assert.Equal(t, first.MsgType, msg.MsgType)
+	assert.Equal(t, first.Payload, msg.Payload)
+
+	_, err = failed.Get(ctx)
+	if assert.IsType(t, &ServiceError{}, err) {
+		assert.Equal(t, ErrDisconnected, err.(*ServiceError).Code)
+	}
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+		Payload:           []interface{}{[]interface{}{}, 1, map[uint64]interface{}{}},
+	}
+	res, err := resubmitted.Get(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, res.Err())
+	assert.Equal(t, 0, s.PendingCalls())
+}
+
 func TestTimeoutError(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipped without Cocaine")
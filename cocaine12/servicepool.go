@@ -0,0 +1,135 @@
+package cocaine12
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// ErrServicePoolClosed is returned by ServicePool.Call after Close
+var ErrServicePoolClosed = errors.New("service pool is closed")
+
+// ServicePool maintains several connections to the same service
+// and spreads calls across them in round-robin order.
+// It has the same Call/Close methods as Service.
+type ServicePool struct {
+	next uint64
+
+	mu       sync.Mutex
+	services []*Service
+	closed   bool
+
+	// dial creates a connection, it's replaced in tests
+	dial func(ctx context.Context) (*Service, error)
+}
+
+// NewServicePool creates a pool of size connections to the service.
+// Connections, which fail to be created, are retried lazily by Call.
+// It returns an error only if no connection has been created.
+func NewServicePool(ctx context.Context, name string, size int, endpoints []string) (*ServicePool, error) {
+	return newServicePool(ctx, size, func(ctx context.Context) (*Service, error) {
+		return NewService(ctx, name, endpoints)
+	})
+}
+
+func newServicePool(ctx context.Context, size int, dial func(context.Context) (*Service, error)) (*ServicePool, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	p := &ServicePool{
+		services: make([]*Service, size),
+		dial:     dial,
+	}
+
+	var (
+		connected int
+		lastErr   error
+	)
+	for i := range p.services {
+		s, err := dial(ctx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		p.services[i] = s
+		connected++
+	}
+
+	if connected == 0 {
+		return nil, lastErr
+	}
+
+	return p, nil
+}
+
+// Call calls the method on the next connection of the pool.
+// A disconnected Service reconnects on its own.
+func (p *ServicePool) Call(ctx context.Context, name string, args ...interface{}) (Channel, error) {
+	s, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Call(ctx, name, args...)
+}
+
+func (p *ServicePool) get(ctx context.Context) (*Service, error) {
+	i := int(atomic.AddUint64(&p.next, 1) % uint64(len(p.services)))
+
+	p.mu.Lock()
+	closed, s := p.closed, p.services[i]
+	p.mu.Unlock()
+
+	switch {
+	case closed:
+		return nil, ErrServicePoolClosed
+	case s != nil:
+		return s, nil
+	}
+
+	// the connection is created without the lock,
+	// so the calls to other connections are not blocked
+	s, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	switch {
+	case p.closed:
+		p.mu.Unlock()
+		s.Close()
+		return nil, ErrServicePoolClosed
+	case p.services[i] != nil:
+		// another call has created the connection meanwhile
+		winner := p.services[i]
+		p.mu.Unlock()
+		s.Close()
+		return winner, nil
+	}
+	p.services[i] = s
+	p.mu.Unlock()
+
+	return s, nil
+}
+
+// Close closes all connections of the pool
+func (p *ServicePool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+
+	for i, s := range p.services {
+		if s != nil {
+			s.Close()
+			p.services[i] = nil
+		}
+	}
+}
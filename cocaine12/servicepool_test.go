@@ -0,0 +1,99 @@
+package cocaine12
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestServicePool(t *testing.T) {
+	var (
+		peers []*asyncRWSocket
+		fail  = true
+	)
+
+	// the second connection fails at first
+	dial := func(ctx context.Context) (*Service, error) {
+		if len(peers) == 1 && fail {
+			fail = false
+			return nil, errors.New("dial error")
+		}
+		s, peer := newTestService("locator", newLocatorServiceInfo())
+		peers = append(peers, peer)
+		return s, nil
+	}
+
+	ctx := context.Background()
+	p, err := newServicePool(ctx, 2, dial)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, 1, len(peers))
+
+	// calls go to both connections in turn,
+	// the failed one is dialed again
+	for i := 0; i < 4; i++ {
+		_, err = p.Call(ctx, "resolve", "echo")
+		assert.NoError(t, err)
+	}
+	if assert.Equal(t, 2, len(peers)) {
+		for _, peer := range peers {
+			<-peer.Read()
+			<-peer.Read()
+		}
+	}
+
+	p.Close()
+	_, err = p.Call(ctx, "resolve", "echo")
+	assert.Equal(t, ErrServicePoolClosed, err)
+}
+
+func TestServicePoolDialError(t *testing.T) {
+	dialErr := errors.New("dial error")
+	_, err := newServicePool(context.Background(), 3, func(context.Context) (*Service, error) {
+		return nil, dialErr
+	})
+	assert.Equal(t, dialErr, err)
+}
+
+func TestServicePoolDialWithoutLock(t *testing.T) {
+	healthy, peer := newTestService("locator", newLocatorServiceInfo())
+	dialed := false
+	p, err := newServicePool(context.Background(), 2, func(context.Context) (*Service, error) {
+		if dialed {
+			return nil, errors.New("dial error")
+		}
+		dialed = true
+		return healthy, nil
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer p.Close()
+
+	// the dead connection is dialed for long
+	dialing, release := make(chan struct{}), make(chan struct{})
+	p.dial = func(context.Context) (*Service, error) {
+		close(dialing)
+		<-release
+		return nil, errors.New("dial error")
+	}
+
+	ctx := context.Background()
+	failed := make(chan error, 1)
+	go func() {
+		_, err := p.Call(ctx, "resolve", "echo")
+		failed <- err
+	}()
+	<-dialing
+
+	// the healthy connection is not blocked meanwhile
+	_, err = p.Call(ctx, "resolve", "echo")
+	assert.NoError(t, err)
+	<-peer.Read()
+
+	close(release)
+	assert.Error(t, <-failed)
+}
@@ -8,6 +8,8 @@ type sessions struct {
 	sync.RWMutex
 	links   map[uint64]Channel
 	counter uint64
+	// idle are closed when the last session is detached
+	idle []chan struct{}
 }
 
 func newSessions() *sessions {
@@ -41,10 +43,37 @@ func (s *sessions) Detach(id uint64) {
 	s.Lock()
 
 	delete(s.links, id)
+	if len(s.links) == 0 {
+		for _, idle := range s.idle {
+			close(idle)
+		}
+		s.idle = nil
+	}
 
 	s.Unlock()
 }
 
+// Len returns the number of attached sessions
+func (s *sessions) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.links)
+}
+
+// Idle returns a channel, which is closed when there are no sessions
+func (s *sessions) Idle() <-chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+
+	idle := make(chan struct{})
+	if len(s.links) == 0 {
+		close(idle)
+	} else {
+		s.idle = append(s.idle, idle)
+	}
+	return idle
+}
+
 func (s *sessions) Get(id uint64) (Channel, bool) {
 	s.RLock()
 
@@ -1,7 +1,9 @@
 package cocaine12
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 	"sync/atomic"
 )
 
@@ -12,10 +14,22 @@ const (
 	InfoLevel
 	WarnLevel
 	ErrorLevel = 3
+	// FatalLevel is used by Fatal and Fatalf, which exit the process.
+	// The logging service receives the records as ErrorLevel ones
+	// with the "original_level" field.
+	FatalLevel Severity = 4
+	// TraceLevel is below DebugLevel for the most verbose records.
+	// Loggers drop them unless the verbosity is TraceLevel.
+	// The logging service receives them as DebugLevel ones
+	// with the "original_level" field.
+	TraceLevel Severity = -1
 )
 
-func (s *Severity) String() string {
-	switch i := s.get(); i {
+// String returns the name of the level as it's sent to the logging service
+func (s Severity) String() string {
+	switch i := s; i {
+	case TraceLevel:
+		return "TRACE"
 	case DebugLevel:
 		return "DEBUG"
 	case InfoLevel:
@@ -24,11 +38,56 @@ func (s *Severity) String() string {
 		return "WARNING"
 	case ErrorLevel:
 		return "ERROR"
+	case FatalLevel:
+		return "FATAL"
 	default:
 		return strconv.FormatInt(int64(i), 10)
 	}
 }
 
+// ParseSeverity parses the name of a level case-insensitively.
+// It accepts the names returned by String and their short forms:
+// trace, debug, info, warn (warning), error (err), fatal.
+// Numeric levels are accepted too.
+func ParseSeverity(s string) (Severity, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if level, err := strconv.ParseInt(name, 10, 32); err == nil {
+		return Severity(level), nil
+	}
+
+	switch name {
+	case "trace":
+		return TraceLevel, nil
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error", "err":
+		return ErrorLevel, nil
+	case "fatal":
+		return FatalLevel, nil
+	default:
+		return DebugLevel, fmt.Errorf("unknown severity %q, expected one of trace, debug, info, warning, error, fatal", s)
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler via ParseSeverity
+func (s *Severity) UnmarshalText(text []byte) error {
+	level, err := ParseSeverity(string(text))
+	if err != nil {
+		return err
+	}
+	*s = level
+	return nil
+}
+
 func (s *Severity) get() Severity {
 	return Severity(atomic.LoadInt32((*int32)(s)))
 }
@@ -36,3 +95,7 @@ func (s *Severity) get() Severity {
 func (s *Severity) set(value Severity) {
 	atomic.StoreInt32((*int32)(s), int32(value))
 }
+
+func (s *Severity) compareAndSet(old, value Severity) bool {
+	return atomic.CompareAndSwapInt32((*int32)(s), int32(old), int32(value))
+}
@@ -0,0 +1,44 @@
+package cocaine12
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSeverity(t *testing.T) {
+	for _, level := range []Severity{TraceLevel, DebugLevel, InfoLevel, WarnLevel, ErrorLevel, FatalLevel} {
+		parsed, err := ParseSeverity(level.String())
+		assert.NoError(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	parsed, err := ParseSeverity(" Warn ")
+	assert.NoError(t, err)
+	assert.Equal(t, WarnLevel, parsed)
+
+	_, err = ParseSeverity("verbose")
+	assert.Error(t, err)
+
+	parsed, err = ParseSeverity("-100")
+	assert.NoError(t, err)
+	assert.Equal(t, Severity(-100), parsed)
+}
+
+func TestSeverityText(t *testing.T) {
+	var config struct {
+		Level Severity `json:"level"`
+	}
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"level": "warn"}`), &config))
+	assert.Equal(t, WarnLevel, config.Level)
+
+	data, err := json.Marshal(config)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"level":"WARNING"}`, string(data))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"level": "verbose"}`), &config))
+	assert.Equal(t, "INFO", fmt.Sprint(InfoLevel))
+}
@@ -0,0 +1,230 @@
+package cocaine12
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Span represents an RPC call started by StartSpan.
+// All methods are safe to call on nil Span, which stands
+// for a span that is not logged.
+type Span struct {
+	traceInfo TraceInfo
+	rpcName   string
+	startTime time.Time
+	// fields are logged both on start and on close
+	fields Fields
+	// ctx is the context of the span, its error is logged on close
+	ctx context.Context
+
+	mu       sync.Mutex
+	tags     Fields
+	events   []Fields
+	finished bool
+}
+
+// StartSpan starts new span like WithTrace, but returns the Span
+// to allow tagging it before closing. The Span is nil if the context
+// has no TraceInfo or the span is not sampled.
+func StartSpan(ctx context.Context, rpcName string) (context.Context, *Span) {
+	return startSpan(ctx, rpcName, time.Time{}, nil)
+}
+
+// StartFollowsFromSpan starts new span like WithFollowsFromTrace,
+// but returns the Span to allow tagging it before closing.
+func StartFollowsFromSpan(ctx context.Context, rpcName string) (context.Context, *Span) {
+	return startSpan(ctx, rpcName, time.Time{}, Fields{"ref_type": "follows_from"})
+}
+
+// StartSpanAt starts new span like StartSpan, but the span starts
+// at the given time. The zero time means now.
+func StartSpanAt(ctx context.Context, rpcName string, startTime time.Time) (context.Context, *Span) {
+	return startSpan(ctx, rpcName, startTime, nil)
+}
+
+func startSpan(ctx context.Context, rpcName string, startTime time.Time, fields Fields) (context.Context, *Span) {
+	if ctx == nil {
+		// I'm not sure it is a valid action.
+		// According to the rule "no trace info, no new span"
+		// to support sampling, nil Context has no TraceInfo, so
+		// it cannot start new Span.
+		return context.Background(), nil
+	}
+
+	// traceInfo is a copy, so sibling spans started
+	// from the same context don't share it
+	traceInfo, ok := TraceInfoFromContext(ctx)
+	if !ok {
+		// given context has no TraceInfo
+		// so we can't start new trace to support sampling.
+		return ctx, nil
+	}
+
+	if !isTraceSampled(traceInfo, rpcName) {
+		// TraceInfo is passed downstream unchanged,
+		// but the span is not logged
+		return ctx, nil
+	}
+
+	// startTime is not used only to log the start of an RPC
+	// It's stored in Context to calculate the RPC call duration.
+	// A user can get it via Context.Value(TraceStartTimeValue)
+	if startTime.IsZero() {
+		startTime = time.Now()
+	}
+
+	// Tracing magic:
+	// * the previous span becomes our parent
+	// * new span is set as random number
+	// * trace still stays the same
+	traceInfo.parent = traceInfo.span
+	traceInfo.span = nextTraceID()
+
+	baggage := getBaggage(ctx)
+	deadline, hasDeadline := ctx.Deadline()
+	withGoroutineID := getTraceSettings().goroutineID
+	if len(baggage) > 0 || hasDeadline || withGoroutineID {
+		merged := make(Fields, len(baggage)+len(fields)+4)
+		for k, v := range baggage {
+			merged[k] = v
+		}
+		if withGoroutineID {
+			merged["goroutine_id"] = goroutineID()
+		}
+		if hasDeadline {
+			// the budget is computed once, so both records show
+			// the time left when the span started
+			budget := deadline.Sub(startTime)
+			merged["deadline_ns"] = deadline.UnixNano()
+			merged["budget_ns"] = budget.Nanoseconds()
+			if budget <= 0 {
+				merged["deadline_exceeded"] = true
+			}
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+		fields = merged
+	}
+
+	sp := &Span{
+		traceInfo: traceInfo,
+		rpcName:   rpcName,
+		startTime: startTime,
+		fields:    fields,
+	}
+
+	getSpanObserver().StartSpan(rpcName, sp.traceInfo, startTime, fields)
+
+	ctx = &traced{
+		Context:   ctx,
+		traceInfo: sp.traceInfo,
+		startTime: startTime,
+		baggage:   baggage,
+	}
+	sp.ctx = ctx
+
+	return ctx, sp
+}
+
+// SetTag attaches the key/value pair to the closing record of the span.
+// Tags set after the span is closed are ignored.
+func (sp *Span) SetTag(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+
+	sp.mu.Lock()
+	if !sp.finished {
+		if sp.tags == nil {
+			sp.tags = make(Fields)
+		}
+		sp.tags[key] = value
+	}
+	sp.mu.Unlock()
+}
+
+// LogEvent records the event with the current timestamp. Events are
+// attached to the closing record as "events" field.
+// Events logged after the span is closed are ignored.
+func (sp *Span) LogEvent(msg string) {
+	if sp == nil {
+		return
+	}
+
+	event := Fields{
+		"timestamp": time.Now().UnixNano(),
+		"event":     msg,
+	}
+
+	sp.mu.Lock()
+	if !sp.finished {
+		sp.events = append(sp.events, event)
+	}
+	sp.mu.Unlock()
+}
+
+// Finish closes the span with "finish" message
+func (sp *Span) Finish() {
+	sp.finish(nil, nil, "finish")
+}
+
+// Close closes the span like CloseSpan
+func (sp *Span) Close(format string, args ...interface{}) {
+	sp.finish(nil, nil, format, args...)
+}
+
+func (sp *Span) finish(err error, fields Fields, format string, args ...interface{}) {
+	if sp == nil {
+		return
+	}
+
+	sp.mu.Lock()
+	if sp.finished {
+		sp.mu.Unlock()
+		return
+	}
+	sp.finished = true
+	tags := sp.tags
+	if len(sp.events) > 0 {
+		// tags are never modified after the span is finished
+		if tags == nil {
+			tags = make(Fields, 1)
+		}
+		tags["events"] = sp.events
+	}
+	sp.mu.Unlock()
+
+	ctxErr := sp.ctx.Err()
+	if len(sp.fields)+len(tags) > 0 || ctxErr != nil {
+		merged := make(Fields, len(sp.fields)+len(tags)+len(fields)+2)
+		for _, src := range []Fields{sp.fields, tags, fields} {
+			for k, v := range src {
+				merged[k] = v
+			}
+		}
+		// the RPC was cancelled or timed out
+		if ctxErr != nil {
+			merged["ctx_error"] = ctxErr.Error()
+			if ctxErr == context.DeadlineExceeded {
+				merged["deadline_exceeded"] = true
+			}
+		}
+		fields = merged
+	}
+
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+
+	finishTime := time.Now()
+	traceStats.record(sp.rpcName, finishTime.Sub(sp.startTime), err != nil)
+	if aggregator := getSpanAggregator(); aggregator != nil {
+		aggregator.Add(sp.rpcName, finishTime.Sub(sp.startTime))
+	}
+	getSpanObserver().FinishSpan(sp.rpcName, sp.traceInfo, sp.startTime, finishTime, err, fields, msg)
+}
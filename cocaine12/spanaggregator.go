@@ -0,0 +1,166 @@
+package cocaine12
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSpanReservoirSize is the number of durations kept per RPC
+// by the aggregator created with a non-positive size
+const DefaultSpanReservoirSize = 1024
+
+// SpanPercentiles is the snapshot of the durations of the spans of an RPC
+type SpanPercentiles struct {
+	// Count is the total number of spans, not only the sampled ones
+	Count uint64
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	// Max is the longest of all spans, not only of the sampled ones
+	Max time.Duration
+}
+
+// SpanAggregator collects the durations of finished spans per RPC name,
+// so the latency percentiles are available locally. It keeps a bounded
+// reservoir of uniformly sampled durations per RPC, so the memory
+// doesn't grow with the number of spans. Unlike TraceStats the
+// percentiles are not rounded up to the histogram buckets.
+type SpanAggregator struct {
+	size int
+
+	mu   sync.RWMutex
+	rpcs map[string]*spanReservoir
+}
+
+type spanReservoir struct {
+	mu      sync.Mutex
+	count   uint64
+	max     time.Duration
+	samples durations
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// NewSpanAggregator creates an aggregator keeping up to reservoirSize
+// durations per RPC. See SetSpanAggregator.
+func NewSpanAggregator(reservoirSize int) *SpanAggregator {
+	if reservoirSize <= 0 {
+		reservoirSize = DefaultSpanReservoirSize
+	}
+
+	return &SpanAggregator{
+		size: reservoirSize,
+		rpcs: make(map[string]*spanReservoir),
+	}
+}
+
+func (a *SpanAggregator) reservoir(rpcName string) *spanReservoir {
+	a.mu.RLock()
+	r, ok := a.rpcs[rpcName]
+	a.mu.RUnlock()
+	if ok {
+		return r
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r, ok = a.rpcs[rpcName]; !ok {
+		r = &spanReservoir{}
+		a.rpcs[rpcName] = r
+	}
+	return r
+}
+
+// Add records the duration of a span of the RPC
+func (a *SpanAggregator) Add(rpcName string, duration time.Duration) {
+	r := a.reservoir(rpcName)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count++
+	if duration > r.max {
+		r.max = duration
+	}
+	if len(r.samples) < a.size {
+		r.samples = append(r.samples, duration)
+		return
+	}
+
+	// every duration is kept with the same probability
+	if i := rand.Int63n(int64(r.count)); i < int64(a.size) {
+		r.samples[i] = duration
+	}
+}
+
+// Snapshot returns the percentiles of the durations per RPC name
+func (a *SpanAggregator) Snapshot() map[string]SpanPercentiles {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	snapshot := make(map[string]SpanPercentiles, len(a.rpcs))
+	for rpcName, r := range a.rpcs {
+		r.mu.Lock()
+		count, max := r.count, r.max
+		samples := append(durations(nil), r.samples...)
+		r.mu.Unlock()
+
+		sort.Sort(samples)
+		snapshot[rpcName] = SpanPercentiles{
+			Count: count,
+			P50:   samples.percentile(50),
+			P90:   samples.percentile(90),
+			P99:   samples.percentile(99),
+			Max:   max,
+		}
+	}
+
+	return snapshot
+}
+
+// Reset clears the collected durations
+func (a *SpanAggregator) Reset() {
+	a.mu.Lock()
+	a.rpcs = make(map[string]*spanReservoir)
+	a.mu.Unlock()
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations
+func (d durations) percentile(p float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(d))))
+	if rank < 1 {
+		rank = 1
+	}
+	return d[rank-1]
+}
+
+var (
+	spanAggregatorMu sync.RWMutex
+	// nil means that the durations are not aggregated
+	spanAggregator *SpanAggregator
+)
+
+// SetSpanAggregator makes finished spans feed their durations
+// to the aggregator. nil disables the aggregation, which is the default.
+func SetSpanAggregator(aggregator *SpanAggregator) {
+	spanAggregatorMu.Lock()
+	spanAggregator = aggregator
+	spanAggregatorMu.Unlock()
+}
+
+func getSpanAggregator() *SpanAggregator {
+	spanAggregatorMu.RLock()
+	defer spanAggregatorMu.RUnlock()
+	return spanAggregator
+}
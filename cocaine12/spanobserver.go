@@ -0,0 +1,278 @@
+package cocaine12
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SpanObserver is notified about every started and finished span.
+// It allows to export spans to other tracing systems.
+type SpanObserver interface {
+	StartSpan(rpcName string, traceInfo TraceInfo, startTime time.Time, fields Fields)
+	FinishSpan(rpcName string, traceInfo TraceInfo, startTime, finishTime time.Time,
+		err error, fields Fields, msg string)
+}
+
+var (
+	spanObserverMu sync.RWMutex
+	spanObserver   SpanObserver = loggingSpanObserver{}
+)
+
+// SetSpanObserver replaces the observer of spans.
+// nil restores the default one, which logs spans to the trace logger.
+func SetSpanObserver(observer SpanObserver) {
+	if observer == nil {
+		observer = loggingSpanObserver{}
+	}
+
+	spanObserverMu.Lock()
+	spanObserver = observer
+	spanObserverMu.Unlock()
+}
+
+func getSpanObserver() SpanObserver {
+	spanObserverMu.RLock()
+	defer spanObserverMu.RUnlock()
+	return spanObserver
+}
+
+// TraceIDEncoding describes how ids are formatted in span records
+type TraceIDEncoding int
+
+const (
+	// TraceIDHex formats ids as hex numbers
+	TraceIDHex TraceIDEncoding = iota
+	// TraceIDDecimal formats ids as decimal numbers
+	TraceIDDecimal
+	// TraceIDBase64 formats ids as base64 of 8 big-endian bytes
+	// (16 bytes for 128-bit trace ids)
+	TraceIDBase64
+)
+
+func (e TraceIDEncoding) encode(id uint64) string {
+	switch e {
+	case TraceIDDecimal:
+		return strconv.FormatUint(id, 10)
+	case TraceIDBase64:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], id)
+		return base64.StdEncoding.EncodeToString(buf[:])
+	default:
+		return strconv.FormatUint(id, 16)
+	}
+}
+
+// encode128 formats a 128-bit id. hi is expected to be non-zero.
+func (e TraceIDEncoding) encode128(hi, lo uint64) string {
+	switch e {
+	case TraceIDDecimal:
+		id := new(big.Int).SetUint64(hi)
+		id.Lsh(id, 64)
+		id.Or(id, new(big.Int).SetUint64(lo))
+		return id.String()
+	case TraceIDBase64:
+		var buf [16]byte
+		binary.BigEndian.PutUint64(buf[:8], hi)
+		binary.BigEndian.PutUint64(buf[8:], lo)
+		return base64.StdEncoding.EncodeToString(buf[:])
+	default:
+		return fmt.Sprintf("%016x%016x", hi, lo)
+	}
+}
+
+// TraceFieldConfig describes the names and the encoding
+// of the id fields in span records
+type TraceFieldConfig struct {
+	TraceKey  string
+	SpanKey   string
+	ParentKey string
+	Encoding  TraceIDEncoding
+}
+
+// DefaultTraceFieldConfig is used unless SetTraceFieldConfig is called
+var DefaultTraceFieldConfig = TraceFieldConfig{
+	TraceKey:  "trace_id",
+	SpanKey:   "span_id",
+	ParentKey: "parent_id",
+	Encoding:  TraceIDHex,
+}
+
+type traceLogSettings struct {
+	durationUnit   time.Duration
+	legacyDuration bool
+	logStart       bool
+	goroutineID    bool
+	fieldConfig    TraceFieldConfig
+}
+
+var (
+	traceSettingsMu sync.RWMutex
+	traceSettings   = traceLogSettings{
+		durationUnit:   time.Microsecond,
+		legacyDuration: true,
+		logStart:       true,
+		fieldConfig:    DefaultTraceFieldConfig,
+	}
+)
+
+func getTraceSettings() traceLogSettings {
+	traceSettingsMu.RLock()
+	defer traceSettingsMu.RUnlock()
+	return traceSettings
+}
+
+// SetTraceDurationUnit sets the unit of span durations. The unit is
+// reflected in the field name, e.g. duration_us or duration_ms.
+// Microseconds are used by default.
+func SetTraceDurationUnit(unit time.Duration) {
+	if unit <= 0 {
+		unit = time.Microsecond
+	}
+
+	traceSettingsMu.Lock()
+	traceSettings.durationUnit = unit
+	traceSettingsMu.Unlock()
+}
+
+// SetTraceLegacyDuration enables the deprecated duration field,
+// which holds microseconds. It's enabled by default
+// and will be removed in the next release.
+func SetTraceLegacyDuration(enable bool) {
+	traceSettingsMu.Lock()
+	traceSettings.legacyDuration = enable
+	traceSettingsMu.Unlock()
+}
+
+// SetTraceLogStart enables the "start" record of spans. It's enabled
+// by default. When disabled, a span is logged once on close, the record
+// still has start_timestamp and the duration.
+func SetTraceLogStart(enable bool) {
+	traceSettingsMu.Lock()
+	traceSettings.logStart = enable
+	traceSettingsMu.Unlock()
+}
+
+// SetTraceGoroutineID enables the "goroutine_id" field of span records,
+// which is the id of the goroutine that has started the span.
+// It's disabled by default, as the id is parsed from the stack trace.
+func SetTraceGoroutineID(enable bool) {
+	traceSettingsMu.Lock()
+	traceSettings.goroutineID = enable
+	traceSettingsMu.Unlock()
+}
+
+// goroutineID parses the id from the header of the stack trace,
+// which looks like "goroutine 18 [running]:"
+func goroutineID() uint64 {
+	var buf [64]byte
+	header := buf[:runtime.Stack(buf[:], false)]
+	header = bytes.TrimPrefix(header, []byte("goroutine "))
+	if i := bytes.IndexByte(header, ' '); i > 0 {
+		header = header[:i]
+	}
+
+	id, _ := strconv.ParseUint(string(header), 10, 64)
+	return id
+}
+
+// SetTraceFieldConfig sets the names and the encoding of the id fields.
+// Empty names are replaced with the default ones.
+func SetTraceFieldConfig(config TraceFieldConfig) {
+	if config.TraceKey == "" {
+		config.TraceKey = DefaultTraceFieldConfig.TraceKey
+	}
+	if config.SpanKey == "" {
+		config.SpanKey = DefaultTraceFieldConfig.SpanKey
+	}
+	if config.ParentKey == "" {
+		config.ParentKey = DefaultTraceFieldConfig.ParentKey
+	}
+
+	traceSettingsMu.Lock()
+	traceSettings.fieldConfig = config
+	traceSettingsMu.Unlock()
+}
+
+// setTraceFields adds the ids of the span to fields
+func setTraceFields(fields Fields, traceInfo TraceInfo) {
+	config := getTraceSettings().fieldConfig
+	if traceInfo.traceHi != 0 {
+		fields[config.TraceKey] = config.Encoding.encode128(traceInfo.traceHi, traceInfo.trace)
+	} else {
+		fields[config.TraceKey] = config.Encoding.encode(traceInfo.trace)
+	}
+	fields[config.SpanKey] = config.Encoding.encode(traceInfo.span)
+	fields[config.ParentKey] = config.Encoding.encode(traceInfo.parent)
+}
+
+func durationFieldName(unit time.Duration) string {
+	switch unit {
+	case time.Nanosecond:
+		return "duration_ns"
+	case time.Microsecond:
+		return "duration_us"
+	case time.Millisecond:
+		return "duration_ms"
+	case time.Second:
+		return "duration_s"
+	default:
+		return "duration_" + unit.String()
+	}
+}
+
+// loggingSpanObserver logs spans to the trace logger
+type loggingSpanObserver struct{}
+
+func (loggingSpanObserver) fields(rpcName string, traceInfo TraceInfo) Fields {
+	fields := Fields{
+		"RPC": rpcName,
+	}
+	setTraceFields(fields, traceInfo)
+	return fields
+}
+
+func (l loggingSpanObserver) StartSpan(rpcName string, traceInfo TraceInfo, startTime time.Time, extra Fields) {
+	if !getTraceSettings().logStart {
+		return
+	}
+
+	fields := l.fields(rpcName, traceInfo)
+	for k, v := range extra {
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+		}
+	}
+	emitTraceRecord(InfoLevel, fields, "start", startTime)
+}
+
+func (l loggingSpanObserver) FinishSpan(rpcName string, traceInfo TraceInfo, startTime, finishTime time.Time,
+	err error, extra Fields, msg string) {
+	fields := l.fields(rpcName, traceInfo)
+	for k, v := range extra {
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+		}
+	}
+	duration := finishTime.Sub(startTime)
+	settings := getTraceSettings()
+	fields["start_timestamp"] = startTime.UnixNano()
+	fields[durationFieldName(settings.durationUnit)] = int64(duration / settings.durationUnit)
+	if settings.legacyDuration {
+		fields["duration"] = duration.Nanoseconds() / 1000
+	}
+	if err != nil {
+		// failed spans are easy to filter by severity
+		fields["error"] = err.Error()
+		emitTraceRecord(WarnLevel, fields, msg, finishTime)
+		return
+	}
+
+	emitTraceRecord(InfoLevel, fields, msg, finishTime)
+}
@@ -2,7 +2,10 @@ package cocaine12
 
 import (
 	"fmt"
-	"math/rand"
+	"io"
+	"math"
+	"path"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,25 +15,137 @@ import (
 const (
 	TraceInfoValue      = "trace.traceinfo"
 	TraceStartTimeValue = "trace.starttime"
+	TraceBaggageValue   = "trace.baggage"
 )
 
+// traceLoggerRetryInterval is the interval of attempts to connect
+// to the logging service while spans are written to the fallback
+const traceLoggerRetryInterval = 30 * time.Second
+
 var (
 	initTraceLogger sync.Once
+	traceLoggerMu   sync.RWMutex
 	traceLogger     Logger
+	// traceLoggerFallback is true while the logging service is unavailable
+	traceLoggerFallback bool
+	traceFallbackSink   io.Writer
 )
 
 func traceLog() Logger {
 	initTraceLogger.Do(func() {
-		var err error
-		traceLogger, err = NewLogger(context.Background())
-		// there must be no error
+		traceLoggerMu.Lock()
+		defer traceLoggerMu.Unlock()
+
+		// SetTraceLogger has been called before the first usage
+		if traceLogger != nil {
+			return
+		}
+
+		logger, err := newCocaineLogger(context.Background(), defaultLoggerName)
 		if err != nil {
-			panic(fmt.Sprintf("unable to create trace logger: %v", err))
+			// spans are written to the fallback,
+			// but the application keeps working
+			useTraceFallbackLocked()
+			go retryTraceLogger()
+			return
 		}
+		traceLogger = logger
 	})
+
+	traceLoggerMu.RLock()
+	defer traceLoggerMu.RUnlock()
 	return traceLogger
 }
 
+func useTraceFallbackLocked() {
+	traceLoggerFallback = true
+	if traceFallbackSink != nil {
+		traceLogger = newJSONLogger(traceFallbackSink)
+		return
+	}
+
+	traceLogger, _ = newFallbackLogger()
+}
+
+// retryTraceLogger switches spans back to the logging service,
+// when it becomes available
+func retryTraceLogger() {
+	ticker := time.NewTicker(traceLoggerRetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		traceLoggerMu.RLock()
+		fallback := traceLoggerFallback
+		traceLoggerMu.RUnlock()
+		if !fallback {
+			// SetTraceLogger has been called
+			return
+		}
+
+		logger, err := newCocaineLogger(context.Background(), defaultLoggerName)
+		if err != nil {
+			continue
+		}
+
+		traceLoggerMu.Lock()
+		if traceLoggerFallback {
+			traceLoggerFallback = false
+			traceLogger = logger
+			logger = nil
+		}
+		traceLoggerMu.Unlock()
+
+		if logger != nil {
+			logger.Close()
+		}
+		return
+	}
+}
+
+// SetTraceLogger replaces the logger used to log spans.
+// nil disables logging of spans.
+func SetTraceLogger(logger Logger) {
+	if logger == nil {
+		logger = NewNopLogger()
+	}
+
+	traceLoggerMu.Lock()
+	traceLogger = logger
+	traceLoggerFallback = false
+	traceLoggerMu.Unlock()
+}
+
+// SetTraceFallbackSink sets the writer, which receives spans as JSON lines
+// while the logging service is unavailable, e.g. a file or a UDP connection.
+// The logging service is reconnected periodically. By default spans are
+// written to the standard logger.
+func SetTraceFallbackSink(w io.Writer) {
+	traceLoggerMu.Lock()
+	traceFallbackSink = w
+	if traceLoggerFallback {
+		useTraceFallbackLocked()
+	}
+	traceLoggerMu.Unlock()
+}
+
+// TraceLogger returns the logger used to log spans
+func TraceLogger() Logger {
+	return traceLog()
+}
+
+// flushTraceLogger flushes the trace logger unless it has not been
+// used yet, so the logging service is not connected just to flush it
+func flushTraceLogger(ctx context.Context) error {
+	traceLoggerMu.RLock()
+	logger := traceLogger
+	traceLoggerMu.RUnlock()
+
+	if logger == nil {
+		return nil
+	}
+	return logger.Flush(ctx)
+}
+
 func getTraceInfo(ctx context.Context) *TraceInfo {
 	if val, ok := ctx.Value(TraceInfoValue).(TraceInfo); ok {
 		return &val
@@ -42,18 +157,219 @@ func getTraceInfo(ctx context.Context) *TraceInfo {
 // the rpc ends.
 type CloseSpan func(format string, args ...interface{})
 
+// FinishSpan closes attached span like CloseSpan. Non-nil err marks
+// the span as failed. Fields are added to the closing log record.
+type FinishSpan func(err error, fields Fields, format string, args ...interface{})
+
+var (
+	closeDummySpan  CloseSpan  = func(format string, args ...interface{}) {}
+	finishDummySpan FinishSpan = func(err error, fields Fields, format string, args ...interface{}) {}
+)
+
+// TraceSampler decides if spans of the trace should be logged.
+// To keep traces complete the decision should depend on the trace id only,
+// so all spans of a trace are either logged or not.
+type TraceSampler func(traceInfo TraceInfo, rpcName string) bool
+
 var (
-	closeDummySpan CloseSpan = func(format string, args ...interface{}) {}
+	traceSamplerMu sync.RWMutex
+	// nil means that every span is logged
+	traceSampler TraceSampler
 )
 
+// SetTraceSampler sets the sampling policy used by WithTrace.
+// nil resets it to the default policy, which logs every span.
+func SetTraceSampler(sampler TraceSampler) {
+	traceSamplerMu.Lock()
+	traceSampler = sampler
+	traceSamplerMu.Unlock()
+}
+
+func isTraceSampled(traceInfo TraceInfo, rpcName string) bool {
+	traceSamplerMu.RLock()
+	sampler := traceSampler
+	traceSamplerMu.RUnlock()
+
+	return sampler == nil || sampler(traceInfo, rpcName)
+}
+
+// NewRateTraceSampler returns a TraceSampler, which logs the given
+// fraction of traces (0.01 = 1%). The decision is sticky per trace id.
+func NewRateTraceSampler(rate float64) TraceSampler {
+	return func(traceInfo TraceInfo, rpcName string) bool {
+		return isTraceIDSampled(traceInfo.trace, rate)
+	}
+}
+
+// NewRPCTraceSampler returns a TraceSampler, which logs the fraction
+// of traces given for the pattern matching the RPC name, e.g.
+// {"payment.*": 1, "health.*": 0.001}. Patterns are matched with
+// path.Match, the longest matching one wins. Other RPCs are logged
+// with defaultRate. The decision is sticky per trace id and RPC name,
+// so a trace might lose the spans of RPCs sampled at a lower rate.
+func NewRPCTraceSampler(rates map[string]float64, defaultRate float64) TraceSampler {
+	patterns := make(rpcPatterns, 0, len(rates))
+	copied := make(map[string]float64, len(rates))
+	for pattern, rate := range rates {
+		patterns = append(patterns, pattern)
+		copied[pattern] = rate
+	}
+	sort.Sort(patterns)
+
+	return func(traceInfo TraceInfo, rpcName string) bool {
+		rate := defaultRate
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, rpcName); matched {
+				rate = copied[pattern]
+				break
+			}
+		}
+		return isTraceIDSampled(traceInfo.trace, rate)
+	}
+}
+
+// rpcPatterns sorts the longest patterns first
+type rpcPatterns []string
+
+func (p rpcPatterns) Len() int      { return len(p) }
+func (p rpcPatterns) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p rpcPatterns) Less(i, j int) bool {
+	if len(p[i]) != len(p[j]) {
+		return len(p[i]) > len(p[j])
+	}
+	return p[i] < p[j]
+}
+
+func isTraceIDSampled(id uint64, rate float64) bool {
+	switch {
+	case rate <= 0:
+		return false
+	case rate >= 1:
+		return true
+	}
+
+	// trace ids are not guaranteed to be distributed uniformly
+	// over the whole uint64 range (e.g. rand.Int63), so mix them
+	return mixTraceID(id) < uint64(rate*math.MaxUint64)
+}
+
+// mixTraceID is a finalizer of splitmix64
+func mixTraceID(id uint64) uint64 {
+	id ^= id >> 30
+	id *= 0xbf58476d1ce4e5b9
+	id ^= id >> 27
+	id *= 0x94d049bb133111eb
+	id ^= id >> 31
+	return id
+}
+
+// TraceInfo describes a span: the trace it belongs to,
+// its own id and the id of the parent span
 type TraceInfo struct {
 	trace, span, parent uint64
+	// traceHi is the high 64 bits of a 128-bit trace id.
+	// It's 0 for 64-bit ids.
+	traceHi uint64
+}
+
+// NewTraceInfo creates TraceInfo from the given ids.
+// It might be used to continue a trace started outside of Cocaine.
+func NewTraceInfo(trace, span, parent uint64) TraceInfo {
+	return TraceInfo{
+		trace:  trace,
+		span:   span,
+		parent: parent,
+	}
+}
+
+// NewTraceInfo128 creates TraceInfo with a 128-bit trace id,
+// which is split into the high and the low 64 bits.
+func NewTraceInfo128(traceHi, trace, span, parent uint64) TraceInfo {
+	return TraceInfo{
+		trace:   trace,
+		span:    span,
+		parent:  parent,
+		traceHi: traceHi,
+	}
+}
+
+// TraceID returns the id of the trace. It's the low 64 bits
+// of a 128-bit trace id.
+func (t TraceInfo) TraceID() uint64 {
+	return t.trace
+}
+
+// TraceIDHigh returns the high 64 bits of the trace id.
+// It's 0 for 64-bit trace ids.
+func (t TraceInfo) TraceIDHigh() uint64 {
+	return t.traceHi
+}
+
+// traceIDHex formats the trace id in hex. A 128-bit id
+// is formatted as 32 hex chars.
+func (t TraceInfo) traceIDHex() string {
+	if t.traceHi != 0 {
+		return TraceIDHex.encode128(t.traceHi, t.trace)
+	}
+	return fmt.Sprintf("%x", t.trace)
+}
+
+// SpanID returns the id of the span
+func (t TraceInfo) SpanID() uint64 {
+	return t.span
+}
+
+// ParentID returns the id of the parent span. It's 0 for a root span.
+func (t TraceInfo) ParentID() uint64 {
+	return t.parent
+}
+
+// String formats the ids in hex the same way as they're logged
+func (t TraceInfo) String() string {
+	return fmt.Sprintf("trace_id=%s span_id=%x parent_id=%x", t.traceIDHex(), t.span, t.parent)
+}
+
+// TraceInfoFromContext returns TraceInfo attached to the context
+func TraceInfoFromContext(ctx context.Context) (TraceInfo, bool) {
+	if traceInfo := getTraceInfo(ctx); traceInfo != nil {
+		return *traceInfo, true
+	}
+	return TraceInfo{}, false
+}
+
+// TraceIDFromContext returns the trace id of the context encoded
+// the same way as in span records (hex by default, see SetTraceFieldConfig).
+// It allows to return the id to clients, e.g. in an HTTP header.
+func TraceIDFromContext(ctx context.Context) (string, bool) {
+	traceInfo := getTraceInfo(ctx)
+	if traceInfo == nil {
+		return "", false
+	}
+
+	encoding := getTraceSettings().fieldConfig.Encoding
+	if traceInfo.traceHi != 0 {
+		return encoding.encode128(traceInfo.traceHi, traceInfo.trace), true
+	}
+	return encoding.encode(traceInfo.trace), true
+}
+
+// SpanIDFromContext returns the span id of the context encoded
+// the same way as in span records
+func SpanIDFromContext(ctx context.Context) (string, bool) {
+	traceInfo := getTraceInfo(ctx)
+	if traceInfo == nil {
+		return "", false
+	}
+
+	return getTraceSettings().fieldConfig.Encoding.encode(traceInfo.span), true
 }
 
 type traced struct {
 	context.Context
 	traceInfo TraceInfo
 	startTime time.Time
+	// baggage is never modified, WithBaggage makes a copy
+	baggage map[string]string
 }
 
 func (t *traced) Value(key interface{}) interface{} {
@@ -62,6 +378,11 @@ func (t *traced) Value(key interface{}) interface{} {
 		return t.traceInfo
 	case TraceStartTimeValue:
 		return t.startTime
+	case TraceBaggageValue:
+		if t.baggage != nil {
+			return t.baggage
+		}
+		return t.Context.Value(key)
 	default:
 		return t.Context.Value(key)
 	}
@@ -69,7 +390,38 @@ func (t *traced) Value(key interface{}) interface{} {
 
 // It might be used in client applications.
 func BeginNewTraceContext(ctx context.Context) context.Context {
-	ts := uint64(rand.Int63())
+	ts := nextTraceID()
+	return AttachTraceInfo(ctx, TraceInfo{
+		trace:  ts,
+		span:   ts,
+		parent: 0,
+	})
+}
+
+// BeginNewTraceContext128 starts a new trace with a 128-bit trace id.
+// The span id equals the low 64 bits of the trace id.
+func BeginNewTraceContext128(ctx context.Context) context.Context {
+	ts := nextTraceID()
+	return AttachTraceInfo(ctx, TraceInfo{
+		trace:   ts,
+		span:    ts,
+		parent:  0,
+		traceHi: nextTraceID(),
+	})
+}
+
+// BeginNewTraceContextSampled starts a new trace with the given probability (0.0-1.0).
+// Otherwise the context is returned unchanged, so no spans are started
+// for the whole request.
+func BeginNewTraceContextSampled(ctx context.Context, probability float64) context.Context {
+	ts := nextTraceID()
+	if !isTraceIDSampled(ts, probability) {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		return ctx
+	}
+
 	return AttachTraceInfo(ctx, TraceInfo{
 		trace:  ts,
 		span:   ts,
@@ -88,13 +440,83 @@ func AttachTraceInfo(ctx context.Context, traceInfo TraceInfo) context.Context {
 		Context:   ctx,
 		traceInfo: traceInfo,
 		startTime: time.Now(),
+		baggage:   getBaggage(ctx),
+	}
+}
+
+func getBaggage(ctx context.Context) map[string]string {
+	baggage, _ := ctx.Value(TraceBaggageValue).(map[string]string)
+	return baggage
+}
+
+// WithBaggage returns a context carrying the key/value pair along the trace.
+// Baggage items are logged with every span started from the context.
+func WithBaggage(ctx context.Context, key, value string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// copy on write keeps the baggage of sibling spans intact
+	parent := getBaggage(ctx)
+	baggage := make(map[string]string, len(parent)+1)
+	for k, v := range parent {
+		baggage[k] = v
+	}
+	baggage[key] = value
+
+	traceInfo := getTraceInfo(ctx)
+	if traceInfo == nil {
+		return context.WithValue(ctx, TraceBaggageValue, baggage)
+	}
+
+	startTime, _ := ctx.Value(TraceStartTimeValue).(time.Time)
+	return &traced{
+		Context:   ctx,
+		traceInfo: *traceInfo,
+		startTime: startTime,
+		baggage:   baggage,
 	}
 }
 
+// BaggageFromContext returns a copy of the baggage items of the context
+func BaggageFromContext(ctx context.Context) map[string]string {
+	baggage := getBaggage(ctx)
+	result := make(map[string]string, len(baggage))
+	for k, v := range baggage {
+		result[k] = v
+	}
+	return result
+}
+
+// BaggageItem returns the baggage item of the context
+// or an empty string if there is no such item
+func BaggageItem(ctx context.Context, key string) string {
+	return getBaggage(ctx)[key]
+}
+
 // CleanTraceInfo might be used to clear context instance from trace info
 // to disable tracing in some RPC calls to get rid of overhead
 func CleanTraceInfo(ctx context.Context) context.Context {
-	return context.WithValue(ctx, TraceInfoValue, nil)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return untraced{ctx}
+}
+
+// untraced hides TraceInfo and the start time of the parent context.
+// Baggage is still passed downstream.
+type untraced struct {
+	context.Context
+}
+
+func (u untraced) Value(key interface{}) interface{} {
+	switch key {
+	case TraceInfoValue, TraceStartTimeValue:
+		return nil
+	default:
+		return u.Context.Value(key)
+	}
 }
 
 // WithTrace starts new span and returns a context with attached TraceInfo and Done.
@@ -102,58 +524,73 @@ func CleanTraceInfo(ctx context.Context) context.Context {
 // so it's user responsibility to make sure that the context has TraceInfo.
 // Anyway it safe to call CloseSpan function even in this case, it actually does nothing.
 func WithTrace(ctx context.Context, rpcName string) (context.Context, func(format string, args ...interface{})) {
-	if ctx == nil {
-		// I'm not sure it is a valid action.
-		// According to the rule "no trace info, no new span"
-		// to support sampling, nil Context has no TraceInfo, so
-		// it cannot start new Span.
-		return context.Background(), closeDummySpan
+	ctx, sp := StartSpan(ctx, rpcName)
+	if sp == nil {
+		return ctx, closeDummySpan
 	}
 
-	traceInfo := getTraceInfo(ctx)
-	if traceInfo == nil {
-		// given context has no TraceInfo
-		// so we can't start new trace to support sampling.
-		// closeDummySpan does nohing
+	return ctx, sp.Close
+}
+
+// WithFollowsFromTrace starts new span like WithTrace, but the span
+// follows from the span of the context instead of being its child.
+// It's intended for asynchronous work, which duration should not be
+// attributed to the caller. The span is logged with ref_type field.
+func WithFollowsFromTrace(ctx context.Context, rpcName string) (context.Context, func(format string, args ...interface{})) {
+	ctx, sp := StartFollowsFromSpan(ctx, rpcName)
+	if sp == nil {
 		return ctx, closeDummySpan
 	}
 
-	// startTime is not used only to log the start of an RPC
-	// It's stored in Context to calculate the RPC call duration.
-	// A user can get it via Context.Value(TraceStartTimeValue)
-	startTime := time.Now()
+	return ctx, sp.Close
+}
 
-	// Tracing magic:
-	// * the previous span becomes our parent
-	// * new span is set as random number
-	// * trace still stays the same
-	traceInfo.parent = traceInfo.span
-	traceInfo.span = uint64(rand.Int63())
+// WithTraceAt works like WithTrace, but the span starts at the given time,
+// so the duration is computed from it. It allows to back-date spans,
+// e.g. when events are replayed from a queue. The zero time means now.
+func WithTraceAt(ctx context.Context, rpcName string, startTime time.Time) (context.Context, func(format string, args ...interface{})) {
+	ctx, sp := StartSpanAt(ctx, rpcName, startTime)
+	if sp == nil {
+		return ctx, closeDummySpan
+	}
 
-	traceLog().WithFields(Fields{
-		"trace_id":  fmt.Sprintf("%x", traceInfo.trace),
-		"span_id":   fmt.Sprintf("%x", traceInfo.span),
-		"parent_id": fmt.Sprintf("%x", traceInfo.parent),
-		"timestamp": startTime.UnixNano(),
-		"RPC":       rpcName,
-	}).Infof("start")
+	return ctx, sp.Close
+}
 
-	ctx = &traced{
-		Context:   ctx,
-		traceInfo: *traceInfo,
-		startTime: startTime,
+// WithTraceFinish works like WithTrace, but the returned FinishSpan
+// allows to mark the span as failed and to attach additional fields
+// to the closing log record.
+func WithTraceFinish(ctx context.Context, rpcName string) (context.Context, FinishSpan) {
+	ctx, sp := StartSpan(ctx, rpcName)
+	if sp == nil {
+		return ctx, finishDummySpan
+	}
+
+	return ctx, sp.finish
+}
+
+// SpanEvent logs an intermediate event of the span attached to the context
+// with its ids, "event" field and "elapsed_us" since the span started.
+// It does nothing if the context has no TraceInfo.
+func SpanEvent(ctx context.Context, msg string, fields Fields) {
+	if ctx == nil {
+		return
+	}
+
+	traceInfo, ok := ctx.Value(TraceInfoValue).(TraceInfo)
+	if !ok {
+		return
 	}
 
-	return ctx, func(format string, args ...interface{}) {
-		now := time.Now()
-		duration := now.Sub(startTime)
-		traceLog().WithFields(Fields{
-			"trace_id":  fmt.Sprintf("%x", traceInfo.trace),
-			"span_id":   fmt.Sprintf("%x", traceInfo.span),
-			"parent_id": fmt.Sprintf("%x", traceInfo.parent),
-			"timestamp": now.UnixNano(),
-			"duration":  duration.Nanoseconds() / 1000,
-			"RPC":       rpcName,
-		}).Infof(format, args...)
+	record := make(Fields, len(fields)+5)
+	for k, v := range fields {
+		record[k] = v
 	}
+	setTraceFields(record, traceInfo)
+	record["event"] = msg
+	if startTime, ok := ctx.Value(TraceStartTimeValue).(time.Time); ok {
+		record["elapsed_us"] = time.Since(startTime).Nanoseconds() / int64(time.Microsecond)
+	}
+
+	emitTraceRecord(InfoLevel, record, msg, time.Now())
 }
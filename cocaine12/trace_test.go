@@ -1,9 +1,854 @@
 package cocaine12
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
+func TestRateTraceSampler(t *testing.T) {
+	const traces = 10000
+
+	sampler := NewRateTraceSampler(0.1)
+	sampled := 0
+	for i := uint64(1); i <= traces; i++ {
+		traceInfo := TraceInfo{trace: i, span: i, parent: 0}
+		decision := sampler(traceInfo, "rpc")
+		if decision {
+			sampled++
+		}
+
+		// the decision must be sticky per trace id
+		traceInfo.parent, traceInfo.span = traceInfo.span, i+traces
+		assert.Equal(t, decision, sampler(traceInfo, "anotherrpc"))
+	}
+	assert.True(t, sampled > traces/20 && sampled < traces/5, "sampled %d", sampled)
+
+	assert.False(t, NewRateTraceSampler(0)(TraceInfo{trace: 1}, "rpc"))
+	assert.True(t, NewRateTraceSampler(1)(TraceInfo{trace: 1}, "rpc"))
+}
+
+func TestWithTraceNotSampled(t *testing.T) {
+	SetTraceSampler(NewRateTraceSampler(0))
+	defer SetTraceSampler(nil)
+
+	ctx := BeginNewTraceContext(nil)
+	spanCtx, _ := WithTrace(ctx, "rpc")
+	// TraceInfo is propagated unchanged
+	assert.Equal(t, ctx, spanCtx)
+}
+
+func TestRPCTraceSampler(t *testing.T) {
+	sampler := NewRPCTraceSampler(map[string]float64{
+		"payment.*":     1,
+		"payment.debug": 0,
+		"health.*":      0,
+	}, 1)
+
+	traceInfo := NewTraceInfo(1, 2, 0)
+	assert.True(t, sampler(traceInfo, "payment.charge"))
+	assert.False(t, sampler(traceInfo, "payment.debug"))
+	assert.False(t, sampler(traceInfo, "health.ping"))
+	assert.True(t, sampler(traceInfo, "search"))
+
+	SetTraceSampler(sampler)
+	defer SetTraceSampler(nil)
+
+	ctx := BeginNewTraceContext(nil)
+	spanCtx, closeSpan := WithTrace(ctx, "health.ping")
+	assert.Equal(t, ctx, spanCtx)
+	closeSpan("done")
+}
+
+type testLogRecord struct {
+	level  Severity
+	fields Fields
+	msg    string
+}
+
+// testRecordLogger keeps all records in memory
+type testRecordLogger struct {
+	mu      sync.Mutex
+	records []testLogRecord
+}
+
+func (r *testRecordLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {
+	r.mu.Lock()
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	r.records = append(r.records, testLogRecord{level, fields, msg})
+	r.mu.Unlock()
+}
+
+func (r *testRecordLogger) Records() []testLogRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]testLogRecord(nil), r.records...)
+}
+
+func (r *testRecordLogger) WithFields(fields Fields) *Entry {
+	return &Entry{Logger: r, Fields: fields}
+}
+
+func (r *testRecordLogger) WithError(err error) *Entry {
+	return &Entry{Logger: r, Fields: errorFields(nil, err)}
+}
+
+func (r *testRecordLogger) WithContext(ctx context.Context) *Entry {
+	return &Entry{Logger: r, Fields: contextFields(nil, ctx)}
+}
+
+func (r *testRecordLogger) Verbosity(context.Context) Severity   { return DebugLevel }
+func (r *testRecordLogger) V(level Severity) bool                { return true }
+func (r *testRecordLogger) WatchVerbosity(context.Context)       {}
+func (r *testRecordLogger) SetReportCaller(bool)                 {}
+func (r *testRecordLogger) SetCallerSkip(int)                    {}
+func (r *testRecordLogger) AddHook(Hook)                         {}
+func (r *testRecordLogger) WithSource(string) Logger             { return r }
+func (r *testRecordLogger) WithPersistentFields(f Fields) Logger { return r.WithFields(f) }
+func (r *testRecordLogger) SetRateLimit(int, time.Duration)      {}
+func (r *testRecordLogger) SetDebugSampling(int)                 {}
+func (r *testRecordLogger) Flush(context.Context) error          { return nil }
+func (r *testRecordLogger) SetErrorHandler(func(error))          {}
+func (r *testRecordLogger) Errors() <-chan error                 { return nil }
+func (r *testRecordLogger) Close()                               {}
+
+func (r *testRecordLogger) Batch() *LogBatch {
+	return NewLogBatch(r)
+}
+
+func (r *testRecordLogger) Writer(level Severity) io.WriteCloser {
+	return newLogWriter(r, level, nil)
+}
+
+func (r *testRecordLogger) Errf(format string, args ...interface{}) {
+	r.log(ErrorLevel, defaultFields, format, args...)
+}
+func (r *testRecordLogger) Err(args ...interface{}) {
+	r.log(ErrorLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+func (r *testRecordLogger) Warnf(format string, args ...interface{}) {
+	r.log(WarnLevel, defaultFields, format, args...)
+}
+func (r *testRecordLogger) Warn(args ...interface{}) {
+	r.log(WarnLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+func (r *testRecordLogger) Infof(format string, args ...interface{}) {
+	r.log(InfoLevel, defaultFields, format, args...)
+}
+func (r *testRecordLogger) Info(args ...interface{}) {
+	r.log(InfoLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+func (r *testRecordLogger) Debugf(format string, args ...interface{}) {
+	r.log(DebugLevel, defaultFields, format, args...)
+}
+func (r *testRecordLogger) Debug(args ...interface{}) {
+	r.log(DebugLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+func (r *testRecordLogger) Logf(level Severity, format string, args ...interface{}) {
+	r.log(level, defaultFields, format, args...)
+}
+func (r *testRecordLogger) Log(level Severity, args ...interface{}) {
+	r.log(level, defaultFields, "%s", fmt.Sprint(args...))
+}
+func (r *testRecordLogger) Tracef(format string, args ...interface{}) {
+	r.log(TraceLevel, defaultFields, format, args...)
+}
+func (r *testRecordLogger) Trace(args ...interface{}) {
+	r.log(TraceLevel, defaultFields, "%s", fmt.Sprint(args...))
+}
+func (r *testRecordLogger) Fatalf(format string, args ...interface{}) {
+	r.log(FatalLevel, defaultFields, format, args...)
+	exit(1)
+}
+func (r *testRecordLogger) Fatal(args ...interface{}) {
+	r.log(FatalLevel, defaultFields, "%s", fmt.Sprint(args...))
+	exit(1)
+}
+func (r *testRecordLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	r.log(ErrorLevel, defaultFields, "%s", msg)
+	panic(msg)
+}
+func (r *testRecordLogger) Panic(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	r.log(ErrorLevel, defaultFields, "%s", msg)
+	panic(msg)
+}
+
+// withTestTraceLogger sets testRecordLogger as the trace logger
+// and returns a function restoring the previous one
+func withTestTraceLogger() (*testRecordLogger, func()) {
+	previous := TraceLogger()
+	logger := &testRecordLogger{}
+	SetTraceLogger(logger)
+	return logger, func() { SetTraceLogger(previous) }
+}
+
+func TestWithTraceFinish(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+	_, finish := WithTraceFinish(ctx, "rpc")
+	finish(errors.New("failure"), Fields{"attempt": 2, "trace_id": "x"}, "done %d", 1)
+
+	records := logger.Records()
+	if !assert.Equal(t, 2, len(records)) {
+		t.FailNow()
+	}
+	assert.Equal(t, "start", records[0].msg)
+	assert.Equal(t, "rpc", records[0].fields["RPC"])
+
+	closeRecord := records[1]
+	assert.Equal(t, WarnLevel, closeRecord.level)
+	assert.Equal(t, "done 1", closeRecord.msg)
+	assert.Equal(t, "failure", closeRecord.fields["error"])
+	assert.Equal(t, 2, closeRecord.fields["attempt"])
+	assert.Equal(t, "1", closeRecord.fields["trace_id"])
+	assert.Equal(t, "2", closeRecord.fields["parent_id"])
+
+	// the old signature does not mark spans as failed
+	_, closeSpan := WithTrace(ctx, "rpc")
+	closeSpan("done")
+	records = logger.Records()
+	_, hasError := records[3].fields["error"]
+	assert.False(t, hasError)
+	assert.Equal(t, InfoLevel, records[3].level)
+}
+
+func TestWithTraceEmittedFields(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(0xa, 0xb, 0))
+	ctx, closeSpan := WithTrace(ctx, "rpc")
+	closeSpan("finished %s", "rpc")
+	traceInfo, _ := TraceInfoFromContext(ctx)
+
+	records := logger.Records()
+	if !assert.Equal(t, 2, len(records)) {
+		t.FailNow()
+	}
+
+	for _, record := range records {
+		assert.Equal(t, InfoLevel, record.level)
+		assert.Equal(t, "a", record.fields["trace_id"])
+		assert.Equal(t, fmt.Sprintf("%x", traceInfo.span), record.fields["span_id"])
+		assert.Equal(t, "b", record.fields["parent_id"])
+		assert.Equal(t, "rpc", record.fields["RPC"])
+		assert.NotNil(t, record.fields["timestamp"])
+	}
+
+	assert.Equal(t, "start", records[0].msg)
+	assert.Equal(t, "finished rpc", records[1].msg)
+	assert.NotNil(t, records[1].fields["duration"])
+}
+
+func TestTraceLogStart(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	SetTraceLogStart(false)
+	defer SetTraceLogStart(true)
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 1, 0))
+	startTime := time.Now().Add(-time.Second)
+	_, closeSpan := WithTraceAt(ctx, "rpc", startTime)
+	closeSpan("done")
+
+	records := logger.Records()
+	if !assert.Equal(t, 1, len(records)) {
+		t.FailNow()
+	}
+	assert.Equal(t, "done", records[0].msg)
+	assert.Equal(t, startTime.UnixNano(), records[0].fields["start_timestamp"])
+	assert.True(t, records[0].fields["duration_us"].(int64) >= int64(time.Second/time.Microsecond))
+}
+
+func TestTraceGoroutineID(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 1, 0))
+	_, closeSpan := WithTrace(ctx, "rpc")
+	closeSpan("done")
+
+	SetTraceGoroutineID(true)
+	defer SetTraceGoroutineID(false)
+
+	ids := make(chan uint64, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ids <- goroutineID()
+			_, closeSpan := WithTrace(ctx, "rpc")
+			closeSpan("done")
+		}()
+	}
+	first, second := <-ids, <-ids
+	assert.NotEqual(t, first, second)
+
+	records := logger.Records()
+	if !assert.Equal(t, 6, len(records)) {
+		t.FailNow()
+	}
+	_, ok := records[0].fields["goroutine_id"]
+	assert.False(t, ok)
+	for _, record := range records[2:] {
+		id := record.fields["goroutine_id"]
+		assert.True(t, id == first || id == second, "unexpected goroutine id %v", id)
+	}
+}
+
+func TestTraceDurationUnit(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	SetTraceDurationUnit(time.Millisecond)
+	SetTraceLegacyDuration(false)
+	defer func() {
+		SetTraceDurationUnit(time.Microsecond)
+		SetTraceLegacyDuration(true)
+	}()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 1, 0))
+	_, closeSpan := WithTrace(ctx, "rpc")
+	closeSpan("done")
+
+	closeRecord := logger.Records()[1]
+	assert.IsType(t, int64(0), closeRecord.fields["duration_ms"])
+	assert.NotNil(t, closeRecord.fields["start_timestamp"])
+	_, hasLegacy := closeRecord.fields["duration"]
+	assert.False(t, hasLegacy)
+}
+
+func TestWithTraceAt(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	SetTraceDurationUnit(time.Millisecond)
+	SetTraceLegacyDuration(false)
+	defer func() {
+		SetTraceDurationUnit(time.Microsecond)
+		SetTraceLegacyDuration(true)
+	}()
+
+	startTime := time.Now().Add(-time.Hour)
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 1, 0))
+	spanCtx, closeSpan := WithTraceAt(ctx, "replay", startTime)
+	assert.Equal(t, startTime, spanCtx.Value(TraceStartTimeValue))
+	closeSpan("done")
+
+	duration := logger.Records()[1].fields["duration_ms"].(int64)
+	assert.True(t, duration >= time.Hour.Nanoseconds()/int64(time.Millisecond))
+
+	// the zero time means now
+	spanCtx, closeSpan = WithTraceAt(ctx, "now", time.Time{})
+	closeSpan("done")
+	assert.WithinDuration(t, time.Now(), spanCtx.Value(TraceStartTimeValue).(time.Time), time.Minute)
+}
+
+func TestSpanEvent(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	SpanEvent(context.Background(), "cache miss", nil)
+	assert.Equal(t, 0, len(logger.Records()))
+	allocs := testing.AllocsPerRun(100, func() {
+		SpanEvent(context.Background(), "cache miss", nil)
+	})
+	assert.Equal(t, float64(0), allocs)
+
+	ctx, closeSpan := WithTraceAt(AttachTraceInfo(nil, NewTraceInfo(1, 2, 0)), "rpc",
+		time.Now().Add(-time.Second))
+	SpanEvent(ctx, "retry 2", Fields{"attempt": 2})
+	closeSpan("done")
+
+	records := logger.Records()
+	if assert.Equal(t, 3, len(records)) {
+		event := records[1]
+		assert.Equal(t, "retry 2", event.msg)
+		assert.Equal(t, "retry 2", event.fields["event"])
+		assert.Equal(t, 2, event.fields["attempt"])
+		assert.Equal(t, "1", event.fields["trace_id"])
+		assert.Equal(t, "2", event.fields["parent_id"])
+		assert.True(t, event.fields["elapsed_us"].(int64) >= int64(time.Second/time.Microsecond))
+	}
+}
+
+func TestWithFollowsFromTrace(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+	ctx, closeSpan := WithFollowsFromTrace(ctx, "warmup")
+	closeSpan("done")
+
+	traceInfo, _ := TraceInfoFromContext(ctx)
+	assert.Equal(t, uint64(1), traceInfo.trace)
+	assert.Equal(t, uint64(2), traceInfo.parent)
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		for _, record := range records {
+			assert.Equal(t, "follows_from", record.fields["ref_type"])
+		}
+	}
+}
+
+func TestTraceIDFromContext(t *testing.T) {
+	_, ok := TraceIDFromContext(context.Background())
+	assert.False(t, ok)
+	spanID, ok := SpanIDFromContext(context.Background())
+	assert.False(t, ok)
+	assert.Equal(t, "", spanID)
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(255, 16, 0))
+	traceID, ok := TraceIDFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "ff", traceID)
+	spanID, _ = SpanIDFromContext(ctx)
+	assert.Equal(t, "10", spanID)
+
+	ctx = AttachTraceInfo(nil, NewTraceInfo128(1, 2, 3, 0))
+	traceID, _ = TraceIDFromContext(ctx)
+	assert.Equal(t, "00000000000000010000000000000002", traceID)
+}
+
+func TestTraceBaggage(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	ctx := WithBaggage(nil, "user", "42")
+	ctx = AttachTraceInfo(ctx, NewTraceInfo(1, 2, 0))
+	assert.Equal(t, map[string]string{"user": "42"}, BaggageFromContext(ctx))
+
+	sibling1 := WithBaggage(ctx, "bucket", "a")
+	sibling2 := WithBaggage(ctx, "bucket", "b")
+	assert.Equal(t, "a", BaggageFromContext(sibling1)["bucket"])
+	assert.Equal(t, "b", BaggageFromContext(sibling2)["bucket"])
+	assert.Equal(t, map[string]string{"user": "42"}, BaggageFromContext(ctx))
+
+	BaggageFromContext(ctx)["user"] = "0"
+	assert.Equal(t, "42", BaggageFromContext(ctx)["user"])
+
+	traceInfo, ok := TraceInfoFromContext(sibling1)
+	assert.True(t, ok)
+	assert.Equal(t, NewTraceInfo(1, 2, 0), traceInfo)
+
+	child, closeSpan := WithTrace(sibling1, "call")
+	assert.Equal(t, "a", BaggageItem(child, "bucket"))
+	assert.Equal(t, "", BaggageItem(child, "missing"))
+	assert.Equal(t, "", BaggageItem(context.Background(), "user"))
+	closeSpan("done")
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		for _, record := range records {
+			assert.Equal(t, "42", record.fields["user"])
+			assert.Equal(t, "a", record.fields["bucket"])
+		}
+	}
+}
+
+func TestWithTraceDeadline(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	root := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+
+	ctx, cancel := context.WithTimeout(root, time.Hour)
+	defer cancel()
+	_, closeSpan := WithTrace(ctx, "call")
+	closeSpan("done")
+
+	expired, cancelExpired := context.WithDeadline(root, time.Now().Add(-time.Second))
+	defer cancelExpired()
+	_, closeSpan = WithTrace(expired, "late")
+	closeSpan("done")
+
+	records := logger.Records()
+	if assert.Equal(t, 4, len(records)) {
+		for _, record := range records[:2] {
+			assert.Contains(t, record.fields, "deadline_ns")
+			assert.True(t, record.fields["budget_ns"].(int64) > 0)
+			assert.NotContains(t, record.fields, "deadline_exceeded")
+		}
+		for _, record := range records[2:] {
+			assert.True(t, record.fields["budget_ns"].(int64) < 0)
+			assert.Equal(t, true, record.fields["deadline_exceeded"])
+		}
+	}
+}
+
+func TestSetTraceBatching(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	SetTraceBatching(3, time.Hour)
+	defer SetTraceBatching(0, 0)
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+	_, closeSpan := WithTrace(ctx, "first")
+	closeSpan("done")
+	assert.Equal(t, 0, len(logger.Records()))
+
+	_, closeSpan = WithTrace(ctx, "second")
+	records := logger.Records()
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, "first", records[0].fields["RPC"])
+		assert.Equal(t, "second", records[2].fields["RPC"])
+	}
+
+	closeSpan("done")
+	FlushTraces()
+	assert.Equal(t, 4, len(logger.Records()))
+
+	SetTraceBatching(100, time.Millisecond)
+	WithTrace(ctx, "delayed")
+	for i := 0; i < 100 && len(logger.Records()) == 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 5, len(logger.Records()))
+}
+
+func TestWithTraceConcurrentSiblings(t *testing.T) {
+	const siblings = 100
+
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	parent := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+
+	var wg sync.WaitGroup
+	spans := make([]uint64, siblings)
+	for i := 0; i < siblings; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, closeSpan := WithTrace(parent, "sibling")
+			traceInfo, _ := TraceInfoFromContext(ctx)
+			spans[i] = traceInfo.SpanID()
+			closeSpan("done")
+		}(i)
+	}
+	wg.Wait()
+
+	closed := make(map[string]bool)
+	for _, record := range logger.Records() {
+		assert.Equal(t, "1", record.fields["trace_id"])
+		assert.Equal(t, "2", record.fields["parent_id"])
+		if record.msg == "done" {
+			closed[record.fields["span_id"].(string)] = true
+		}
+	}
+
+	assert.Equal(t, siblings, len(closed))
+	for _, span := range spans {
+		assert.True(t, closed[fmt.Sprintf("%x", span)])
+	}
+}
+
+func TestWithTraceContextError(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	root := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+
+	ctx, cancel := context.WithTimeout(root, time.Millisecond)
+	defer cancel()
+	ctx, closeSpan := WithTrace(ctx, "timeout")
+	<-ctx.Done()
+	closeSpan("done")
+
+	ctx, cancel = context.WithCancel(root)
+	_, closeSpan = WithTrace(ctx, "cancel")
+	cancel()
+	closeSpan("done")
+
+	_, closeSpan = WithTrace(root, "success")
+	closeSpan("done")
+
+	records := logger.Records()
+	if assert.Equal(t, 6, len(records)) {
+		assert.Equal(t, context.DeadlineExceeded.Error(), records[1].fields["ctx_error"])
+		assert.Equal(t, true, records[1].fields["deadline_exceeded"])
+
+		assert.Equal(t, context.Canceled.Error(), records[3].fields["ctx_error"])
+		assert.NotContains(t, records[3].fields, "deadline_exceeded")
+
+		assert.NotContains(t, records[5].fields, "ctx_error")
+	}
+}
+
+func TestSetTraceFieldConfig(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+	defer SetTraceFieldConfig(DefaultTraceFieldConfig)
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(255, 1, 0))
+
+	SetTraceFieldConfig(TraceFieldConfig{TraceKey: "trace", Encoding: TraceIDDecimal})
+	_, closeSpan := WithTrace(ctx, "decimal")
+	closeSpan("done")
+
+	SetTraceFieldConfig(TraceFieldConfig{Encoding: TraceIDBase64})
+	_, closeSpan = WithTrace(ctx, "base64")
+	closeSpan("done")
+
+	records := logger.Records()
+	if assert.Equal(t, 4, len(records)) {
+		assert.Equal(t, "255", records[1].fields["trace"])
+		assert.Equal(t, "1", records[1].fields["parent_id"])
+		assert.NotContains(t, records[1].fields, "trace_id")
+
+		assert.Equal(t, "AAAAAAAAAP8=", records[3].fields["trace_id"])
+		assert.Equal(t, "AAAAAAAAAAE=", records[3].fields["parent_id"])
+	}
+}
+
+func TestSetTraceFallbackSink(t *testing.T) {
+	previous := TraceLogger()
+	defer SetTraceLogger(previous)
+	defer SetTraceFallbackSink(nil)
+
+	var buf bytes.Buffer
+	traceLoggerMu.Lock()
+	useTraceFallbackLocked()
+	traceLoggerMu.Unlock()
+	SetTraceFallbackSink(&buf)
+
+	_, closeSpan := WithTrace(AttachTraceInfo(nil, NewTraceInfo(1, 2, 0)), "call")
+	closeSpan("done")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Equal(t, 2, len(lines)) {
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+		assert.Equal(t, "done", record["message"])
+		assert.Equal(t, "INFO", record["level"])
+		assert.Equal(t, "call", record["RPC"])
+		assert.Equal(t, "1", record["trace_id"])
+	}
+
+	// SetTraceLogger disables the fallback
+	SetTraceLogger(nil)
+	SetTraceFallbackSink(&buf)
+	assert.Equal(t, NewNopLogger(), TraceLogger())
+}
+
+func TestCleanTraceInfo(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	isDummy := func(closeSpan func(string, ...interface{})) bool {
+		return reflect.ValueOf(closeSpan).Pointer() == reflect.ValueOf(closeDummySpan).Pointer()
+	}
+
+	cleaned := CleanTraceInfo(AttachTraceInfo(nil, NewTraceInfo(1, 2, 0)))
+	assert.Nil(t, cleaned.Value(TraceStartTimeValue))
+	_, closeSpan := WithTrace(cleaned, "cleaned")
+	assert.True(t, isDummy(closeSpan))
+	closeSpan("done")
+	assert.Equal(t, 0, len(logger.Records()))
+
+	traced := AttachTraceInfo(CleanTraceInfo(context.Background()), NewTraceInfo(1, 2, 0))
+	_, closeSpan = WithTrace(traced, "traced")
+	assert.False(t, isDummy(closeSpan))
+	closeSpan("done")
+	assert.Equal(t, 2, len(logger.Records()))
+}
+
+func TestSpanSetTag(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	_, sp := StartSpan(BeginNewTraceContext(nil), "rpc")
+	sp.SetTag("http.status_code", 200)
+	sp.Close("done")
+	sp.SetTag("late", true)
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, 200, records[1].fields["http.status_code"])
+		_, hasLate := records[1].fields["late"]
+		assert.False(t, hasLate)
+	}
+
+	// no TraceInfo, no Span
+	_, sp = StartSpan(context.Background(), "rpc")
+	assert.Nil(t, sp)
+	sp.SetTag("key", "value")
+	sp.Close("done")
+}
+
+type testSpanObserver struct {
+	started, finished []TraceInfo
+	lastErr           error
+}
+
+func (o *testSpanObserver) StartSpan(rpcName string, traceInfo TraceInfo, startTime time.Time, fields Fields) {
+	o.started = append(o.started, traceInfo)
+}
+
+func (o *testSpanObserver) FinishSpan(rpcName string, traceInfo TraceInfo, startTime, finishTime time.Time,
+	err error, fields Fields, msg string) {
+	o.finished = append(o.finished, traceInfo)
+	o.lastErr = err
+}
+
+func TestSpanLogEventFinish(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	_, sp := StartSpan(AttachTraceInfo(nil, NewTraceInfo(1, 2, 0)), "call")
+	sp.SetTag("k", "v")
+	sp.LogEvent("retry")
+	sp.Finish()
+	sp.LogEvent("ignored")
+	sp.Finish()
+
+	records := logger.Records()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "finish", records[1].msg)
+		assert.Equal(t, "v", records[1].fields["k"])
+		events := records[1].fields["events"].([]Fields)
+		if assert.Equal(t, 1, len(events)) {
+			assert.Equal(t, "retry", events[0]["event"])
+		}
+	}
+}
+
+func TestSetSpanObserver(t *testing.T) {
+	observer := &testSpanObserver{}
+	SetSpanObserver(observer)
+	defer SetSpanObserver(nil)
+
+	ctx, finish := WithTraceFinish(BeginNewTraceContext(nil), "rpc")
+	traceInfo, _ := TraceInfoFromContext(ctx)
+	failure := errors.New("failure")
+	finish(failure, nil, "done")
+
+	assert.Equal(t, []TraceInfo{traceInfo}, observer.started)
+	assert.Equal(t, []TraceInfo{traceInfo}, observer.finished)
+	assert.Equal(t, failure, observer.lastErr)
+}
+
+type seqIDGenerator struct {
+	last uint64
+}
+
+func (s *seqIDGenerator) NextID() uint64 {
+	return atomic.AddUint64(&s.last, 1)
+}
+
+func TestBeginNewTraceContextSampled(t *testing.T) {
+	ctx := BeginNewTraceContextSampled(nil, 1)
+	_, ok := TraceInfoFromContext(ctx)
+	assert.True(t, ok)
+
+	ctx = BeginNewTraceContextSampled(nil, 0)
+	_, ok = TraceInfoFromContext(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, context.Background(), ctx)
+}
+
+func TestSetIDGenerator(t *testing.T) {
+	SetIDGenerator(&seqIDGenerator{last: 100})
+	defer SetIDGenerator(nil)
+
+	ctx := BeginNewTraceContext(nil)
+	traceInfo := getTraceInfo(ctx)
+	assert.Equal(t, TraceInfo{trace: 101, span: 101, parent: 0}, *traceInfo)
+
+	ctx, _ = WithTrace(ctx, "rpc")
+	traceInfo = getTraceInfo(ctx)
+	assert.Equal(t, TraceInfo{trace: 101, span: 102, parent: 101}, *traceInfo)
+}
+
+func TestTraceInfoRoundTrip(t *testing.T) {
+	_, ok := TraceInfoFromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1000, 2000, 3000))
+	traceInfo, ok := TraceInfoFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1000), traceInfo.TraceID())
+	assert.Equal(t, uint64(2000), traceInfo.SpanID())
+	assert.Equal(t, uint64(3000), traceInfo.ParentID())
+
+	ctx, closeSpan := WithTrace(ctx, "rpc")
+	defer closeSpan("done")
+	traceInfo, ok = TraceInfoFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1000), traceInfo.TraceID())
+	assert.Equal(t, uint64(2000), traceInfo.ParentID())
+	assert.NotEqual(t, uint64(2000), traceInfo.SpanID())
+}
+
+func TestTraceInfoString(t *testing.T) {
+	assert.Equal(t, "trace_id=3e8 span_id=7d0 parent_id=0",
+		NewTraceInfo(1000, 2000, 0).String())
+}
+
+func TestTraceInfo128(t *testing.T) {
+	traceInfo := NewTraceInfo128(0x1, 0xabc, 0xdef, 0)
+	assert.Equal(t, uint64(0x1), traceInfo.TraceIDHigh())
+	assert.Equal(t, uint64(0xabc), traceInfo.TraceID())
+	assert.Equal(t, "trace_id=00000000000000010000000000000abc span_id=def parent_id=0", traceInfo.String())
+
+	fields := make(Fields)
+	setTraceFields(fields, traceInfo)
+	assert.Equal(t, "00000000000000010000000000000abc", fields["trace_id"])
+	assert.Equal(t, "18446744073709554364", TraceIDDecimal.encode128(0x1, 0xabc))
+
+	// the full 32 hex chars are parsed back
+	trace, traceHi, ok := parseHexTraceID(fields["trace_id"].(string))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0xabc), trace)
+	assert.Equal(t, uint64(0x1), traceHi)
+
+	// the high bits are preserved by the child spans
+	ctx, closeSpan := WithTrace(AttachTraceInfo(nil, traceInfo), "rpc")
+	defer closeSpan("done")
+	child, _ := TraceInfoFromContext(ctx)
+	assert.Equal(t, uint64(0x1), child.TraceIDHigh())
+	assert.Equal(t, uint64(0xabc), child.TraceID())
+
+	traceInfo, _ = TraceInfoFromContext(BeginNewTraceContext128(nil))
+	assert.NotEqual(t, uint64(0), traceInfo.TraceIDHigh())
+	assert.Equal(t, traceInfo.TraceID(), traceInfo.SpanID())
+}
+
+func TestSetTraceLogger(t *testing.T) {
+	defaultLogger := TraceLogger()
+	defer SetTraceLogger(defaultLogger)
+
+	logger, _ := newFallbackLogger()
+	SetTraceLogger(logger)
+	assert.Equal(t, logger, TraceLogger())
+
+	SetTraceLogger(nil)
+	assert.Equal(t, NewNopLogger(), TraceLogger())
+
+	ctx, closeSpan := WithTrace(BeginNewTraceContext(nil), "rpc")
+	_, ok := TraceInfoFromContext(ctx)
+	assert.True(t, ok)
+	closeSpan("done")
+}
+
 func BenchmarkTraceWith(b *testing.B) {
 	ctx := BeginNewTraceContext(nil)
 	for n := 0; n < b.N; n++ {
@@ -0,0 +1,173 @@
+package cocaine12
+
+import (
+	"sync"
+	"time"
+)
+
+type traceRecord struct {
+	level  Severity
+	fields Fields
+	msg    string
+	// time is the time of the call, it's kept while the record is pending
+	time time.Time
+}
+
+// timestampFields adds the time of the record
+// unless the fields have a timestamp already
+func timestampFields(fields Fields, t time.Time) Fields {
+	if t.IsZero() {
+		return fields
+	}
+	if _, ok := fields["timestamp"]; ok {
+		return fields
+	}
+
+	result := make(Fields, len(fields)+1)
+	for k, v := range fields {
+		result[k] = v
+	}
+	result["timestamp"] = t.UnixNano()
+	return result
+}
+
+// batchLogger is implemented by loggers, which are able
+// to send several records at once
+type batchLogger interface {
+	logBatch(records []traceRecord)
+}
+
+// traceBatcher accumulates trace records and passes them to the trace logger
+// when maxRecords are pending or maxDelay passes since the first pending record
+type traceBatcher struct {
+	maxDelay time.Duration
+
+	mu sync.Mutex
+	// ring buffer of pending records
+	records []traceRecord
+	head    int
+	size    int
+	timer   *time.Timer
+}
+
+func newTraceBatcher(maxRecords int, maxDelay time.Duration) *traceBatcher {
+	return &traceBatcher{
+		maxDelay: maxDelay,
+		records:  make([]traceRecord, maxRecords),
+	}
+}
+
+func (b *traceBatcher) add(record traceRecord) {
+	b.mu.Lock()
+	b.records[(b.head+b.size)%len(b.records)] = record
+	b.size++
+
+	if b.size == len(b.records) {
+		pending := b.takeLocked()
+		b.mu.Unlock()
+		emitTraceRecords(pending)
+		return
+	}
+
+	if b.size == 1 && b.maxDelay > 0 {
+		b.timer = time.AfterFunc(b.maxDelay, b.flush)
+	}
+	b.mu.Unlock()
+}
+
+func (b *traceBatcher) flush() {
+	b.mu.Lock()
+	pending := b.takeLocked()
+	b.mu.Unlock()
+
+	emitTraceRecords(pending)
+}
+
+func (b *traceBatcher) takeLocked() []traceRecord {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	pending := make([]traceRecord, 0, b.size)
+	for i := 0; i < b.size; i++ {
+		idx := (b.head + i) % len(b.records)
+		pending = append(pending, b.records[idx])
+		b.records[idx] = traceRecord{}
+	}
+	b.head, b.size = 0, 0
+
+	return pending
+}
+
+var (
+	traceBatcherMu sync.RWMutex
+	// nil means that every record is passed to the logger immediately
+	currentTraceBatcher *traceBatcher
+)
+
+// SetTraceBatching makes span records be sent to the trace logger in batches
+// of maxRecords or every maxDelay, whichever comes first.
+// maxRecords less than 2 disables batching, which is the default.
+// Pending records are flushed on the Worker shutdown, client applications
+// should call FlushTraces before exit.
+func SetTraceBatching(maxRecords int, maxDelay time.Duration) {
+	var batcher *traceBatcher
+	if maxRecords > 1 {
+		batcher = newTraceBatcher(maxRecords, maxDelay)
+	}
+
+	traceBatcherMu.Lock()
+	previous := currentTraceBatcher
+	currentTraceBatcher = batcher
+	traceBatcherMu.Unlock()
+
+	if previous != nil {
+		previous.flush()
+	}
+}
+
+// FlushTraces sends the pending span records to the trace logger
+func FlushTraces() {
+	traceBatcherMu.RLock()
+	batcher := currentTraceBatcher
+	traceBatcherMu.RUnlock()
+
+	if batcher != nil {
+		batcher.flush()
+	}
+}
+
+// emitTraceRecord passes the record to the trace logger,
+// t is the timestamp of the record
+func emitTraceRecord(level Severity, fields Fields, msg string, t time.Time) {
+	traceBatcherMu.RLock()
+	batcher := currentTraceBatcher
+	traceBatcherMu.RUnlock()
+
+	if batcher == nil {
+		emitTraceRecords([]traceRecord{{level, fields, msg, t}})
+		return
+	}
+
+	batcher.add(traceRecord{level, fields, msg, t})
+}
+
+func emitTraceRecords(records []traceRecord) {
+	if len(records) == 0 {
+		return
+	}
+
+	logger := traceLog()
+	if batch, ok := logger.(batchLogger); ok {
+		batch.logBatch(records)
+		return
+	}
+
+	// the loggers without batches have no client timestamps
+	for _, record := range records {
+		if logger.V(record.level) {
+			logger.log(record.level, timestampFields(record.fields, record.time), "%s", record.msg)
+		}
+	}
+}
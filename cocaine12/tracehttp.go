@@ -0,0 +1,141 @@
+package cocaine12
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// TraceHTTPHeaders contains names of HTTP headers,
+// which carry hex encoded trace ids
+type TraceHTTPHeaders struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+}
+
+// DefaultTraceHTTPHeaders are the headers used by Cocaine HTTP proxies
+var DefaultTraceHTTPHeaders = TraceHTTPHeaders{
+	TraceID:  "X-Cocaine-Trace-Id",
+	SpanID:   "X-Cocaine-Span-Id",
+	ParentID: "X-Cocaine-Parent-Id",
+}
+
+// B3TraceHTTPHeaders are the headers of Zipkin B3 propagation
+var B3TraceHTTPHeaders = TraceHTTPHeaders{
+	TraceID:  "X-B3-TraceId",
+	SpanID:   "X-B3-SpanId",
+	ParentID: "X-B3-ParentSpanId",
+}
+
+var (
+	traceHTTPHeadersMu sync.RWMutex
+	traceHTTPHeaders   = DefaultTraceHTTPHeaders
+)
+
+// SetTraceHTTPHeaders changes the names of HTTP headers
+// used by TraceInfoFromHTTPHeaders and InjectTraceInfoIntoHTTPHeaders
+func SetTraceHTTPHeaders(names TraceHTTPHeaders) {
+	traceHTTPHeadersMu.Lock()
+	traceHTTPHeaders = names
+	traceHTTPHeadersMu.Unlock()
+}
+
+func getTraceHTTPHeaders() TraceHTTPHeaders {
+	traceHTTPHeadersMu.RLock()
+	defer traceHTTPHeadersMu.RUnlock()
+	return traceHTTPHeaders
+}
+
+// TraceInfoFromHTTPHeaders parses TraceInfo from HTTP headers.
+// Absent or malformed trace and span ids mean that there is no trace.
+// Absent parent id means that the span is a root one.
+func TraceInfoFromHTTPHeaders(h http.Header) (TraceInfo, bool) {
+	return extractTraceInfo(h, getTraceHTTPHeaders())
+}
+
+// InjectTraceInfoIntoHTTPHeaders puts TraceInfo attached to the context
+// into HTTP headers. It does nothing if the context has no TraceInfo.
+func InjectTraceInfoIntoHTTPHeaders(ctx context.Context, h http.Header) {
+	if traceInfo := getTraceInfo(ctx); traceInfo != nil {
+		injectTraceInfo(*traceInfo, h, getTraceHTTPHeaders())
+	}
+}
+
+// ExtractB3 parses TraceInfo from Zipkin B3 headers.
+// Missing or malformed headers mean that there is no trace.
+func ExtractB3(h http.Header) (TraceInfo, bool) {
+	return extractTraceInfo(h, B3TraceHTTPHeaders)
+}
+
+// InjectB3 puts TraceInfo attached to the context into Zipkin B3 headers.
+// It does nothing if the context has no TraceInfo.
+func InjectB3(ctx context.Context, h http.Header) {
+	if traceInfo := getTraceInfo(ctx); traceInfo != nil {
+		injectTraceInfo(*traceInfo, h, B3TraceHTTPHeaders)
+	}
+}
+
+func extractTraceInfo(h http.Header, names TraceHTTPHeaders) (traceInfo TraceInfo, ok bool) {
+	if traceInfo.trace, traceInfo.traceHi, ok = parseHexTraceID(h.Get(names.TraceID)); !ok {
+		return TraceInfo{}, false
+	}
+
+	if traceInfo.span, ok = parseHexID(h.Get(names.SpanID)); !ok {
+		return TraceInfo{}, false
+	}
+
+	if parent := h.Get(names.ParentID); parent != "" {
+		if traceInfo.parent, ok = parseHexID(parent); !ok {
+			return TraceInfo{}, false
+		}
+	}
+
+	return traceInfo, true
+}
+
+func injectTraceInfo(traceInfo TraceInfo, h http.Header, names TraceHTTPHeaders) {
+	h.Set(names.TraceID, traceInfo.traceIDHex())
+	h.Set(names.SpanID, fmt.Sprintf("%x", traceInfo.span))
+	if traceInfo.parent != 0 {
+		h.Set(names.ParentID, fmt.Sprintf("%x", traceInfo.parent))
+	} else {
+		h.Del(names.ParentID)
+	}
+}
+
+// parseHexTraceID parses both 64-bit and 128-bit (more than 16 hex chars) trace ids
+func parseHexTraceID(value string) (trace, traceHi uint64, ok bool) {
+	if len(value) <= 16 {
+		trace, ok = parseHexID(value)
+		return trace, 0, ok
+	}
+
+	if len(value) > 32 {
+		return 0, 0, false
+	}
+
+	split := len(value) - 16
+	if traceHi, ok = parseHexID(value[:split]); !ok {
+		return 0, 0, false
+	}
+	if trace, ok = parseHexID(value[split:]); !ok {
+		return 0, 0, false
+	}
+	return trace, traceHi, true
+}
+
+func parseHexID(value string) (uint64, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(value, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,91 @@
+package cocaine12
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestTraceInfoHTTPHeadersRoundTrip(t *testing.T) {
+	h := make(http.Header)
+	InjectTraceInfoIntoHTTPHeaders(context.Background(), h)
+	assert.Equal(t, 0, len(h))
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(0xabc, 0xdef, 0x123))
+	InjectTraceInfoIntoHTTPHeaders(ctx, h)
+	assert.Equal(t, "abc", h.Get("X-Cocaine-Trace-Id"))
+	assert.Equal(t, "def", h.Get("X-Cocaine-Span-Id"))
+	assert.Equal(t, "123", h.Get("X-Cocaine-Parent-Id"))
+
+	traceInfo, ok := TraceInfoFromHTTPHeaders(h)
+	assert.True(t, ok)
+	assert.Equal(t, NewTraceInfo(0xabc, 0xdef, 0x123), traceInfo)
+}
+
+func TestTraceInfoFromMalformedHTTPHeaders(t *testing.T) {
+	h := make(http.Header)
+	_, ok := TraceInfoFromHTTPHeaders(h)
+	assert.False(t, ok)
+
+	h.Set("X-Cocaine-Trace-Id", "abc")
+	h.Set("X-Cocaine-Span-Id", "xyz")
+	_, ok = TraceInfoFromHTTPHeaders(h)
+	assert.False(t, ok)
+
+	// no parent means a root span
+	h.Set("X-Cocaine-Span-Id", "abc")
+	traceInfo, ok := TraceInfoFromHTTPHeaders(h)
+	assert.True(t, ok)
+	assert.Equal(t, NewTraceInfo(0xabc, 0xabc, 0), traceInfo)
+}
+
+func TestTraceInfo128HTTPHeaders(t *testing.T) {
+	h := make(http.Header)
+	ctx := AttachTraceInfo(nil, NewTraceInfo128(0x4bf92f3577b34da6, 0xa3ce929d0e0e4736, 0xdef, 0))
+	InjectTraceInfoIntoHTTPHeaders(ctx, h)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", h.Get("X-Cocaine-Trace-Id"))
+
+	traceInfo, ok := TraceInfoFromHTTPHeaders(h)
+	assert.True(t, ok)
+	assert.Equal(t, NewTraceInfo128(0x4bf92f3577b34da6, 0xa3ce929d0e0e4736, 0xdef, 0), traceInfo)
+
+	h.Set("X-Cocaine-Trace-Id", "1"+"4bf92f3577b34da6a3ce929d0e0e4736")
+	_, ok = TraceInfoFromHTTPHeaders(h)
+	assert.False(t, ok)
+}
+
+func TestSetTraceHTTPHeaders(t *testing.T) {
+	SetTraceHTTPHeaders(TraceHTTPHeaders{
+		TraceID:  "X-Trace-Id",
+		SpanID:   "X-Span-Id",
+		ParentID: "X-Parent-Id",
+	})
+	defer SetTraceHTTPHeaders(DefaultTraceHTTPHeaders)
+
+	h := make(http.Header)
+	h.Set("X-Trace-Id", "1")
+	h.Set("X-Span-Id", "2")
+	h.Set("X-Parent-Id", "3")
+	traceInfo, ok := TraceInfoFromHTTPHeaders(h)
+	assert.True(t, ok)
+	assert.Equal(t, NewTraceInfo(1, 2, 3), traceInfo)
+}
+
+func TestB3RoundTrip(t *testing.T) {
+	h := make(http.Header)
+	ctx := AttachTraceInfo(nil, NewTraceInfo(0x1a, 0x2b, 0x3c))
+	InjectB3(ctx, h)
+	assert.Equal(t, "1a", h.Get("X-B3-TraceId"))
+	assert.Equal(t, "2b", h.Get("X-B3-SpanId"))
+	assert.Equal(t, "3c", h.Get("X-B3-ParentSpanId"))
+
+	traceInfo, ok := ExtractB3(h)
+	assert.True(t, ok)
+	assert.Equal(t, NewTraceInfo(0x1a, 0x2b, 0x3c), traceInfo)
+
+	h.Set("X-B3-SpanId", "not-a-hex")
+	_, ok = ExtractB3(h)
+	assert.False(t, ok)
+}
@@ -0,0 +1,108 @@
+package cocaine12
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// IDGenerator mints trace and span ids
+type IDGenerator interface {
+	NextID() uint64
+}
+
+// IDGeneratorFunc is an adapter to use ordinary functions as IDGenerator
+type IDGeneratorFunc func() uint64
+
+// NextID calls f()
+func (f IDGeneratorFunc) NextID() uint64 {
+	return f()
+}
+
+type randomIDGenerator struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewRandomIDGenerator returns an IDGenerator, which produces random ids.
+// It's safe for concurrent use.
+func NewRandomIDGenerator(seed int64) IDGenerator {
+	return &randomIDGenerator{
+		rnd: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (r *randomIDGenerator) NextID() uint64 {
+	r.mu.Lock()
+	id := uint64(r.rnd.Int63())
+	r.mu.Unlock()
+	return id
+}
+
+// pooledIDGenerator keeps a pool of sources to avoid
+// lock contention under high concurrency
+type pooledIDGenerator struct {
+	pool sync.Pool
+}
+
+func newPooledIDGenerator() IDGenerator {
+	return &pooledIDGenerator{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return rand.New(rand.NewSource(cryptoSeed()))
+			},
+		},
+	}
+}
+
+func (p *pooledIDGenerator) NextID() uint64 {
+	rnd := p.pool.Get().(*rand.Rand)
+	id := uint64(rnd.Int63())
+	p.pool.Put(rnd)
+	return id
+}
+
+// cryptoSeed makes ids differ between restarts of a process
+func cryptoSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+var (
+	idGeneratorMu sync.RWMutex
+	idGenerator   = newPooledIDGenerator()
+)
+
+// SetIDGenerator replaces the generator of trace and span ids.
+// nil restores the default random one.
+func SetIDGenerator(generator IDGenerator) {
+	if generator == nil {
+		generator = newPooledIDGenerator()
+	}
+
+	idGeneratorMu.Lock()
+	idGenerator = generator
+	idGeneratorMu.Unlock()
+}
+
+// SetTraceIDGenerator is like SetIDGenerator, but accepts a function
+func SetTraceIDGenerator(generator func() uint64) {
+	if generator == nil {
+		SetIDGenerator(nil)
+		return
+	}
+	SetIDGenerator(IDGeneratorFunc(generator))
+}
+
+func nextTraceID() uint64 {
+	idGeneratorMu.RLock()
+	generator := idGenerator
+	idGeneratorMu.RUnlock()
+
+	return generator.NextID()
+}
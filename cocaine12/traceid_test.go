@@ -0,0 +1,48 @@
+package cocaine12
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTraceIDGenerator(t *testing.T) {
+	SetTraceIDGenerator(func() uint64 { return 42 })
+	defer SetTraceIDGenerator(nil)
+
+	traceInfo, _ := TraceInfoFromContext(BeginNewTraceContext(nil))
+	assert.Equal(t, NewTraceInfo(42, 42, 0), traceInfo)
+}
+
+func TestDefaultIDGeneratorIsSeeded(t *testing.T) {
+	// every process starts with a fresh generator
+	first, second := newPooledIDGenerator(), newPooledIDGenerator()
+	assert.NotEqual(t, first.NextID(), second.NextID())
+}
+
+func BenchmarkGlobalRandParallel(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = uint64(rand.Int63())
+		}
+	})
+}
+
+func BenchmarkRandomIDGeneratorParallel(b *testing.B) {
+	generator := NewRandomIDGenerator(1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			generator.NextID()
+		}
+	})
+}
+
+func BenchmarkDefaultIDGeneratorParallel(b *testing.B) {
+	generator := newPooledIDGenerator()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			generator.NextID()
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package cocaine12
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTraceStatsBuckets are the upper bounds of the latency histogram
+// buckets. Spans longer than the last bound fall into the overflow bucket.
+var defaultTraceStatsBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// RPCStats is the snapshot of the spans of an RPC
+type RPCStats struct {
+	Count  uint64
+	Errors uint64
+	// Buckets contains the number of spans per Bounds.
+	// The last item is the overflow bucket.
+	Buckets []uint64
+	// Bounds are the upper bounds of the buckets, see SetTraceStatsBuckets
+	Bounds []time.Duration
+	// P99 is the upper bound of the bucket containing
+	// the 99th percentile of the latency
+	P99 time.Duration
+}
+
+// Percentile returns the upper bound of the bucket containing
+// the given percentile (0-100) of the latency. The overflow bucket
+// is reported as the last bound.
+func (s RPCStats) Percentile(p float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(p / 100 * float64(s.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, n := range s.Buckets {
+		seen += n
+		if seen >= rank {
+			if i < len(s.Bounds) {
+				return s.Bounds[i]
+			}
+			break
+		}
+	}
+
+	if len(s.Bounds) == 0 {
+		return 0
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+type rpcCounters struct {
+	count   uint64
+	errors  uint64
+	buckets []uint64
+	// bounds are shared by the counters, they are never modified
+	bounds []time.Duration
+}
+
+func newRPCCounters(bounds []time.Duration) *rpcCounters {
+	return &rpcCounters{
+		buckets: make([]uint64, len(bounds)+1),
+		bounds:  bounds,
+	}
+}
+
+type traceStatsRegistry struct {
+	mu     sync.RWMutex
+	rpcs   map[string]*rpcCounters
+	bounds []time.Duration
+}
+
+var traceStats = &traceStatsRegistry{
+	rpcs:   make(map[string]*rpcCounters),
+	bounds: defaultTraceStatsBuckets,
+}
+
+func (r *traceStatsRegistry) counters(rpcName string) *rpcCounters {
+	r.mu.RLock()
+	c, ok := r.rpcs[rpcName]
+	r.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok = r.rpcs[rpcName]; !ok {
+		c = newRPCCounters(r.bounds)
+		r.rpcs[rpcName] = c
+	}
+	return c
+}
+
+// record updates the counters of the RPC.
+// Counters are atomic, so spans of the same RPC don't contend on a lock.
+func (r *traceStatsRegistry) record(rpcName string, duration time.Duration, failed bool) {
+	c := r.counters(rpcName)
+
+	bucket := len(c.bounds)
+	for i, bound := range c.bounds {
+		if duration <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	atomic.AddUint64(&c.count, 1)
+	atomic.AddUint64(&c.buckets[bucket], 1)
+	if failed {
+		atomic.AddUint64(&c.errors, 1)
+	}
+}
+
+func (r *traceStatsRegistry) snapshot() map[string]RPCStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := make(map[string]RPCStats, len(r.rpcs))
+	for rpcName, c := range r.rpcs {
+		s := RPCStats{
+			Count:   atomic.LoadUint64(&c.count),
+			Errors:  atomic.LoadUint64(&c.errors),
+			Buckets: make([]uint64, len(c.buckets)),
+			Bounds:  append([]time.Duration(nil), c.bounds...),
+		}
+		for i := range c.buckets {
+			s.Buckets[i] = atomic.LoadUint64(&c.buckets[i])
+		}
+		s.P99 = s.Percentile(99)
+		stats[rpcName] = s
+	}
+
+	return stats
+}
+
+func (r *traceStatsRegistry) reset() {
+	r.mu.Lock()
+	r.rpcs = make(map[string]*rpcCounters)
+	r.mu.Unlock()
+}
+
+func (r *traceStatsRegistry) setBounds(bounds []time.Duration) {
+	r.mu.Lock()
+	r.bounds = bounds
+	r.rpcs = make(map[string]*rpcCounters)
+	r.mu.Unlock()
+}
+
+// SetTraceStatsBuckets sets the upper bounds of the latency histogram
+// buckets in ascending order and clears the statistics. Spans longer
+// than the last bound fall into the overflow bucket. No bounds restore
+// the default ones from 1ms to 10s.
+func SetTraceStatsBuckets(bounds ...time.Duration) {
+	if len(bounds) == 0 {
+		traceStats.setBounds(defaultTraceStatsBuckets)
+		return
+	}
+
+	copied := append([]time.Duration(nil), bounds...)
+	sort.Sort(durations(copied))
+	traceStats.setBounds(copied)
+}
+
+// TraceStats returns the number of spans, failed spans
+// and the latency histogram per RPC name
+func TraceStats() map[string]RPCStats {
+	return traceStats.snapshot()
+}
+
+// ResetTraceStats clears the statistics returned by TraceStats
+func ResetTraceStats() {
+	traceStats.reset()
+}
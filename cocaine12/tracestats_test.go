@@ -0,0 +1,131 @@
+package cocaine12
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceStats(t *testing.T) {
+	_, restore := withTestTraceLogger()
+	defer restore()
+
+	ResetTraceStats()
+	defer ResetTraceStats()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, finish := WithTraceFinish(ctx, "stats")
+			var err error
+			if i%10 == 0 {
+				err = errors.New("failure")
+			}
+			finish(err, nil, "done")
+		}(i)
+	}
+	wg.Wait()
+
+	stats := TraceStats()["stats"]
+	assert.Equal(t, uint64(50), stats.Count)
+	assert.Equal(t, uint64(5), stats.Errors)
+
+	ResetTraceStats()
+	assert.Equal(t, 0, len(TraceStats()))
+}
+
+func TestTraceStatsPercentile(t *testing.T) {
+	ResetTraceStats()
+	defer ResetTraceStats()
+
+	for i := 0; i < 98; i++ {
+		traceStats.record("rpc", 500*time.Microsecond, false)
+	}
+	traceStats.record("rpc", 3*time.Second, false)
+	traceStats.record("rpc", time.Minute, false)
+
+	stats := TraceStats()["rpc"]
+	assert.Equal(t, uint64(98), stats.Buckets[0])
+	assert.Equal(t, uint64(1), stats.Buckets[len(stats.Buckets)-1])
+	assert.Equal(t, 5*time.Second, stats.P99)
+	assert.Equal(t, time.Millisecond, stats.Percentile(50))
+	assert.Equal(t, 10*time.Second, stats.Percentile(100))
+}
+
+func TestSetTraceStatsBuckets(t *testing.T) {
+	ResetTraceStats()
+	defer SetTraceStatsBuckets()
+
+	traceStats.record("rpc", time.Millisecond, false)
+
+	// the counters of the old bounds are dropped
+	SetTraceStatsBuckets(time.Second, 100*time.Millisecond)
+	assert.Equal(t, 0, len(TraceStats()))
+
+	traceStats.record("rpc", 50*time.Millisecond, false)
+	traceStats.record("rpc", time.Minute, false)
+	stats := TraceStats()["rpc"]
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, time.Second}, stats.Bounds)
+	assert.Equal(t, []uint64{1, 0, 1}, stats.Buckets)
+	assert.Equal(t, 100*time.Millisecond, stats.Percentile(50))
+	assert.Equal(t, time.Second, stats.Percentile(100))
+}
+
+func TestSpanAggregator(t *testing.T) {
+	a := NewSpanAggregator(100)
+	for i := 1; i <= 100; i++ {
+		a.Add("rpc", time.Duration(i)*time.Millisecond)
+	}
+
+	assert.Equal(t, SpanPercentiles{
+		Count: 100,
+		P50:   50 * time.Millisecond,
+		P90:   90 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+		Max:   100 * time.Millisecond,
+	}, a.Snapshot()["rpc"])
+
+	// the reservoir is bounded
+	for i := 0; i < 1000; i++ {
+		a.Add("rpc", time.Second)
+	}
+	assert.Equal(t, uint64(1100), a.Snapshot()["rpc"].Count)
+	assert.Equal(t, 100, len(a.rpcs["rpc"].samples))
+
+	a.Reset()
+	assert.Equal(t, 0, len(a.Snapshot()))
+
+	// the maximum is kept even if it's not sampled
+	a = NewSpanAggregator(1)
+	a.Add("rpc", time.Second)
+	for i := 0; i < 1000; i++ {
+		a.Add("rpc", time.Millisecond)
+	}
+	assert.Equal(t, time.Second, a.Snapshot()["rpc"].Max)
+}
+
+func TestSetSpanAggregator(t *testing.T) {
+	_, restore := withTestTraceLogger()
+	defer restore()
+
+	a := NewSpanAggregator(0)
+	SetSpanAggregator(a)
+	defer SetSpanAggregator(nil)
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo(1, 2, 0))
+	_, finish := WithTraceFinish(ctx, "aggregated")
+	finish(nil, nil, "done")
+	assert.Equal(t, uint64(1), a.Snapshot()["aggregated"].Count)
+
+	SetSpanAggregator(nil)
+	_, finish = WithTraceFinish(ctx, "aggregated")
+	finish(nil, nil, "done")
+	assert.Equal(t, uint64(1), a.Snapshot()["aggregated"].Count)
+}
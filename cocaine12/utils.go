@@ -14,11 +14,21 @@ var (
 )
 
 func convertPayload(in interface{}, out interface{}) error {
+	handler := payloadHandler
+	// the extension types are decoded by the registered decoders
+	extHandler, err := payloadExtensionHandler(in)
+	if err != nil {
+		return err
+	}
+	if extHandler != nil {
+		handler = extHandler
+	}
+
 	var buf []byte
-	if err := codec.NewEncoderBytes(&buf, payloadHandler).Encode(in); err != nil {
+	if err := codec.NewEncoderBytes(&buf, handler).Encode(in); err != nil {
 		return err
 	}
-	if err := codec.NewDecoderBytes(buf, payloadHandler).Decode(out); err != nil {
+	if err := codec.NewDecoderBytes(buf, handler).Decode(out); err != nil {
 		return err
 	}
 	return nil
@@ -117,12 +117,16 @@ type Worker struct {
 	debug bool
 	// allow the worker to handle SIGUSR1 to print all goroutines stacks
 	stackSignalEnabled bool
+	// start a span for every traced event
+	autoSpansEnabled bool
 	// protocol version id
 	protoVersion int
 	// protocol dispatcher
 	dispatcher protocolDispather
 	// temination handler
 	terminationHandler TerminationHandler
+	// logger is flushed on termination
+	logger Logger
 }
 
 // NewWorker connects to the cocaine-runtime and create Worker on top of this connection
@@ -205,6 +209,8 @@ func (w *Worker) SetFallbackHandler(handler FallbackEventHandler) {
 
 // call a fallback handler inwith a panic trap
 func (w *Worker) callFallbackHandler(ctx context.Context, event string, request Request, response Response) {
+	ctx, response, finishSpan := w.startEventSpan(ctx, event, response)
+	defer finishSpan()
 	defer trapRecoverAndClose(ctx, event, response, w.debug)
 	w.fallbackHandler(ctx, event, request, response)
 }
@@ -222,10 +228,57 @@ func (w *Worker) EnableStackSignal(enable bool) {
 	w.stackSignalEnabled = enable
 }
 
+// EnableAutoSpans makes the worker start a span named after the event
+// for every request carrying TraceInfo. The span is closed when
+// the handler returns and is marked as failed if the handler replies
+// with an error or panics. Handlers receive the context of the span,
+// so they can start nested spans. It's disabled by default.
+func (w *Worker) EnableAutoSpans(enable bool) {
+	w.autoSpansEnabled = enable
+}
+
+// startEventSpan starts the span of the event if auto spans are enabled.
+// The returned Response tracks errors sent by the handler.
+func (w *Worker) startEventSpan(ctx context.Context, event string, response Response) (context.Context, Response, func()) {
+	if !w.autoSpansEnabled {
+		return ctx, response, func() {}
+	}
+
+	ctx, finishSpan := WithTraceFinish(ctx, event)
+	tracked := &spanResponse{Response: response}
+	return ctx, tracked, func() {
+		finishSpan(tracked.err, nil, "%s", event)
+	}
+}
+
+// spanResponse remembers the error sent to the client
+type spanResponse struct {
+	Response
+	err error
+}
+
+func (s *spanResponse) ErrorMsg(code int, message string) error {
+	if s.err == nil {
+		s.err = &ErrRequest{
+			Message:  message,
+			Category: cworkererrorcategory,
+			Code:     code,
+		}
+	}
+	return s.Response.ErrorMsg(code, message)
+}
+
 func (w *Worker) SetTerminationHandler(handler TerminationHandler) {
 	w.terminationHandler = handler
 }
 
+// SetLogger sets the logger of the application. It's flushed along with
+// the trace logger when the worker is terminated, so the last records
+// are not lost.
+func (w *Worker) SetLogger(logger Logger) {
+	w.logger = logger
+}
+
 // Run makes the worker anounce itself to a cocaine-runtime
 // as being ready to hadnle incoming requests and hablde them
 func (w *Worker) Run(handlers map[string]EventHandler) error {
@@ -233,7 +286,26 @@ func (w *Worker) Run(handlers map[string]EventHandler) error {
 		w.On(event, handler)
 	}
 
-	return w.loop()
+	err := w.loop()
+	// the last spans of the worker must not be lost
+	FlushTraces()
+	return err
+}
+
+// flushLoggers waits for the records to be delivered
+// up to terminationTimeout
+func (w *Worker) flushLoggers() {
+	ctx, cancel := context.WithTimeout(context.Background(), terminationTimeout)
+	defer cancel()
+
+	if err := flushTraceLogger(ctx); err != nil {
+		fmt.Printf("unable to flush the trace logger: %v\n", err)
+	}
+	if w.logger != nil {
+		if err := w.logger.Flush(ctx); err != nil {
+			fmt.Printf("unable to flush the logger: %v\n", err)
+		}
+	}
 }
 
 // Stop makes the Worker stop handling requests
@@ -399,11 +471,13 @@ func (w *Worker) onInvoke(msg *Message) error {
 	}
 
 	go func() {
+		ctx, response, finishSpan := w.startEventSpan(ctx, event, responseStream)
+		defer finishSpan()
 		// this trap catches a panic from a handler
 		// and checks if the response is closed.
-		defer trapRecoverAndClose(ctx, event, responseStream, w.debug)
+		defer trapRecoverAndClose(ctx, event, response, w.debug)
 
-		handler(ctx, requestStream, responseStream)
+		handler(ctx, requestStream, response)
 	}()
 	return nil
 }
@@ -432,6 +506,9 @@ func (w *Worker) onTerminate(msg *Message) {
 		}
 	}
 
+	FlushTraces()
+	w.flushLoggers()
+
 	// According to spec we have time
 	// to prepare for being killed by cocaine-runtime
 	select {
@@ -183,6 +183,115 @@ func TestWorkerV1(t *testing.T) {
 	w.Stop()
 }
 
+func TestWorkerV1AutoSpans(t *testing.T) {
+	logger, restore := withTestTraceLogger()
+	defer restore()
+
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	sock2, _ := newAsyncRW(in)
+	w, err := newWorker(sock, "uuid", 1, true)
+	if err != nil {
+		t.Fatal("unable to create worker", err)
+	}
+	w.EnableAutoSpans(true)
+
+	handlers := map[string]EventHandler{
+		"ok": func(ctx context.Context, req Request, res Response) {
+			traceInfo, _ := TraceInfoFromContext(ctx)
+			assert.Equal(t, uint64(2), traceInfo.ParentID())
+			res.Close()
+		},
+		"fail": func(ctx context.Context, req Request, res Response) {
+			res.ErrorMsg(-100, "dummyError")
+		},
+	}
+	go w.Run(handlers)
+	defer w.Stop()
+
+	// handshake & heartbeat
+	<-sock2.Read()
+	<-sock2.Read()
+
+	for i, event := range []string{"ok", "fail"} {
+		invoke := newInvokeV1(uint64(10+i), event)
+		invoke.Headers = traceInfoToHeaders(NewTraceInfo(1, 2, 0))
+		sock2.Write() <- invoke
+		<-sock2.Read()
+	}
+
+	for i := 0; i < 100 && len(logger.Records()) < 4; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	closing := make(map[string]testLogRecord)
+	for _, record := range logger.Records() {
+		if record.msg != "start" {
+			closing[record.fields["RPC"].(string)] = record
+		}
+	}
+	if assert.Equal(t, 2, len(closing)) {
+		assert.Equal(t, InfoLevel, closing["ok"].level)
+		assert.Equal(t, WarnLevel, closing["fail"].level)
+		assert.Contains(t, closing["fail"].fields["error"], "dummyError")
+	}
+}
+
+// TestWorkerV1TracePropagation checks that the trace headers packed by
+// Service.Call are unpacked into the context of the handler
+func TestWorkerV1TracePropagation(t *testing.T) {
+	_, restore := withTestTraceLogger()
+	defer restore()
+
+	s, peer := newTestService("locator", newLocatorServiceInfo())
+	defer s.Close()
+
+	ctx := AttachTraceInfo(nil, NewTraceInfo128(7, 1000, 2000, 0))
+	_, err := s.Call(ctx, "resolve", "echo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	outgoing := <-peer.Read()
+	sent, err := outgoing.Headers.getTraceData()
+	assert.NoError(t, err)
+
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	sock2, _ := newAsyncRW(in)
+	w, err := newWorker(sock, "uuid", 1, true)
+	if err != nil {
+		t.Fatal("unable to create worker", err)
+	}
+
+	received := make(chan TraceInfo, 1)
+	go w.Run(map[string]EventHandler{
+		"echo": func(ctx context.Context, req Request, res Response) {
+			traceInfo, _ := TraceInfoFromContext(ctx)
+			received <- traceInfo
+			res.Close()
+		},
+	})
+	defer w.Stop()
+
+	// handshake & heartbeat
+	<-sock2.Read()
+	<-sock2.Read()
+
+	invoke := newInvokeV1(10, "echo")
+	invoke.Headers = outgoing.Headers
+	sock2.Write() <- invoke
+
+	select {
+	case traceInfo := <-received:
+		assert.Equal(t, sent, traceInfo)
+		assert.Equal(t, uint64(7), traceInfo.TraceIDHigh())
+		assert.Equal(t, uint64(1000), traceInfo.TraceID())
+		assert.Equal(t, uint64(2000), traceInfo.ParentID())
+	case <-time.After(time.Second):
+		t.Fatal("the handler has not been called")
+	}
+}
+
 func TestWorkerV1Termination(t *testing.T) {
 	const (
 		testID = "uuid"